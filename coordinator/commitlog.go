@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// CommitLog keeps the latest committed messages ordered by their sequence,
+// so a counter signing in again gets only the messages it missed.
+// Sequence is given to a message when its commit is logged,
+// so it has no gaps and only the oldest messages are dropped.
+// Nil *CommitLog is valid and keeps nothing.
+type CommitLog struct {
+	mu       sync.Mutex
+	size     int
+	messages []*Message
+}
+
+func NewCommitLog(size int) *CommitLog {
+	return &CommitLog{size: size}
+}
+
+func (cl *CommitLog) Append(m *Message) {
+	if cl == nil || cl.size <= 0 {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	// recovered commits may be appended again
+	i := sort.Search(len(cl.messages), func(i int) bool {
+		return cl.messages[i].Seq >= m.Seq
+	})
+	if i < len(cl.messages) && cl.messages[i].Seq == m.Seq {
+		return
+	}
+
+	cl.messages = append(cl.messages, nil)
+	copy(cl.messages[i+1:], cl.messages[i:])
+	cl.messages[i] = m
+
+	if len(cl.messages) > cl.size {
+		cl.messages = cl.messages[len(cl.messages)-cl.size:]
+	}
+}
+
+// returns messages after given sequence up to the last one,
+// false when some of them were already dropped
+// or the sequence is not known, e.g. the log was lost
+func (cl *CommitLog) Since(seq uint64, last uint64) ([]*Message, bool) {
+	if seq == last {
+		return []*Message{}, true
+	}
+	if cl == nil || seq > last {
+		return nil, false
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if len(cl.messages) == 0 || cl.messages[0].Seq > seq+1 {
+		return nil, false
+	}
+
+	messages := []*Message{}
+	for _, m := range cl.messages {
+		if m.Seq > seq && m.Seq <= last {
+			messages = append(messages, m)
+		}
+	}
+	if uint64(len(messages)) != last-seq {
+		return nil, false
+	}
+	return messages, true
+}
+
+// returns messages the counter missed since its sequence,
+// falls back to a snapshot with commits still in progress,
+// counter which can pull the snapshot gets address of a populated peer
+// and items of all counters are sent only when there is none,
+// sharded counter gets only items of the tenants it owns
+func (c *Coordinator) catchUp(signIn SignIn) *CatchUp {
+	last := c.lastSeq()
+	if signIn.Seq > 0 {
+		if messages, ok := c.commitLog.Since(signIn.Seq, last); ok {
+			for i, m := range messages {
+				messages[i] = m.shard(signIn.Addr)
+			}
+			return &CatchUp{Seq: last, Messages: messages}
+		}
+		l.Printf("[INFO] Commit log has no messages since %d, sending snapshot", signIn.Seq)
+	}
+
+	// peers store different tenants when sharded
+	catchUp := &CatchUp{Seq: last, Snapshot: true, Messages: []*Message{}}
+	if signIn.PullSnapshot && !c.sharded() {
+		catchUp.Peer = c.populatedPeer(signIn.Addr)
+	}
+	if catchUp.Peer == "" {
+		catchUp.Items, catchUp.Tombstones = c.getItems()
+		if c.sharded() {
+			catchUp.Items = c.owned(signIn.Addr, catchUp.Items)
+		}
+	}
+
+	for _, tx := range c.txlog.InDoubt() {
+		if !tx.decided() {
+			continue
+		}
+
+		m := tx.Message
+		if c.sharded() {
+			part := *m
+			part.Content = c.owned(signIn.Addr, m.Content)
+			part.Shards = nil
+			m = &part
+		}
+		catchUp.Messages = append(catchUp.Messages, m)
+	}
+	return catchUp
+}
+
+// returns random alive counter with items other than given one
+func (c *Coordinator) populatedPeer(except string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	peers := []string{}
+	for _, counter := range c.Counters {
+		if !counter.IsDead && counter.HasItems && counter.Addr != except {
+			peers = append(peers, counter.Addr)
+		}
+	}
+	if len(peers) == 0 {
+		return ""
+	}
+	return peers[rand.Intn(len(peers))]
+}
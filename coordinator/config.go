@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	DataDir           string
+	TxLogRetention    time.Duration
+	HealthInterval    time.Duration
+	RecoveryTries     int16
+	CounterTimeout    time.Duration
+	FanoutParallelism int
+	IdempotencyWindow time.Duration
+	CommitRetryMin    time.Duration
+	CommitRetryMax    time.Duration
+	TxHistory         int
+	Protocol          string
+	ReplicationMode   string
+	Election          string
+	Me                string
+	LeaseDuration     time.Duration
+	CounterService    string
+	WriteQuorum       int
+	ReadQuorum        int
+	ConsistencyWait   time.Duration
+	CommitLogSize     int
+	ReplicationFactor int
+	VirtualNodes      int
+	RebalanceBatch    int
+	RebalanceRetry    time.Duration
+}
+
+// reads configuration from the environment
+func loadConfig() Config {
+	config := Config{
+		DataDir:           env("DATA_DIR", "data"),
+		TxLogRetention:    envDuration("TXLOG_RETENTION", 24*time.Hour),
+		HealthInterval:    envDuration("HEALTH_INTERVAL", 10*time.Second),
+		RecoveryTries:     int16(envInt("RECOVERY_TRIES", 5)),
+		CounterTimeout:    envDuration("COUNTER_TIMEOUT", 1*time.Second),
+		FanoutParallelism: envInt("FANOUT_PARALLELISM", 16),
+		IdempotencyWindow: envDuration("IDEMPOTENCY_WINDOW", 24*time.Hour),
+		CommitRetryMin:    envDuration("COMMIT_RETRY_MIN", 100*time.Millisecond),
+		CommitRetryMax:    envDuration("COMMIT_RETRY_MAX", 10*time.Second),
+		TxHistory:         envInt("TX_HISTORY", 1000),
+		Protocol:          env("COMMIT_PROTOCOL", Protocol2PC),
+		ReplicationMode:   env("REPLICATION_MODE", ReplicationCommit),
+		Election:          env("ELECTION", ElectionNone),
+		Me:                env("COORDINATOR_ADDR", hostname()),
+		LeaseDuration:     envDuration("LEASE_DURATION", 5*time.Second),
+		CounterService:    env("COUNTER_SERVICE", "counter"),
+		WriteQuorum:       envInt("WRITE_QUORUM", 0),
+		ReadQuorum:        envInt("READ_QUORUM", 1),
+		ConsistencyWait:   envDuration("CONSISTENCY_WAIT", 1*time.Second),
+		CommitLogSize:     envInt("COMMIT_LOG_SIZE", 10000),
+		ReplicationFactor: envInt("REPLICATION_FACTOR", 0),
+		VirtualNodes:      envInt("RING_VNODES", 64),
+		RebalanceBatch:    envInt("REBALANCE_BATCH", 1000),
+		RebalanceRetry:    envDuration("REBALANCE_RETRY", 5*time.Second),
+	}
+
+	if config.Protocol != Protocol2PC && config.Protocol != Protocol3PC {
+		l.Printf("[ERROR] Invalid COMMIT_PROTOCOL %s, using %s", config.Protocol, Protocol2PC)
+		config.Protocol = Protocol2PC
+	}
+
+	if config.ReplicationMode != ReplicationCommit && config.ReplicationMode != ReplicationRaft {
+		l.Printf("[ERROR] Invalid REPLICATION_MODE %s, using %s", config.ReplicationMode, ReplicationCommit)
+		config.ReplicationMode = ReplicationCommit
+	}
+
+	// counters which did not prepare would refuse the precommit
+	if config.WriteQuorum > 0 && config.Protocol == Protocol3PC {
+		l.Printf("[ERROR] WRITE_QUORUM is not supported with %s, using all counters", Protocol3PC)
+		config.WriteQuorum = 0
+	}
+
+	// raft group replicates the whole log to every member
+	if config.ReplicationFactor > 0 && config.ReplicationMode == ReplicationRaft {
+		l.Printf("[ERROR] REPLICATION_FACTOR is not supported with %s replication, storing every tenant on every counter", ReplicationRaft)
+		config.ReplicationFactor = 0
+	}
+
+	if config.Election != ElectionNone && config.Election != ElectionLease {
+		l.Printf("[ERROR] Invalid ELECTION %s, using %s", config.Election, ElectionNone)
+		config.Election = ElectionNone
+	}
+
+	return config
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		l.Printf("[ERROR] Cannot obtain hostname: %s", err.Error())
+	}
+	return h
+}
+
+// returns value of the environment variable
+// or given default when it is not set
+func env(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// returns duration parsed from the environment variable
+// or given default when it is not set or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		l.Printf("[ERROR] Invalid %s, using %s: %s", key, def, err.Error())
+		return def
+	}
+	return d
+}
+
+// returns integer parsed from the environment variable
+// or given default when it is not set or invalid
+func envInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		l.Printf("[ERROR] Invalid %s, using %d: %s", key, def, err.Error())
+		return def
+	}
+	return i
+}
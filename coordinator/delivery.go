@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// commit which some counters have not acknowledged yet
+type pendingCommit struct {
+	message  *Message
+	payloads map[string][]byte
+	waiting  map[string]bool
+}
+
+// commits waiting for a single counter, in order of decision
+type commitQueue struct {
+	addr    string
+	commits []*pendingCommit
+}
+
+// Delivery keeps sending decided commits to counters which failed
+// to acknowledge them, with exponential backoff, until every live
+// counter does. Then the transaction is logged as committed.
+type Delivery struct {
+	coordinator *Coordinator
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	mu      sync.Mutex
+	queues  map[string]*commitQueue
+	pending map[string]*pendingCommit
+	stop    chan struct{}
+}
+
+func NewDelivery(c *Coordinator, minBackoff, maxBackoff time.Duration) *Delivery {
+	return &Delivery{
+		coordinator: c,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		queues:      map[string]*commitQueue{},
+		pending:     map[string]*pendingCommit{},
+		stop:        make(chan struct{}),
+	}
+}
+
+// queues the commit for given counters, each with its own payload
+func (d *Delivery) enqueue(m *Message, payloads map[string][]byte, counters []*Counter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.pending[m.ID]
+	if !ok {
+		p = &pendingCommit{message: m, payloads: payloads, waiting: map[string]bool{}}
+		d.pending[m.ID] = p
+	}
+
+	for _, counter := range counters {
+		if p.waiting[counter.Addr] {
+			continue
+		}
+		p.waiting[counter.Addr] = true
+
+		q, ok := d.queues[counter.Addr]
+		if !ok {
+			q = &commitQueue{addr: counter.Addr}
+			d.queues[counter.Addr] = q
+			go d.deliver(q)
+		}
+		q.commits = append(q.commits, p)
+	}
+}
+
+// returns number of commits waiting for acknowledgement per counter
+func (d *Delivery) Pending() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pending := map[string]int{}
+	for addr, q := range d.queues {
+		pending[addr] = len(q.commits)
+	}
+	return pending
+}
+
+// forgets commits waiting for a removed counter
+func (d *Delivery) drop(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	q, ok := d.queues[addr]
+	if !ok {
+		return
+	}
+	for _, p := range q.commits {
+		d.acknowledged(p, addr)
+	}
+	q.commits = nil
+}
+
+func (d *Delivery) Close() {
+	close(d.stop)
+}
+
+// sends queued commits to a single counter one by one,
+// the goroutine ends when the queue is empty or the lease is lost,
+// the new leader delivers commits in doubt from the shared log
+func (d *Delivery) deliver(q *commitQueue) {
+	backoff := d.minBackoff
+	for {
+		d.mu.Lock()
+		if !d.coordinator.leading() {
+			d.forget(q)
+		}
+		if len(q.commits) == 0 {
+			delete(d.queues, q.addr)
+			d.mu.Unlock()
+			return
+		}
+		p := q.commits[0]
+		d.mu.Unlock()
+
+		counter := d.coordinator.counter(q.addr)
+		if counter == nil {
+			d.drop(q.addr)
+			continue
+		}
+
+		results := d.coordinator.fanout([]*Counter{counter}, http.MethodPost, "/commit", p.payloads[q.addr])
+		d.coordinator.history.errors(p.message, PhaseCommitting, results)
+		r := results[0]
+		if r.ok() {
+			d.coordinator.markPopulated(counter)
+
+			d.mu.Lock()
+			// queue may have been dropped in the meantime
+			if len(q.commits) > 0 && q.commits[0] == p {
+				q.commits = q.commits[1:]
+				d.acknowledged(p, q.addr)
+			}
+			d.mu.Unlock()
+
+			backoff = d.minBackoff
+			continue
+		}
+
+		l.Printf("[ERROR] Unable to deliver commit of %s to %s, retry in %s", p.message.ID, r, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-d.stop:
+			return
+		}
+
+		backoff *= 2
+		if backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+	}
+}
+
+// forgets commits of the queue without logging them as committed,
+// must be called with the lock held
+func (d *Delivery) forget(q *commitQueue) {
+	for _, p := range q.commits {
+		delete(p.waiting, q.addr)
+		if len(p.waiting) == 0 {
+			delete(d.pending, p.message.ID)
+		}
+	}
+	q.commits = nil
+}
+
+// must be called with the lock held
+func (d *Delivery) acknowledged(p *pendingCommit, addr string) {
+	delete(p.waiting, addr)
+	if len(p.waiting) > 0 {
+		return
+	}
+
+	delete(d.pending, p.message.ID)
+	if err := d.coordinator.record(p.message, PhaseCommitted); err != nil {
+		l.Printf("[ERROR] Unable to log message %s: %s", p.message.ID, err.Error())
+	}
+	l.Printf("[INFO] Commit of %s delivered to all counters", p.message.ID)
+}
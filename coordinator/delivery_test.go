@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDelivery_Retry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	txlog, err := OpenTxLog(filepath.Join(dir, "txlog"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txlog.Close()
+
+	mu := sync.Mutex{}
+	commits := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		mu.Lock()
+		defer mu.Unlock()
+
+		commits++
+		if commits < 3 {
+			return resp(500)
+		}
+		return resp(200)
+	})
+
+	counter := &Counter{Addr: "counter"}
+	c := &Coordinator{
+		Counters: []*Counter{counter},
+		http:     client,
+		txlog:    txlog,
+	}
+	c.delivery = NewDelivery(c, time.Millisecond, 5*time.Millisecond)
+	defer c.delivery.Close()
+
+	m := &Message{ID: "message-1", Content: Items{{ID: "item-1", Tenant: "test"}}}
+	txlog.Record(m, PhaseCommitting)
+	c.delivery.enqueue(m, map[string][]byte{counter.Addr: []byte(`{}`)}, []*Counter{counter})
+
+	deadline := time.Now().Add(time.Second)
+	for len(c.delivery.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if pending := c.delivery.Pending(); len(pending) > 0 {
+		t.Fatalf("Want commit to be delivered, pending %+v", pending)
+	}
+
+	if tx, _ := txlog.Get(m.ID); tx.Phase != PhaseCommitted {
+		t.Errorf("Want committed, got '%s'", tx.Phase)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if commits != 3 {
+		t.Errorf("Want 3 attempts, got %d", commits)
+	}
+}
+
+func TestDelivery_LostLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	txlog, err := OpenTxLog(filepath.Join(dir, "txlog"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txlog.Close()
+
+	mu := sync.Mutex{}
+	commits := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		mu.Lock()
+		defer mu.Unlock()
+
+		commits++
+		return resp(200)
+	})
+
+	counter := &Counter{Addr: "counter"}
+	c := &Coordinator{
+		Counters: []*Counter{counter},
+		http:     client,
+		txlog:    txlog,
+	}
+	c.delivery = NewDelivery(c, time.Millisecond, 5*time.Millisecond)
+	defer c.delivery.Close()
+
+	m := &Message{ID: "message-1", Content: Items{{ID: "item-1", Tenant: "test"}}}
+	txlog.Record(m, PhaseCommitting)
+
+	// lease of the leader expired, the new leader delivers the commit
+	c.election = &Election{me: "coordinator-1"}
+	txlog.Fence(c.election.IsLeader)
+	c.delivery.enqueue(m, map[string][]byte{counter.Addr: []byte(`{}`)}, []*Counter{counter})
+
+	deadline := time.Now().Add(time.Second)
+	for len(c.delivery.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if pending := c.delivery.Pending(); len(pending) > 0 {
+		t.Fatalf("Want delivery stopped, pending %+v", pending)
+	}
+	if err := txlog.Record(m, PhaseCommitted); err != errFenced {
+		t.Errorf("Want fenced transaction log, got %v", err)
+	}
+	if tx, _ := txlog.Get(m.ID); tx.Phase != PhaseCommitting {
+		t.Errorf("Want committing left in doubt, got '%s'", tx.Phase)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if commits != 0 {
+		t.Errorf("Want no commit sent, got %d", commits)
+	}
+}
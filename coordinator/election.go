@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	ElectionNone  = "none"
+	ElectionLease = "lease"
+)
+
+// lease granted by a counter
+type Lease struct {
+	Holder  string    `json:"holder"`
+	Epoch   uint64    `json:"epoch"`
+	Expires time.Time `json:"expires"`
+}
+
+// epoch the holder asks for, counters never grant a lower one
+type LeaseRequest struct {
+	Holder   string        `json:"holder"`
+	Duration time.Duration `json:"duration"`
+	Epoch    uint64        `json:"epoch,omitempty"`
+}
+
+// header of every request to counters with the epoch of the leader,
+// counters refuse requests of a leader deposed by a later epoch
+const EpochHeader = "X-Coordinator-Epoch"
+
+// Election elects the leader among coordinator replicas.
+// Every replica asks all counters for the lease, the one holding it
+// on the majority of them is the leader until the lease expires.
+// Counters are found with DNS lookup of the counter service,
+// because followers do not know the registry of the leader.
+// The leader counts its lease from the moment it asked for it,
+// so it gives up before any counter would grant the lease to another replica.
+// A candidate asks for an epoch above every epoch it has seen, so the new
+// leader fences off requests of the previous one on the counters it holds.
+// The elected replica takes over in the background, so the renewals go on,
+// and the context of the takeover is cancelled when the lease is lost.
+type Election struct {
+	coordinator *Coordinator
+	me          string
+	duration    time.Duration
+	lookup      func() ([]string, error)
+	elected     func(ctx context.Context)
+
+	mu      sync.RWMutex
+	leader  string
+	expires time.Time
+	epoch   uint64
+	cancel  context.CancelFunc
+}
+
+func NewElection(c *Coordinator, me string, duration time.Duration, service string, elected func(ctx context.Context)) *Election {
+	return &Election{
+		coordinator: c,
+		me:          me,
+		duration:    duration,
+		lookup: func() ([]string, error) {
+			return net.LookupHost(service)
+		},
+		elected: elected,
+	}
+}
+
+// renews the lease three times within its duration,
+// replicas which are not the leader retry after random delay
+// so they do not keep splitting the counters between each other
+func (e *Election) Run() {
+	for {
+		e.acquire()
+
+		d := e.duration / 3
+		if !e.IsLeader() {
+			d += time.Duration(rand.Int63n(int64(e.duration / 3)))
+		}
+		time.Sleep(d)
+	}
+}
+
+// returns counters found in DNS
+func (e *Election) counters() []*Counter {
+	addrs, err := e.lookup()
+	if err != nil {
+		l.Printf("[ERROR] Unable to find counters for election: %s", err.Error())
+		return nil
+	}
+
+	counters := make([]*Counter, 0, len(addrs))
+	for _, addr := range addrs {
+		counters = append(counters, NewCounter(addr))
+	}
+	return counters
+}
+
+func (e *Election) acquire() {
+	counters := e.counters()
+	if len(counters) == 0 {
+		return
+	}
+
+	e.mu.RLock()
+	epoch := e.epoch
+	if !e.isLeader() {
+		epoch++
+	}
+	e.mu.RUnlock()
+
+	payload, err := json.Marshal(&LeaseRequest{Holder: e.me, Duration: e.duration, Epoch: epoch})
+	if err != nil {
+		l.Printf("[ERROR] Unable to marshall lease request: %s", err.Error())
+		return
+	}
+
+	start := time.Now()
+	results := e.coordinator.fanout(counters, http.MethodPost, "/lease", payload)
+
+	granted := 0
+	holders := map[string]int{}
+	grantedEpoch, seenEpoch := uint64(0), uint64(0)
+	for _, r := range results {
+		lease := Lease{}
+		if r.Err != nil || json.Unmarshal(r.Body, &lease) != nil {
+			continue
+		}
+		if lease.Epoch > seenEpoch {
+			seenEpoch = lease.Epoch
+		}
+		if r.ok() && lease.Holder == e.me {
+			granted++
+			if lease.Epoch > grantedEpoch {
+				grantedEpoch = lease.Epoch
+			}
+			continue
+		}
+		if lease.Holder != "" {
+			holders[lease.Holder]++
+		}
+	}
+
+	e.mu.Lock()
+	wasLeader := e.isLeader()
+	if granted >= len(counters)/2+1 {
+		e.leader = e.me
+		e.expires = start.Add(e.duration)
+		// renewal raises the epoch of the counters which granted a lower one
+		if grantedEpoch > e.epoch {
+			e.epoch = grantedEpoch
+		}
+	} else if !wasLeader {
+		// follow the replica holding most of the leases
+		e.leader = ""
+		for holder, n := range holders {
+			if n > holders[e.leader] {
+				e.leader = holder
+			}
+		}
+		if seenEpoch > e.epoch {
+			e.epoch = seenEpoch
+		}
+	}
+	isLeader := e.isLeader()
+	e.mu.Unlock()
+
+	// leases of a lost election would block the other replicas until they expire
+	if !isLeader && granted > 0 {
+		e.release(counters)
+	}
+
+	if isLeader && !wasLeader {
+		l.Printf("[INFO] %s elected as the leader until %s", e.me, e.expires)
+		e.takeOver()
+	}
+	if wasLeader && !isLeader {
+		l.Printf("[INFO] %s lost the lease", e.me)
+	}
+	if !isLeader {
+		e.stepDown()
+	}
+}
+
+// starts the takeover of the new leader, the one of a lease
+// which expired between renewals is cancelled first
+func (e *Election) takeOver() {
+	if e.elected == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.mu.Lock()
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.cancel = cancel
+	e.mu.Unlock()
+
+	go e.elected(ctx)
+}
+
+// cancels the takeover once the lease is lost
+func (e *Election) stepDown() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+}
+
+// must be called with the lock held
+func (e *Election) isLeader() bool {
+	return e.leader == e.me && time.Now().Before(e.expires)
+}
+
+// whether this replica holds a valid lease,
+// nil *Election means the only coordinator is always the leader
+func (e *Election) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.isLeader()
+}
+
+// returns epoch of the lease, zero without election
+func (e *Election) Epoch() uint64 {
+	if e == nil {
+		return 0
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.epoch
+}
+
+// returns address of the leader or empty string when it is not known
+func (e *Election) Leader() string {
+	if e == nil {
+		return ""
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.leader == e.me && !e.isLeader() {
+		return ""
+	}
+	return e.leader
+}
+
+// gives the lease up, so other replica takes over without waiting for expiry
+func (e *Election) Resign() {
+	if e == nil || !e.IsLeader() {
+		return
+	}
+
+	e.mu.Lock()
+	e.expires = time.Time{}
+	e.mu.Unlock()
+
+	e.stepDown()
+	e.release(e.counters())
+}
+
+func (e *Election) release(counters []*Counter) {
+	payload, err := json.Marshal(&LeaseRequest{Holder: e.me})
+	if err != nil {
+		return
+	}
+	e.coordinator.fanout(counters, http.MethodDelete, "/lease", payload)
+}
+
+// Leadership serves requests on the leader and proxies them
+// to the leader on other replicas, health check is always served locally
+type Leadership struct {
+	election *Election
+	next     http.Handler
+}
+
+func NewLeadership(e *Election, next http.Handler) *Leadership {
+	return &Leadership{e, next}
+}
+
+func (h *Leadership) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" || h.election.IsLeader() {
+		h.next.ServeHTTP(rw, r)
+		return
+	}
+
+	leader := h.election.Leader()
+	if leader == "" {
+		l.Println("[ERROR] No leader to handle", r.Method, r.URL)
+		http.Error(rw, status("Leader is not elected"), http.StatusServiceUnavailable)
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: leader})
+	proxy.Transport = h.election.coordinator.http.Transport
+	proxy.ServeHTTP(rw, r)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// counters granting leases the way counters do
+type testLeases struct {
+	mu     sync.Mutex
+	leases map[string]Lease
+	down   map[string]bool
+}
+
+func (s *testLeases) client() *http.Client {
+	return NewTestClient(func(req *http.Request) *http.Response {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.down[req.URL.Host] {
+			return resp(500)
+		}
+
+		lr := LeaseRequest{}
+		json.NewDecoder(req.Body).Decode(&lr)
+		lease := s.leases[req.URL.Host]
+		code := http.StatusOK
+		switch {
+		case req.Method == http.MethodDelete:
+			if lease.Holder == lr.Holder {
+				lease = Lease{Epoch: lease.Epoch}
+			}
+		case lease.Holder == "" || lease.Holder == lr.Holder || time.Now().After(lease.Expires):
+			epoch := lease.Epoch
+			if lease.Holder != lr.Holder {
+				epoch++
+			}
+			if lr.Epoch > epoch {
+				epoch = lr.Epoch
+			}
+			lease = Lease{Holder: lr.Holder, Epoch: epoch, Expires: time.Now().Add(lr.Duration)}
+		default:
+			code = http.StatusConflict
+		}
+		s.leases[req.URL.Host] = lease
+
+		b, _ := json.Marshal(&lease)
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewReader(b)),
+			Header:     make(http.Header),
+		}
+	})
+}
+
+func newTestElection(me string, client *http.Client, elected func(ctx context.Context)) *Election {
+	c := &Coordinator{http: client}
+	e := NewElection(c, me, time.Minute, "counter", elected)
+	e.lookup = func() ([]string, error) {
+		return []string{"counter-1", "counter-2", "counter-3"}, nil
+	}
+	return e
+}
+
+func TestElection_Lease(t *testing.T) {
+	s := &testLeases{leases: map[string]Lease{}, down: map[string]bool{}}
+	client := s.client()
+
+	elected := make(chan context.Context, 2)
+	first := newTestElection("coordinator-1", client, func(ctx context.Context) { elected <- ctx })
+	second := newTestElection("coordinator-2", client, nil)
+
+	first.acquire()
+	second.acquire()
+	var takeover context.Context
+	select {
+	case takeover = <-elected:
+	case <-time.After(time.Second):
+		t.Fatal("Want coordinator-1 to take over")
+	}
+	if !first.IsLeader() {
+		t.Error("Want coordinator-1 elected")
+	}
+	if second.IsLeader() || second.Leader() != "coordinator-1" {
+		t.Errorf("Want coordinator-2 to follow coordinator-1, got '%s'", second.Leader())
+	}
+
+	// renewal with a majority keeps the leader
+	s.down["counter-1"] = true
+	first.acquire()
+	if !first.IsLeader() || len(elected) != 0 {
+		t.Errorf("Want coordinator-1 to stay the leader, got leader %t elected %d more times", first.IsLeader(), len(elected))
+	}
+	if takeover.Err() != nil {
+		t.Errorf("Want takeover of the leader to go on, got %s", takeover.Err())
+	}
+	first.Resign()
+	if takeover.Err() == nil {
+		t.Error("Want takeover cancelled after resignation")
+	}
+	second.acquire()
+	if first.IsLeader() || !second.IsLeader() {
+		t.Errorf("Want coordinator-2 to take over, got leader '%s'", second.Leader())
+	}
+
+	// counter-1 still holds the lease of coordinator-1
+	if second.Epoch() <= first.Epoch() {
+		t.Errorf("Want epoch of coordinator-2 above %d, got %d", first.Epoch(), second.Epoch())
+	}
+}
+
+func TestLeadership_ServeHTTP(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		if req.URL.Host != "coordinator-1" {
+			return resp(500)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"message":"Success"}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	local := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("local"))
+	})
+
+	tt := []struct {
+		name       string
+		leader     string
+		path       string
+		want       string
+		statusCode int
+	}{
+		{
+			name:       "proxied to the leader",
+			leader:     "coordinator-1",
+			path:       "/items",
+			want:       `{"message":"Success"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "health check served locally",
+			leader:     "coordinator-1",
+			path:       "/health",
+			want:       `local`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "no leader",
+			path:       "/items",
+			want:       `{"message":"Leader is not elected"}`,
+			statusCode: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestElection("coordinator-2", client, nil)
+			e.leader = tc.leader
+
+			request := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(`[]`))
+			rr := httptest.NewRecorder()
+			NewLeadership(e, local).ServeHTTP(rr, request)
+
+			if rr.Code != tc.statusCode {
+				t.Errorf("Want status '%d', got '%d'", tc.statusCode, rr.Code)
+			}
+
+			if strings.TrimSpace(rr.Body.String()) != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, rr.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// response of a single counter to a request sent to many of them
+type Result struct {
+	Counter    *Counter
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Err        error
+}
+
+type Results []*Result
+
+func (r *Result) ok() bool {
+	return r.Err == nil && r.StatusCode == http.StatusOK
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("%s: %s", r.Counter.Addr, r.problem())
+}
+
+func (r *Result) problem() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	return fmt.Sprintf("unexpected status code %d", r.StatusCode)
+}
+
+// returns results of counters which did not respond with 200
+func (rs Results) Failed() Results {
+	failed := Results{}
+	for _, r := range rs {
+		if !r.ok() {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// joins all failures into a single error
+func (rs Results) Err() error {
+	failed := rs.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(failed))
+	for _, r := range failed {
+		msgs = append(msgs, r.String())
+	}
+	return fmt.Errorf("%d of %d counters failed: %s", len(failed), len(rs), strings.Join(msgs, "; "))
+}
+
+// sends request to given counters concurrently, at most
+// FanoutParallelism at a time and each one with its own deadline,
+// so the slowest counter bounds the latency instead of the sum of them
+// returns results in the order of counters
+func (c *Coordinator) fanout(counters []*Counter, method string, path string, payload []byte) Results {
+	payloads := make(map[string][]byte, len(counters))
+	for _, counter := range counters {
+		payloads[counter.Addr] = payload
+	}
+	return c.fanoutEach(counters, method, path, payloads)
+}
+
+// like fanout, but every counter gets its own payload
+func (c *Coordinator) fanoutEach(counters []*Counter, method string, path string, payloads map[string][]byte) Results {
+	results := make(Results, len(counters))
+
+	parallelism := c.config.FanoutParallelism
+	if parallelism <= 0 || parallelism > len(counters) {
+		parallelism = len(counters)
+	}
+
+	timeout := c.config.CounterTimeout
+	if timeout <= 0 {
+		timeout = 1 * time.Second
+	}
+
+	sem := make(chan struct{}, parallelism)
+	wg := sync.WaitGroup{}
+	for i, counter := range counters {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, counter *Counter) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			var body io.Reader
+			if payload := payloads[counter.Addr]; payload != nil {
+				body = bytes.NewReader(payload)
+			}
+
+			result := &Result{Counter: counter}
+			url := fmt.Sprintf("http://%s%s", counter.Addr, path)
+			resp, err := c.DoContext(ctx, method, url, body)
+			if err != nil {
+				result.Err = err
+				results[i] = result
+				return
+			}
+			defer resp.Body.Close()
+
+			result.StatusCode = resp.StatusCode
+			result.Header = resp.Header
+			result.Body, result.Err = ioutil.ReadAll(resp.Body)
+			results[i] = result
+		}(i, counter)
+	}
+	wg.Wait()
+
+	return results
+}
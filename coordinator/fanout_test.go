@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCoordinator_fanout(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		time.Sleep(100 * time.Millisecond)
+		if req.URL.Host == "error" {
+			return resp(500)
+		}
+		return resp(200)
+	})
+
+	counters := []*Counter{
+		{Addr: "counter-1"},
+		{Addr: "error"},
+		{Addr: "counter-2"},
+		{Addr: "counter-3"},
+	}
+	c := &Coordinator{
+		Counters: counters,
+		http:     client,
+	}
+
+	start := time.Now()
+	results := c.fanout(counters, http.MethodPost, "/init", []byte(`{}`))
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Want counters to be called concurrently, took %s", elapsed)
+	}
+
+	for i, r := range results {
+		if r.Counter != counters[i] {
+			t.Errorf("Want result %d for %s, got %s", i, counters[i].Addr, r.Counter.Addr)
+		}
+	}
+
+	failed := results.Failed()
+	if len(failed) != 1 || failed[0].Counter.Addr != "error" {
+		t.Errorf("Want only error counter to fail, got %+v", failed)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 )
 
 type ItemsCount struct {
@@ -20,10 +21,54 @@ type CounterAdd struct {
 	coordinator *Coordinator
 }
 
+type Transactions struct {
+	coordinator *Coordinator
+}
+
+type Rebalance struct {
+	rebalancer *Rebalancer
+}
+
+// operator accepts losing items of ranges whose old owners are all dead
+type RebalanceRequest struct {
+	Force bool `json:"force"`
+}
+
+type RingGet struct {
+	coordinator *Coordinator
+}
+
 type HealthCheck struct{}
 
 type Status struct {
-	Message string `json:"message"`
+	Message string   `json:"message"`
+	Reasons []Reason `json:"reasons,omitempty"`
+}
+
+// counter which can pull snapshot from a peer asks for it,
+// so the coordinator does not gather items in its memory
+type SignIn struct {
+	Addr         string `json:"addr"`
+	Seq          uint64 `json:"seq"`
+	PullSnapshot bool   `json:"pullSnapshot,omitempty"`
+}
+
+// messages committed since the sequence of the counter,
+// or items of all counters when the log no longer has them,
+// or peer to pull the snapshot from
+type CatchUp struct {
+	Seq      uint64     `json:"seq"`
+	Snapshot bool       `json:"snapshot"`
+	Peer     string     `json:"peer,omitempty"`
+	Items    Items      `json:"items,omitempty"`
+	Messages []*Message `json:"messages"`
+	// deletes the items may still miss
+	Tombstones []Tombstone `json:"tombstones,omitempty"`
+}
+
+type Outcome struct {
+	ID      string `json:"id"`
+	Outcome string `json:"outcome"`
 }
 
 func NewItemsCount(c *Coordinator) *ItemsCount {
@@ -38,6 +83,18 @@ func NewCounterAdd(c *Coordinator) *CounterAdd {
 	return &CounterAdd{c}
 }
 
+func NewTransactions(c *Coordinator) *Transactions {
+	return &Transactions{c}
+}
+
+func NewRebalance(r *Rebalancer) *Rebalance {
+	return &Rebalance{r}
+}
+
+func NewRingGet(c *Coordinator) *RingGet {
+	return &RingGet{c}
+}
+
 func NewHealthCheck() *HealthCheck {
 	return &HealthCheck{}
 }
@@ -47,6 +104,11 @@ func status(m string) string {
 	return string(j)
 }
 
+func statusWithReasons(m string, reasons []Reason) string {
+	j, _ := json.Marshal(&Status{Message: m, Reasons: reasons})
+	return string(j)
+}
+
 func (h *ItemsCount) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -62,7 +124,33 @@ func (h *ItemsCount) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		count, err := h.coordinator.getItemsCountPerTenant(g[0][1])
+		// client which got the token from POST /items reads its own writes
+		token := r.Header.Get(ConsistencyTokenHeader)
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		var seq uint64
+		if token != "" {
+			v, err := strconv.ParseUint(token, 10, 64)
+			if err != nil {
+				l.Println("[ERROR] Invalid consistency token:", token)
+				http.Error(rw, status("Invalid consistency token"), http.StatusBadRequest)
+				return
+			}
+			seq = v
+		}
+
+		count, err := h.coordinator.getItemsCountPerTenant(g[0][1], seq)
+		if err == errTokenNotApplied {
+			l.Println("[ERROR] Unable to get count:", err.Error())
+			http.Error(rw, status("No counter applied the write yet"), http.StatusServiceUnavailable)
+			return
+		}
+		if err == errNoOwner {
+			l.Println("[ERROR] Unable to get count:", err.Error())
+			http.Error(rw, status("No owner of the tenant is alive"), http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
 			l.Println("[ERROR] Unable to get count:", err.Error())
 			http.Error(rw, status("Unable to get count"), http.StatusInternalServerError)
@@ -82,10 +170,16 @@ func (h *ItemsCount) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 func (h *ItemsAdd) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case http.MethodPost:
+	case http.MethodPost, http.MethodDelete:
 		l.Println("[INFO] Handle", r.Method, r.URL)
 		rw.Header().Set("Content-Type", "application/json")
 
+		// deletes run through the same commit as additions
+		op := ""
+		if r.Method == http.MethodDelete {
+			op = OpDelete
+		}
+
 		items := Items{}
 		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
 			l.Println("[ERROR] Unable to unmarshal json:", err)
@@ -99,27 +193,111 @@ func (h *ItemsAdd) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		m := NewMessage(items)
-		if h.coordinator.canCommit(m) == false {
-			h.coordinator.abort(m)
-			http.Error(rw, status("Unable to add items"), http.StatusInternalServerError)
+		key := r.Header.Get(IdempotencyHeader)
+		if key == "" || h.coordinator.idempotency == nil {
+			m := h.coordinator.newMessage(op, items)
+			code, body := h.add(m)
+			reply(rw, m.ID, m.Seq, code, body)
 			return
 		}
 
-		if err := h.coordinator.commit(m); err != nil {
-			http.Error(rw, status("Unable to add items"), http.StatusInternalServerError)
+		e, fresh, err := h.coordinator.idempotency.begin(key, fingerprint(op, items))
+		if err != nil {
+			l.Printf("[ERROR] Idempotency key %s: %s", key, err.Error())
+			http.Error(rw, status("Idempotency key reused with different items"), http.StatusUnprocessableEntity)
 			return
 		}
 
-		if err := json.NewEncoder(rw).Encode(Status{Message: "Success"}); err != nil {
+		if !fresh {
+			if !e.finished {
+				http.Error(rw, status("Request with this idempotency key is in progress"), http.StatusConflict)
+				return
+			}
+			l.Printf("[INFO] Replay %s for idempotency key %s", e.messageID, key)
+			rw.Header().Set("Idempotent-Replayed", "true")
+			reply(rw, e.messageID, e.seq, e.code, e.body)
 			return
 		}
 
+		m := h.coordinator.newMessage(op, items)
+		code, body := h.add(m)
+		if code == http.StatusInternalServerError && !h.coordinator.decided(m) {
+			// aborted before the decision, nothing was applied and retry is safe
+			h.coordinator.idempotency.forget(key)
+		} else {
+			h.coordinator.idempotency.finish(key, m.ID, m.Seq, code, body)
+		}
+		reply(rw, m.ID, m.Seq, code, body)
+
 	default:
 		rw.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// runs two-phase commit of the message
+// returns status code and body of the response
+func (h *ItemsAdd) add(m *Message) (int, string) {
+	if h.coordinator.config.ReplicationMode == ReplicationRaft {
+		if err := h.coordinator.propose(m); err != nil {
+			l.Printf("[ERROR] Unable to replicate %s: %s", m.ID, err.Error())
+			return http.StatusInternalServerError, status(failure(m))
+		}
+		return http.StatusOK, status("Success")
+	}
+
+	if ok, reasons := h.coordinator.canCommit(m); !ok {
+		h.coordinator.abort(m)
+
+		// conflict when every counter is alive but at least one voted no
+		code := http.StatusConflict
+		for _, r := range reasons {
+			if r.Reason == ReasonUnavailable {
+				code = http.StatusInternalServerError
+			}
+		}
+		if len(reasons) == 0 {
+			code = http.StatusInternalServerError
+		}
+
+		return code, statusWithReasons(failure(m), reasons)
+	}
+
+	if m.Protocol == Protocol3PC {
+		if err := h.coordinator.preCommit(m); err != nil {
+			h.coordinator.abort(m)
+			return http.StatusInternalServerError, status(failure(m))
+		}
+	}
+
+	pending, err := h.coordinator.commit(m)
+	if err != nil {
+		h.coordinator.abort(m)
+		return http.StatusInternalServerError, status(failure(m))
+	}
+
+	// decided but not yet applied by every counter
+	if pending > 0 {
+		return http.StatusAccepted, status("Accepted")
+	}
+
+	return http.StatusOK, status("Success")
+}
+
+// commit sequence of the write is the consistency token,
+// raft writes have none as their reads are linearizable
+func reply(rw http.ResponseWriter, messageID string, seq uint64, code int, body string) {
+	rw.Header().Set("X-Transaction-Id", messageID)
+	if code >= http.StatusBadRequest {
+		http.Error(rw, body, code)
+		return
+	}
+	if seq > 0 {
+		rw.Header().Set(ConsistencyTokenHeader, strconv.FormatUint(seq, 10))
+	}
+	rw.WriteHeader(code)
+	fmt.Fprintln(rw, body)
+}
+
 func (h *CounterAdd) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
@@ -132,12 +310,130 @@ func (h *CounterAdd) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		items := h.coordinator.getItems()
-		counterAddr := string(body)
-		h.coordinator.acceptNewCounter(counterAddr)
-		l.Println("[INFO] New counter accepted:", counterAddr)
+		// counters which do not report their sequence send the address only
+		signIn := SignIn{}
+		if err := json.Unmarshal(body, &signIn); err != nil || signIn.Addr == "" {
+			signIn = SignIn{Addr: string(body)}
+		}
+
+		// accepted first, so it gets every commit decided after the catch-up
+		h.coordinator.acceptNewCounter(signIn.Addr)
+		l.Println("[INFO] New counter accepted:", signIn.Addr)
+
+		catchUp := h.coordinator.catchUp(signIn)
+		if err := json.NewEncoder(rw).Encode(catchUp); err != nil {
+			l.Println("[ERROR] Unable to marshal json:", err)
+			http.Error(rw, status("Unable to marshal json"), http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(rw).Encode(h.coordinator.listCounters()); err != nil {
+			l.Println("[ERROR] Unable to marshal json:", err)
+			http.Error(rw, status("Unable to marshal json"), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Transactions) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		// expect /transactions, /transactions/{id} or /transactions/{id}/outcome
+		reg := regexp.MustCompile(`^\/transactions(?:\/([^\/]+)(\/outcome)?)?\/?$`)
+		g := reg.FindStringSubmatch(r.URL.Path)
+		if g == nil {
+			l.Println("[ERROR] Invalid URI:", r.URL.Path)
+			http.Error(rw, status("Invalid URI"), http.StatusBadRequest)
+			return
+		}
+
+		var response interface{}
+		switch id, outcome := g[1], g[2] != ""; {
+		case id == "":
+			response = h.coordinator.history.List()
+		case outcome:
+			o, ok := h.coordinator.outcome(id)
+			if !ok {
+				http.Error(rw, status("Unknown transaction"), http.StatusNotFound)
+				return
+			}
+			response = o
+		default:
+			tx, ok := h.coordinator.history.Get(id)
+			if !ok {
+				http.Error(rw, status("Unknown transaction"), http.StatusNotFound)
+				return
+			}
+			response = tx
+		}
+
+		if err := json.NewEncoder(rw).Encode(response); err != nil {
+			l.Println("[ERROR] Unable to marshall json:", err)
+			http.Error(rw, status("Unable to marshall json"), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Rebalance) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(rw).Encode(h.rebalancer.Status()); err != nil {
+			l.Println("[ERROR] Unable to marshal json:", err)
+			http.Error(rw, status("Unable to marshal json"), http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		req := RebalanceRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			l.Println("[ERROR] Unable to unmarshal json:", err)
+			http.Error(rw, status("Unable to unmarshal json"), http.StatusBadRequest)
+			return
+		}
+		if !req.Force {
+			http.Error(rw, status("Only forcing the rebalancing is supported"), http.StatusBadRequest)
+			return
+		}
+
+		if !h.rebalancer.Force() {
+			http.Error(rw, status("No ring change pending"), http.StatusConflict)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(rw, status("Rebalancing forced"))
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
 
-		if err := json.NewEncoder(rw).Encode(items); err != nil {
+func (h *RingGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(rw).Encode(h.coordinator.ringView()); err != nil {
 			l.Println("[ERROR] Unable to marshal json:", err)
 			http.Error(rw, status("Unable to marshal json"), http.StatusInternalServerError)
 			return
@@ -151,3 +447,11 @@ func (h *CounterAdd) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 func (h *HealthCheck) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	l.Println("[INFO] Health check")
 }
+
+// message of the response to a failed write
+func failure(m *Message) string {
+	if m.Op == OpDelete {
+		return "Unable to delete items"
+	}
+	return "Unable to add items"
+}
@@ -2,11 +2,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type RoundTripFunc func(req *http.Request) *http.Response
@@ -42,6 +49,8 @@ func TestItemsAdd_ServeHTTP(t *testing.T) {
 			return abortError(req.URL.Path)
 		case "commitError":
 			return commitError(req.URL.Path)
+		case "initRejection":
+			return initRejection(req.URL.Path)
 		default:
 			return resp(500)
 		}
@@ -79,9 +88,20 @@ func TestItemsAdd_ServeHTTP(t *testing.T) {
 				{Addr: "initError", HasItems: true},
 			},
 			body:       `[{"ID":"item-1", "tenant":"tenant-1"}]`,
-			want:       `{"message":"Unable to add items"}`,
+			want:       `{"message":"Unable to add items","reasons":[{"counter":"initError","reason":"unavailable","message":"unexpected status code 500"}]}`,
 			statusCode: http.StatusInternalServerError,
 		},
+		{
+			name:   "counter init rejection",
+			method: http.MethodPost,
+			counters: []*Counter{
+				{Addr: "noError", HasItems: true},
+				{Addr: "initRejection", HasItems: true},
+			},
+			body:       `[{"ID":"item-1", "tenant":"tenant-1"}]`,
+			want:       `{"message":"Unable to add items","reasons":[{"counter":"initRejection","reason":"items_locked","message":"item item-1 of tenant-1 is locked"}]}`,
+			statusCode: http.StatusConflict,
+		},
 		{
 			name:   "counter commit fail",
 			method: http.MethodPost,
@@ -90,8 +110,8 @@ func TestItemsAdd_ServeHTTP(t *testing.T) {
 				{Addr: "commitError", HasItems: true},
 			},
 			body:       `[{"ID":"item-1", "tenant":"tenant-1"}]`,
-			want:       `{"message":"Unable to add items"}`,
-			statusCode: http.StatusInternalServerError,
+			want:       `{"message":"Accepted"}`,
+			statusCode: http.StatusAccepted,
 		},
 		{
 			name:   "counter abort fail",
@@ -101,8 +121,8 @@ func TestItemsAdd_ServeHTTP(t *testing.T) {
 				{Addr: "abortError", HasItems: true},
 			},
 			body:       `[{"ID":"item-1", "tenant":"tenant-1"}]`,
-			want:       `{"message":"Unable to add items"}`,
-			statusCode: http.StatusInternalServerError,
+			want:       `{"message":"Accepted"}`,
+			statusCode: http.StatusAccepted,
 		},
 		{
 			name:   "no counter fail",
@@ -136,6 +156,90 @@ func TestItemsAdd_ServeHTTP(t *testing.T) {
 				Counters: tc.counters,
 				http:     client,
 			}
+			c.delivery = NewDelivery(c, time.Millisecond, time.Millisecond)
+			defer c.delivery.Close()
+			NewItemsAdd(c).ServeHTTP(rr, request)
+
+			if rr.Code != tc.statusCode {
+				t.Errorf("Want status '%d', got '%d'", tc.statusCode, rr.Code)
+			}
+
+			if strings.TrimSpace(rr.Body.String()) != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, rr.Body)
+			}
+		})
+	}
+}
+
+func TestItemsAdd_Idempotency(t *testing.T) {
+	inits := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		if req.URL.Path == "/init" {
+			inits++
+		}
+		return resp(200)
+	})
+
+	c := &Coordinator{
+		Counters:    []*Counter{{Addr: "noError", HasItems: true}},
+		http:        client,
+		idempotency: NewIdempotency(time.Hour),
+	}
+
+	tt := []struct {
+		name       string
+		key        string
+		body       string
+		want       string
+		statusCode int
+		replayed   string
+		inits      int
+	}{
+		{
+			name:       "first request",
+			key:        "key-1",
+			body:       `[{"ID":"item-1", "tenant":"tenant-1"}]`,
+			want:       `{"message":"Success"}`,
+			statusCode: http.StatusOK,
+			replayed:   "",
+			inits:      1,
+		},
+		{
+			name:       "retried request",
+			key:        "key-1",
+			body:       `[{"ID":"item-1", "tenant":"tenant-1"}]`,
+			want:       `{"message":"Success"}`,
+			statusCode: http.StatusOK,
+			replayed:   "true",
+			inits:      1,
+		},
+		{
+			name:       "key reused with different items",
+			key:        "key-1",
+			body:       `[{"ID":"item-2", "tenant":"tenant-1"}]`,
+			want:       `{"message":"Idempotency key reused with different items"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			replayed:   "",
+			inits:      1,
+		},
+		{
+			name:       "another key",
+			key:        "key-2",
+			body:       `[{"ID":"item-1", "tenant":"tenant-1"}]`,
+			want:       `{"message":"Success"}`,
+			statusCode: http.StatusOK,
+			replayed:   "",
+			inits:      2,
+		},
+	}
+
+	ids := map[string]string{}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(tc.body))
+			request.Header.Set(IdempotencyHeader, tc.key)
+			rr := httptest.NewRecorder()
+
 			NewItemsAdd(c).ServeHTTP(rr, request)
 
 			if rr.Code != tc.statusCode {
@@ -145,10 +249,132 @@ func TestItemsAdd_ServeHTTP(t *testing.T) {
 			if strings.TrimSpace(rr.Body.String()) != tc.want {
 				t.Errorf("Want '%s', got '%s'", tc.want, rr.Body)
 			}
+
+			if replayed := rr.Header().Get("Idempotent-Replayed"); replayed != tc.replayed {
+				t.Errorf("Want replayed '%s', got '%s'", tc.replayed, replayed)
+			}
+
+			if inits != tc.inits {
+				t.Errorf("Want %d transactions, got %d", tc.inits, inits)
+			}
+
+			if id := rr.Header().Get("X-Transaction-Id"); tc.replayed != "" && id != ids[tc.key] {
+				t.Errorf("Want transaction '%s', got '%s'", ids[tc.key], id)
+			} else if tc.statusCode == http.StatusOK {
+				ids[tc.key] = id
+			}
 		})
 	}
 }
 
+func TestItemsAdd_ThreePhaseCommit(t *testing.T) {
+	mu := sync.Mutex{}
+	paths := []string{}
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		mu.Lock()
+		defer mu.Unlock()
+
+		paths = append(paths, req.URL.Path)
+		return resp(200)
+	})
+
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "noError", HasItems: true}},
+		config:   Config{Protocol: Protocol3PC},
+		http:     client,
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`[{"ID":"item-1", "tenant":"tenant-1"}]`))
+	rr := httptest.NewRecorder()
+	NewItemsAdd(c).ServeHTTP(rr, request)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Want status '%d', got '%d'", http.StatusOK, rr.Code)
+	}
+
+	if want := []string{"/init", "/precommit", "/commit"}; !reflect.DeepEqual(want, paths) {
+		t.Errorf("Want %+v, got %+v", want, paths)
+	}
+}
+
+func TestItemsAdd_ThreePhaseCommitFailedPreCommit(t *testing.T) {
+	mu := sync.Mutex{}
+	paths := map[string]int{}
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		mu.Lock()
+		defer mu.Unlock()
+
+		paths[req.URL.Path]++
+		if req.URL.Host == "error" && req.URL.Path == "/precommit" {
+			return resp(500)
+		}
+		return resp(200)
+	})
+
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "noError", HasItems: true}, {Addr: "error", HasItems: true}},
+		config:   Config{Protocol: Protocol3PC},
+		http:     client,
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`[{"ID":"item-1", "tenant":"tenant-1"}]`))
+	rr := httptest.NewRecorder()
+	NewItemsAdd(c).ServeHTTP(rr, request)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Want status '%d', got '%d'", http.StatusInternalServerError, rr.Code)
+	}
+
+	// counter which missed the precommit would abort on timeout
+	if want := map[string]int{"/init": 2, "/precommit": 2, "/abort": 2}; !reflect.DeepEqual(want, paths) {
+		t.Errorf("Want %+v, got %+v", want, paths)
+	}
+}
+
+func TestItemsAdd_Raft(t *testing.T) {
+	mu := sync.Mutex{}
+	hosts := []string{}
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		mu.Lock()
+		defer mu.Unlock()
+
+		hosts = append(hosts, req.URL.Host+req.URL.Path)
+		switch req.URL.Host {
+		case "follower":
+			return &http.Response{
+				StatusCode: http.StatusMisdirectedRequest,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"leader":"leader"}`)),
+				Header:     make(http.Header),
+			}
+		case "leader":
+			return resp(200)
+		}
+		return resp(500)
+	})
+
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "dead"}, {Addr: "follower"}, {Addr: "leader"}},
+		config:   Config{ReplicationMode: ReplicationRaft},
+		http:     client,
+	}
+
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`[{"ID":"item-1", "tenant":"tenant-1"}]`))
+		rr := httptest.NewRecorder()
+		NewItemsAdd(c).ServeHTTP(rr, request)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("Want status '%d', got '%d'", http.StatusOK, rr.Code)
+		}
+	}
+
+	// the second proposal goes straight to the cached leader
+	want := []string{"dead/raft/propose", "follower/raft/propose", "leader/raft/propose", "leader/raft/propose"}
+	if !reflect.DeepEqual(want, hosts) {
+		t.Errorf("Want %+v, got %+v", want, hosts)
+	}
+}
+
 func TestItemsCount_ServeHTTP(t *testing.T) {
 	client := NewTestClient(func(req *http.Request) *http.Response {
 		return &http.Response{
@@ -214,6 +440,441 @@ func TestItemsCount_ServeHTTP(t *testing.T) {
 	}
 }
 
+func TestQuorum(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		switch req.URL.Host + req.URL.Path {
+		case "stale/items/tenant/count":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"count":1,"version":1,"applied":1,"seq":1}`)),
+				Header:     make(http.Header),
+			}
+		case "fresh/items/tenant/count":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"count":2,"version":2,"applied":2,"seq":2}`)),
+				Header:     make(http.Header),
+			}
+		case "gap/items/tenant/count":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"count":1,"version":3,"applied":3,"seq":1}`)),
+				Header:     make(http.Header),
+			}
+		case "stale/init", "fresh/init", "stale/commit", "fresh/commit":
+			return resp(200)
+		case "locked/commit":
+			// counter which refused gets the sequence without items
+			m := Message{}
+			if err := json.NewDecoder(req.Body).Decode(&m); err != nil || len(m.Content) > 0 || m.Seq == 0 {
+				return resp(500)
+			}
+			return resp(200)
+		case "locked/init":
+			return &http.Response{
+				StatusCode: http.StatusConflict,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"reason":"items_locked","message":"locked"}`)),
+				Header:     make(http.Header),
+			}
+		}
+		return resp(500)
+	})
+
+	tt := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		counters   []*Counter
+		config     Config
+		want       string
+		token      string
+		statusCode int
+	}{
+		{
+			name:       "write quorum reached",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `[{"ID":"item-1", "tenant":"tenant"}]`,
+			counters:   []*Counter{{Addr: "stale"}, {Addr: "fresh"}, {Addr: "locked"}},
+			config:     Config{WriteQuorum: 2},
+			want:       `{"message":"Success"}`,
+			token:      "1",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "write quorum not reached",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `[{"ID":"item-1", "tenant":"tenant"}]`,
+			counters:   []*Counter{{Addr: "stale"}, {Addr: "dead"}, {Addr: "locked"}},
+			config:     Config{WriteQuorum: 2},
+			want:       `{"message":"Unable to add items","reasons":[{"counter":"dead","reason":"unavailable","message":"unexpected status code 500"},{"counter":"locked","reason":"items_locked","message":"locked"}]}`,
+			statusCode: http.StatusInternalServerError,
+		},
+		{
+			name:       "latest version wins",
+			method:     http.MethodGet,
+			path:       "/items/tenant/count",
+			counters:   []*Counter{{Addr: "stale"}, {Addr: "fresh"}, {Addr: "dead"}},
+			config:     Config{ReadQuorum: 2},
+			want:       `{"count":2,"version":2,"applied":2,"seq":2}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "read quorum not reached",
+			method:     http.MethodGet,
+			path:       "/items/tenant/count",
+			counters:   []*Counter{{Addr: "stale"}, {Addr: "dead"}},
+			config:     Config{ReadQuorum: 2},
+			want:       `{"message":"Unable to get count"}`,
+			statusCode: http.StatusInternalServerError,
+		},
+		{
+			name:       "token applied",
+			method:     http.MethodGet,
+			path:       "/items/tenant/count?token=2",
+			counters:   []*Counter{{Addr: "stale"}, {Addr: "fresh"}},
+			config:     Config{ConsistencyWait: 10 * time.Millisecond},
+			want:       `{"count":2,"version":2,"applied":2,"seq":2}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "token not applied",
+			method:     http.MethodGet,
+			path:       "/items/tenant/count?token=3",
+			counters:   []*Counter{{Addr: "stale"}, {Addr: "fresh"}},
+			config:     Config{ConsistencyWait: 10 * time.Millisecond},
+			want:       `{"message":"No counter applied the write yet"}`,
+			statusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "token missed by commit applied out of order",
+			method:     http.MethodGet,
+			path:       "/items/tenant/count?token=2",
+			counters:   []*Counter{{Addr: "gap"}},
+			config:     Config{ConsistencyWait: 10 * time.Millisecond},
+			want:       `{"message":"No counter applied the write yet"}`,
+			statusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "invalid token",
+			method:     http.MethodGet,
+			path:       "/items/tenant/count?token=abc",
+			counters:   []*Counter{{Addr: "stale"}},
+			want:       `{"message":"Invalid consistency token"}`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			rr := httptest.NewRecorder()
+
+			c := &Coordinator{
+				Counters: tc.counters,
+				config:   tc.config,
+				http:     client,
+			}
+			if tc.method == http.MethodGet {
+				NewItemsCount(c).ServeHTTP(rr, request)
+			} else {
+				NewItemsAdd(c).ServeHTTP(rr, request)
+			}
+
+			if rr.Code != tc.statusCode {
+				t.Errorf("Want status '%d', got '%d'", tc.statusCode, rr.Code)
+			}
+
+			if strings.TrimSpace(rr.Body.String()) != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, rr.Body)
+			}
+
+			if token := rr.Header().Get(ConsistencyTokenHeader); token != tc.token {
+				t.Errorf("Want token '%s', got '%s'", tc.token, token)
+			}
+		})
+	}
+}
+
+func TestItemsAdd_Sharded(t *testing.T) {
+	mu := sync.Mutex{}
+	inits := map[string]Message{}
+	owner := ""
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		switch req.URL.Path {
+		case "/init":
+			m := Message{}
+			json.NewDecoder(req.Body).Decode(&m)
+			mu.Lock()
+			inits[req.URL.Host] = m
+			mu.Unlock()
+		case "/items/tenant-a/count":
+			if req.URL.Host != owner {
+				return resp(500)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"count":1}`)),
+				Header:     make(http.Header),
+			}
+		}
+		return resp(200)
+	})
+
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "counter-1"}, {Addr: "counter-2"}, {Addr: "counter-3"}},
+		config:   Config{ReplicationFactor: 1, VirtualNodes: 64},
+		http:     client,
+	}
+	c.rebuildRing()
+	owner = c.owners("tenant-a")[0]
+
+	body := `[{"ID":"item-1", "tenant":"tenant-a"}, {"ID":"item-2", "tenant":"tenant-b"}, {"ID":"item-3", "tenant":"tenant-c"}]`
+	rr := httptest.NewRecorder()
+	NewItemsAdd(c).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Want status '%d', got '%d': %s", http.StatusOK, rr.Code, rr.Body)
+	}
+
+	// every item goes to the single owner of its tenant
+	stored := 0
+	for addr, m := range inits {
+		if m.Shards != nil {
+			t.Errorf("Want shards stripped from %s payload, got %+v", addr, m.Shards)
+		}
+		for _, i := range m.Content {
+			if owners := c.owners(i.Tenant); len(owners) != 1 || owners[0] != addr {
+				t.Errorf("Want %s stored by %v, got %s", i.Tenant, owners, addr)
+			}
+			stored++
+		}
+	}
+	if stored != 3 {
+		t.Errorf("Want 3 items stored once, got %d in %+v", stored, inits)
+	}
+
+	rr = httptest.NewRecorder()
+	NewItemsCount(c).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/items/tenant-a/count", nil))
+	if want := `{"count":1}`; strings.TrimSpace(rr.Body.String()) != want {
+		t.Errorf("Want '%s', got '%s'", want, rr.Body)
+	}
+}
+
+func TestCounterAdd_ServeHTTP(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		if req.URL.Path == "/tombstones" {
+			return resp(http.StatusNotFound)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`[{"id":"item-1","tenant":"test"},{"id":"item-2","tenant":"test"}]`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	tt := []struct {
+		name string
+		body string
+		addr string
+		want string
+	}{
+		{
+			name: "delta since sequence",
+			body: `{"addr":"counter-2","seq":2}`,
+			addr: "counter-2",
+			want: `{"seq":3,"snapshot":false,"messages":[{"id":"message-3","content":[{"id":"item-2","tenant":"test"}],"seq":3,"timestamp":{"wall":0,"logical":0}}]}`,
+		},
+		{
+			name: "snapshot when log is truncated",
+			body: `{"addr":"counter-2","seq":1}`,
+			addr: "counter-2",
+			want: `{"seq":3,"snapshot":true,"items":[{"id":"item-1","tenant":"test"},{"id":"item-2","tenant":"test"}],"messages":[]}`,
+		},
+		{
+			name: "peer for counter pulling snapshot",
+			body: `{"addr":"counter-2","seq":1,"pullSnapshot":true}`,
+			addr: "counter-2",
+			want: `{"seq":3,"snapshot":true,"peer":"counter-1","messages":[]}`,
+		},
+		{
+			name: "snapshot for address only",
+			body: `counter-3`,
+			addr: "counter-3",
+			want: `{"seq":3,"snapshot":true,"items":[{"id":"item-1","tenant":"test"},{"id":"item-2","tenant":"test"}],"messages":[]}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Coordinator{
+				Counters:  []*Counter{{Addr: "counter-1", HasItems: true}},
+				http:      client,
+				commitLog: NewCommitLog(1),
+			}
+			for seq := uint64(1); seq <= 3; seq++ {
+				m := &Message{ID: fmt.Sprintf("message-%d", seq), Content: Items{{ID: fmt.Sprintf("item-%d", seq-1), Tenant: "test"}}}
+				if err := c.decide(m); err != nil {
+					t.Fatalf("Decide error: %s", err.Error())
+				}
+			}
+
+			request := httptest.NewRequest(http.MethodPost, "/counters", strings.NewReader(tc.body))
+			rr := httptest.NewRecorder()
+			NewCounterAdd(c).ServeHTTP(rr, request)
+
+			if strings.TrimSpace(rr.Body.String()) != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, rr.Body)
+			}
+
+			if c.counter(tc.addr) == nil {
+				t.Errorf("Want %s registered, got %+v", tc.addr, c.listCounters())
+			}
+		})
+	}
+}
+
+func TestTransactions_ServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	txlog, err := OpenTxLog(filepath.Join(dir, "txlog"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txlog.Close()
+
+	c := &Coordinator{txlog: txlog, history: NewHistory(3)}
+	c.record(&Message{ID: "tx-1"}, PhaseCommitting)
+	c.record(&Message{ID: "tx-2"}, PhaseAborted)
+	c.record(&Message{ID: "tx-5"}, PhasePreCommitted)
+	c.record(&Message{ID: "tx-3"}, PhasePrepared)
+	c.history.votes(&Message{ID: "tx-3"}, Results{
+		{Counter: &Counter{Addr: "counter-1"}, StatusCode: 200},
+		{Counter: &Counter{Addr: "counter-2"}, StatusCode: 409, Body: []byte(`{"reason":"items_locked","message":"locked"}`)},
+	})
+	// phases of remembered transactions at a fixed time
+	for _, tx := range c.history.txs {
+		for p := range tx.Phases {
+			tx.Phases[p] = time.Unix(0, 0).UTC()
+		}
+	}
+
+	tt := []struct {
+		name       string
+		method     string
+		path       string
+		want       string
+		statusCode int
+	}{
+		{
+			name:       "wrong HTTP method",
+			method:     http.MethodPost,
+			path:       `/transactions/tx-1/outcome`,
+			want:       ``,
+			statusCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "invalid path",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-1/o`,
+			want:       `{"message":"Invalid URI"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid path after id",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-1/o/outcome`,
+			want:       `{"message":"Invalid URI"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "committed",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-1/outcome`,
+			want:       `{"id":"tx-1","outcome":"committed"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "aborted",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-2/outcome`,
+			want:       `{"id":"tx-2","outcome":"aborted"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "pending",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-3/outcome`,
+			want:       `{"id":"tx-3","outcome":"pending"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "precommitted",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-5/outcome`,
+			want:       `{"id":"tx-5","outcome":"pending"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "precommitted details",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-5`,
+			want:       `{"id":"tx-5","message":{"id":"tx-5","content":null,"timestamp":{"wall":0,"logical":0}},"votes":[],"phases":{"precommitted":"1970-01-01T00:00:00Z"},"errors":[],"outcome":"pending"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "unknown",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-4/outcome`,
+			want:       `{"message":"Unknown transaction"}`,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "details",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-3`,
+			want:       `{"id":"tx-3","message":{"id":"tx-3","content":null,"timestamp":{"wall":0,"logical":0}},"votes":[{"counter":"counter-1","vote":"yes"},{"counter":"counter-2","vote":"no","reason":"items_locked","message":"locked"}],"phases":{"prepared":"1970-01-01T00:00:00Z"},"errors":[],"outcome":"pending"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "forgotten details",
+			method:     http.MethodGet,
+			path:       `/transactions/tx-1`,
+			want:       `{"message":"Unknown transaction"}`,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "list",
+			method:     http.MethodGet,
+			path:       `/transactions`,
+			want:       `[{"id":"tx-3","message":{"id":"tx-3","content":null,"timestamp":{"wall":0,"logical":0}},"votes":[{"counter":"counter-1","vote":"yes"},{"counter":"counter-2","vote":"no","reason":"items_locked","message":"locked"}],"phases":{"prepared":"1970-01-01T00:00:00Z"},"errors":[],"outcome":"pending"},{"id":"tx-5","message":{"id":"tx-5","content":null,"timestamp":{"wall":0,"logical":0}},"votes":[],"phases":{"precommitted":"1970-01-01T00:00:00Z"},"errors":[],"outcome":"pending"},{"id":"tx-2","message":{"id":"tx-2","content":null,"timestamp":{"wall":0,"logical":0}},"votes":[],"phases":{"aborted":"1970-01-01T00:00:00Z"},"errors":[],"outcome":"aborted"}]`,
+			statusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(tc.method, tc.path, nil)
+			rr := httptest.NewRecorder()
+
+			NewTransactions(c).ServeHTTP(rr, request)
+
+			if rr.Code != tc.statusCode {
+				t.Errorf("Want status '%d', got '%d'", tc.statusCode, rr.Code)
+			}
+
+			if strings.TrimSpace(rr.Body.String()) != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, rr.Body)
+			}
+		})
+	}
+}
+
 func TestHealthCheck_ServeHTTP(t *testing.T) {
 	tt := []struct {
 		name       string
@@ -269,6 +930,21 @@ func abortError(p string) *http.Response {
 	}
 }
 
+func initRejection(p string) *http.Response {
+	switch p {
+	case "/init":
+		return &http.Response{
+			StatusCode: 409,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"reason":"items_locked","message":"item item-1 of tenant-1 is locked"}`)),
+			Header:     make(http.Header),
+		}
+	case "/abort":
+		return resp(200)
+	default:
+		return resp(500)
+	}
+}
+
 func commitError(p string) *http.Response {
 	switch p {
 	case "/init":
@@ -279,3 +955,111 @@ func commitError(p string) *http.Response {
 		return resp(500)
 	}
 }
+
+func TestItemsAdd_Delete(t *testing.T) {
+	mu := sync.Mutex{}
+	ops := map[string]string{}
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		mu.Lock()
+		defer mu.Unlock()
+
+		m := Message{}
+		json.NewDecoder(req.Body).Decode(&m)
+		ops[req.URL.Path] = m.Op
+		return resp(200)
+	})
+
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "counter-1", HasItems: true}},
+		http:     client,
+	}
+
+	tt := []struct {
+		name   string
+		method string
+		op     string
+	}{
+		{name: "add", method: http.MethodPost, op: ""},
+		{name: "delete", method: http.MethodDelete, op: OpDelete},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			NewItemsAdd(c).ServeHTTP(rr, httptest.NewRequest(tc.method, "/items", strings.NewReader(`[{"ID":"item-1", "tenant":"tenant-1"}]`)))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Want status '%d', got '%d': %s", http.StatusOK, rr.Code, rr.Body)
+			}
+
+			for _, path := range []string{"/init", "/commit"} {
+				if ops[path] != tc.op {
+					t.Errorf("Want op '%s' on %s, got '%s'", tc.op, path, ops[path])
+				}
+			}
+		})
+	}
+}
+
+func TestCoordinator_getItemsTombstones(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		body := `[]`
+		switch {
+		case req.URL.Path == "/items" && req.URL.Host == "stale":
+			body = `[{"id":"item-1","tenant":"test"},{"id":"item-2","tenant":"test"}]`
+		case req.URL.Path == "/items":
+			body = `[{"id":"item-2","tenant":"test"}]`
+		case req.URL.Path == "/tombstones" && req.URL.Host == "current":
+			body = `[{"id":"item-1","tenant":"test","version":4}]`
+		}
+		r := resp(200)
+		r.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+		return r
+	})
+
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "stale", HasItems: true}, {Addr: "current", HasItems: true}},
+		http:     client,
+	}
+
+	items, tombstones := c.getItems()
+	if want := (Items{{ID: "item-2", Tenant: "test"}}); !reflect.DeepEqual(want, items) {
+		t.Errorf("Want deleted item left out, got %+v", items)
+	}
+	if want := []Tombstone{{ID: "item-1", Tenant: "test", Version: 4}}; !reflect.DeepEqual(want, tombstones) {
+		t.Errorf("Want %+v, got %+v", want, tombstones)
+	}
+}
+
+func TestCoordinator_getItemsAddedAgain(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		bodies := map[string]string{
+			"again/items":        `[{"id":"item-1","tenant":"test"},{"id":"item-3","tenant":"test"}]`,
+			"current/items":      `[]`,
+			"current/tombstones": `[{"id":"item-1","tenant":"test","version":4,"seq":5},{"id":"item-2","tenant":"test","version":3,"seq":3}]`,
+			"stale/items":        `[{"id":"item-2","tenant":"test"}]`,
+		}
+		seqs := map[string]string{"again": "6", "current": "5", "stale": "2"}
+
+		body, ok := bodies[req.URL.Host+req.URL.Path]
+		if !ok {
+			body = `[]`
+		}
+		r := resp(200)
+		r.Header = http.Header{AppliedSeqHeader: []string{seqs[req.URL.Host]}}
+		r.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+		return r
+	})
+
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "again", HasItems: true}, {Addr: "current", HasItems: true}, {Addr: "stale", HasItems: true}},
+		http:     client,
+	}
+
+	items, tombstones := c.getItems()
+	if want := (Items{{ID: "item-1", Tenant: "test"}, {ID: "item-3", Tenant: "test"}}); !reflect.DeepEqual(want, items) {
+		t.Errorf("Want item added again and item of a counter which missed its delete left out, got %+v", items)
+	}
+	if want := []Tombstone{{ID: "item-2", Tenant: "test", Version: 3, Seq: 3}}; !reflect.DeepEqual(want, tombstones) {
+		t.Errorf("Want %+v, got %+v", want, tombstones)
+	}
+}
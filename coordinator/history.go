@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	VoteYes         = "yes"
+	VoteNo          = "no"
+	VoteUnavailable = "unavailable"
+)
+
+// answer of a single counter in the prepare phase
+type Vote struct {
+	Counter string `json:"counter"`
+	Vote    string `json:"vote"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// everything coordinator knows about a transaction
+type TxInfo struct {
+	ID      string              `json:"id"`
+	Message *Message            `json:"message"`
+	Votes   []Vote              `json:"votes"`
+	Phases  map[Phase]time.Time `json:"phases"`
+	Errors  []string            `json:"errors"`
+	Outcome string              `json:"outcome"`
+}
+
+// Bounded history of recent transactions, the oldest ones
+// are forgotten when the limit is reached.
+// Nil *History is valid and remembers nothing.
+type History struct {
+	mu    sync.Mutex
+	limit int
+	txs   map[string]*TxInfo
+	order []string
+}
+
+func NewHistory(limit int) *History {
+	return &History{
+		limit: limit,
+		txs:   map[string]*TxInfo{},
+	}
+}
+
+// must be called with the lock held
+func (h *History) get(m *Message) *TxInfo {
+	if tx, ok := h.txs[m.ID]; ok {
+		return tx
+	}
+
+	tx := &TxInfo{
+		ID:      m.ID,
+		Message: snapshot(m),
+		Votes:   []Vote{},
+		Phases:  map[Phase]time.Time{},
+		Errors:  []string{},
+		Outcome: OutcomePending,
+	}
+	h.txs[m.ID] = tx
+	h.order = append(h.order, m.ID)
+
+	for len(h.order) > h.limit {
+		delete(h.txs, h.order[0])
+		h.order = h.order[1:]
+	}
+	return tx
+}
+
+func (h *History) phase(m *Message, p Phase) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	tx := h.get(m)
+	// later phases show the sequence given by the decision
+	tx.Message = snapshot(m)
+	tx.Phases[p] = time.Now()
+	switch p {
+	case PhaseCommitting, PhaseCommitted:
+		tx.Outcome = OutcomeCommitted
+	case PhaseAborted:
+		tx.Outcome = OutcomeAborted
+	}
+}
+
+func (h *History) votes(m *Message, results Results) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	tx := h.get(m)
+	for _, r := range results {
+		if r.ok() {
+			tx.Votes = append(tx.Votes, Vote{Counter: r.Counter.Addr, Vote: VoteYes})
+			continue
+		}
+
+		reason := rejection(r)
+		vote := Vote{Counter: r.Counter.Addr, Vote: VoteNo, Reason: reason.Reason, Message: reason.Message}
+		if reason.Reason == ReasonUnavailable {
+			vote.Vote = VoteUnavailable
+			vote.Reason = ""
+		}
+		tx.Votes = append(tx.Votes, vote)
+	}
+}
+
+// remembers failures of counters in given phase
+func (h *History) errors(m *Message, p Phase, results Results) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	tx := h.get(m)
+	for _, r := range results.Failed() {
+		tx.Errors = append(tx.Errors, string(p)+": "+r.String())
+	}
+}
+
+// returns copies of remembered transactions, the latest first
+func (h *History) List() []TxInfo {
+	if h == nil {
+		return []TxInfo{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	txs := make([]TxInfo, 0, len(h.order))
+	for i := len(h.order) - 1; i >= 0; i-- {
+		txs = append(txs, h.txs[h.order[i]].copy())
+	}
+	return txs
+}
+
+func (h *History) Get(id string) (TxInfo, bool) {
+	if h == nil {
+		return TxInfo{}, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	tx, ok := h.txs[id]
+	if !ok {
+		return TxInfo{}, false
+	}
+	return tx.copy(), true
+}
+
+// copy of the message as recorded, the caller keeps changing
+// its own one while the history is read
+func snapshot(m *Message) *Message {
+	c := *m
+	return &c
+}
+
+// must be called with the lock held
+func (tx *TxInfo) copy() TxInfo {
+	c := *tx
+	c.Votes = append([]Vote{}, tx.Votes...)
+	c.Errors = append([]string{}, tx.Errors...)
+	c.Phases = map[Phase]time.Time{}
+	for p, t := range tx.Phases {
+		c.Phases[p] = t
+	}
+	return c
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHistory_CopiesMessage(t *testing.T) {
+	h := NewHistory(10)
+	m := &Message{ID: "tx-1", Content: Items{{ID: "item-1", Tenant: "test"}}}
+	h.phase(m, PhasePrepared)
+
+	// history is read while the decision gives the message its sequence
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			json.Marshal(h.List())
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		m.Seq = uint64(i + 1)
+	}
+	<-done
+
+	if tx, _ := h.Get("tx-1"); tx.Message == m || tx.Message.Seq != 0 {
+		t.Errorf("Want copy of the prepared message, got %+v", tx.Message)
+	}
+
+	h.phase(m, PhaseCommitting)
+	if tx, _ := h.Get("tx-1"); tx.Message.Seq != 100 {
+		t.Errorf("Want sequence 100 of the decided message, got %d", tx.Message.Seq)
+	}
+}
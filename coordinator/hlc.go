@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// hybrid logical clock timestamp, wall time in unix nanoseconds
+// and a logical counter ordering events within the same wall time
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+}
+
+func (t Timestamp) Before(o Timestamp) bool {
+	return t.Wall < o.Wall || (t.Wall == o.Wall && t.Logical < o.Logical)
+}
+
+func (t Timestamp) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%s/%d", time.Unix(0, t.Wall).UTC().Format(time.RFC3339Nano), t.Logical)
+}
+
+// Clock is a hybrid logical clock. Its timestamps follow physical time
+// but never go backwards, even when the wall clock does or another
+// coordinator ran ahead of it, so they order transactions across
+// restarts and failovers. Nil *Clock gives zero timestamps.
+type Clock struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	last Timestamp
+}
+
+func NewClock() *Clock {
+	return &Clock{now: time.Now}
+}
+
+// returns timestamp of a local event, e.g. a new transaction
+func (c *Clock) Now() Timestamp {
+	if c == nil {
+		return Timestamp{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wall := c.now().UnixNano(); wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// moves the clock past timestamp received from another node
+func (c *Clock) Update(t Timestamp) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.now().UnixNano()
+	switch {
+	case wall > c.last.Wall && wall > t.Wall:
+		c.last = Timestamp{Wall: wall}
+	case t.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: t.Wall, Logical: t.Logical + 1}
+	case c.last.Wall > t.Wall:
+		c.last.Logical++
+	default:
+		if t.Logical > c.last.Logical {
+			c.last.Logical = t.Logical
+		}
+		c.last.Logical++
+	}
+}
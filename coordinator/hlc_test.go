@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	tt := []struct {
+		name   string
+		last   Timestamp
+		wall   int64
+		remote *Timestamp
+		want   Timestamp
+	}{
+		{
+			name: "local event follows wall clock",
+			last: Timestamp{Wall: 10, Logical: 3},
+			wall: 20,
+			want: Timestamp{Wall: 20},
+		},
+		{
+			name: "local event with wall clock behind",
+			last: Timestamp{Wall: 10, Logical: 3},
+			wall: 5,
+			want: Timestamp{Wall: 10, Logical: 4},
+		},
+		{
+			name:   "remote timestamp ahead",
+			last:   Timestamp{Wall: 10, Logical: 3},
+			wall:   5,
+			remote: &Timestamp{Wall: 30, Logical: 7},
+			want:   Timestamp{Wall: 30, Logical: 8},
+		},
+		{
+			name:   "remote timestamp with the same wall time",
+			last:   Timestamp{Wall: 10, Logical: 3},
+			wall:   5,
+			remote: &Timestamp{Wall: 10, Logical: 9},
+			want:   Timestamp{Wall: 10, Logical: 10},
+		},
+		{
+			name:   "remote timestamp behind",
+			last:   Timestamp{Wall: 10, Logical: 3},
+			wall:   5,
+			remote: &Timestamp{Wall: 8, Logical: 9},
+			want:   Timestamp{Wall: 10, Logical: 4},
+		},
+		{
+			name:   "wall clock ahead of both",
+			last:   Timestamp{Wall: 10, Logical: 3},
+			wall:   40,
+			remote: &Timestamp{Wall: 30, Logical: 9},
+			want:   Timestamp{Wall: 40},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			wall := tc.wall
+			c := &Clock{now: func() time.Time { return time.Unix(0, wall) }, last: tc.last}
+
+			got := Timestamp{}
+			if tc.remote != nil {
+				c.Update(*tc.remote)
+				got = c.last
+			} else {
+				got = c.Now()
+			}
+			if got != tc.want {
+				t.Errorf("Want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCoordinator_checkCountersApplied(t *testing.T) {
+	c := &Coordinator{
+		Counters:  []*Counter{NewCounter("c1"), NewCounter("c2")},
+		clock:     NewClock(),
+		timestamp: Timestamp{Wall: int64(5 * time.Second)},
+		http: NewTestClient(func(req *http.Request) *http.Response {
+			r := resp(http.StatusOK)
+			if req.URL.Host == "c1" {
+				r.Body = ioutil.NopCloser(bytes.NewBufferString(`{"applied":{"wall":3000000000,"logical":1},"seq":4}`))
+			}
+			return r
+		}),
+	}
+
+	c.checkCounters()
+
+	counters := c.listCounters()
+	if want := (Timestamp{Wall: int64(3 * time.Second), Logical: 1}); counters[0].Applied != want {
+		t.Errorf("Want applied %+v, got %+v", want, counters[0].Applied)
+	}
+	if counters[0].Seq != 4 {
+		t.Errorf("Want sequence 4, got %d", counters[0].Seq)
+	}
+	if counters[0].Lag != 2*time.Second {
+		t.Errorf("Want lag 2s, got %s", counters[0].Lag)
+	}
+	if counters[1].Lag != 5*time.Second {
+		t.Errorf("Want lag 5s of counter without timestamp, got %s", counters[1].Lag)
+	}
+	if next := c.clock.Now(); !(Timestamp{Wall: int64(3 * time.Second), Logical: 1}).Before(next) {
+		t.Errorf("Want clock past applied timestamp, got %+v", next)
+	}
+}
+
+func TestCoordinator_checkCountersShardLag(t *testing.T) {
+	applied := `{"applied":{"wall":4000000000}}`
+	c := &Coordinator{
+		Counters: []*Counter{NewCounter("c1"), NewCounter("c2")},
+		config:   Config{ReplicationFactor: 1},
+		clock:    NewClock(),
+		http: NewTestClient(func(req *http.Request) *http.Response {
+			r := resp(http.StatusOK)
+			r.Body = ioutil.NopCloser(bytes.NewBufferString(applied))
+			return r
+		}),
+	}
+	c.decidedAt(&Message{Timestamp: Timestamp{Wall: int64(3 * time.Second)}, Shards: map[string]Items{"c1": {{ID: "item-1", Tenant: "a"}}}})
+	c.decidedAt(&Message{Timestamp: Timestamp{Wall: int64(9 * time.Second)}, Shards: map[string]Items{"c2": {{ID: "item-2", Tenant: "b"}}}})
+
+	c.checkCounters()
+	// restarted counters report less than before
+	applied = `{"applied":{"wall":2000000000}}`
+	c.checkCounters()
+
+	counters := c.listCounters()
+	if want := (Timestamp{Wall: int64(2 * time.Second)}); counters[0].Applied != want {
+		t.Errorf("Want applied %+v as reported, got %+v", want, counters[0].Applied)
+	}
+	if counters[0].Lag != time.Second {
+		t.Errorf("Want lag 1s behind own shard, got %s", counters[0].Lag)
+	}
+	if counters[1].Lag != 7*time.Second {
+		t.Errorf("Want lag 7s behind own shard, got %s", counters[1].Lag)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const IdempotencyHeader = "Idempotency-Key"
+
+var errKeyReused = errors.New("idempotency key reused with different items")
+
+// outcome of a request remembered under its idempotency key
+type idempotent struct {
+	key         string
+	fingerprint string
+	messageID   string
+	seq         uint64
+	code        int
+	body        string
+	finished    bool
+	expires     time.Time
+}
+
+// Remembers outcomes of POST /items for the window,
+// so a retried request gets the original response
+// instead of starting another transaction.
+type Idempotency struct {
+	mu     sync.Mutex
+	window time.Duration
+	keys   map[string]*idempotent
+	// keys in order of expiration
+	queue []*idempotent
+}
+
+func NewIdempotency(window time.Duration) *Idempotency {
+	return &Idempotency{
+		window: window,
+		keys:   map[string]*idempotent{},
+	}
+}
+
+// returns fingerprint of items to detect the key reused for another request
+func fingerprint(op string, items Items) string {
+	b, _ := json.Marshal(items)
+	b = append([]byte(op), b...)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// reserves the key for a new request and returns true,
+// or returns the copy of entry created by a previous request with the same key
+func (i *Idempotency) begin(key string, fingerprint string) (idempotent, bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.expire()
+
+	if e, ok := i.keys[key]; ok {
+		if e.fingerprint != fingerprint {
+			return idempotent{}, false, errKeyReused
+		}
+		return *e, false, nil
+	}
+
+	e := &idempotent{
+		key:         key,
+		fingerprint: fingerprint,
+		expires:     time.Now().Add(i.window),
+	}
+	i.keys[key] = e
+	i.queue = append(i.queue, e)
+	return *e, true, nil
+}
+
+// remembers the response given to the request holding the key
+func (i *Idempotency) finish(key string, messageID string, seq uint64, code int, body string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if e, ok := i.keys[key]; ok {
+		e.messageID = messageID
+		e.seq = seq
+		e.code = code
+		e.body = body
+		e.finished = true
+	}
+}
+
+// releases the key, so the request can be retried
+// when it had no effect on counters
+func (i *Idempotency) forget(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.keys, key)
+}
+
+// must be called with the lock held
+func (i *Idempotency) expire() {
+	now := time.Now()
+	for len(i.queue) > 0 && now.After(i.queue[0].expires) {
+		e := i.queue[0]
+		i.queue = i.queue[1:]
+		if i.keys[e.key] == e {
+			delete(i.keys, e.key)
+		}
+	}
+}
@@ -2,28 +2,53 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"time"
 )
 
 var l = log.New(os.Stdout, "coordinator-", log.LstdFlags)
 
 func main() {
-	c := NewCoordinator()
+	config := loadConfig()
+	txlog, err := OpenTxLog(filepath.Join(config.DataDir, "txlog"), config.TxLogRetention)
+	if err != nil {
+		l.Fatal("[ERROR] Cannot open transaction log:", err.Error())
+	}
+	defer txlog.Close()
+
+	c := NewCoordinator(config, txlog)
+
+	// with several replicas only the elected one recovers and acts
+	var election *Election
+	if config.Election == ElectionLease {
+		election = NewElection(c, config.Me, config.LeaseDuration, config.CounterService, c.takeOver)
+		c.election = election
+		txlog.Fence(election.IsLeader)
+		go election.Run()
+	} else {
+		if err := txlog.Compact(); err != nil {
+			l.Printf("[ERROR] Unable to compact transaction log: %s", err.Error())
+		}
+		c.recover(context.Background())
+	}
 
 	sm := http.NewServeMux()
 	sm.Handle("/items/", NewItemsCount(c))
 	sm.Handle("/items", NewItemsAdd(c))
 	sm.Handle("/counters", NewCounterAdd(c))
+	sm.Handle("/transactions", NewTransactions(c))
+	sm.Handle("/transactions/", NewTransactions(c))
+	sm.Handle("/rebalance", NewRebalance(c.rebalancer))
+	sm.Handle("/ring", NewRingGet(c))
 	sm.Handle("/health", NewHealthCheck())
 
 	s := &http.Server{
 		Addr:         ":80",
-		Handler:      sm,
+		Handler:      NewLeadership(election, sm),
 		IdleTimeout:  120 * time.Second,
 		ReadTimeout:  1 * time.Second,
 		WriteTimeout: 1 * time.Second,
@@ -36,39 +61,38 @@ func main() {
 		}
 	}()
 
+	if config.ReplicationFactor > 0 {
+		go c.rebalancer.Run(election.IsLeader)
+	}
+
 	go func() {
-		for {
-			for range time.Tick(10 * time.Second) {
-				for i, counter := range c.Counters {
-					url := fmt.Sprintf("http://%s/health", counter.Addr)
-					resp, err := c.Do(http.MethodGet, url, nil)
-					if err != nil || resp.StatusCode != 200 {
-						if c.Counters[i].RecoveryTries >= 5 {
-							c.Counters = append(c.Counters[:i], c.Counters[i+1:]...)
-							l.Printf("[INFO] %s removed", counter.Addr)
-							continue
-						}
-						c.Counters[i].IsDead = true
-						c.Counters[i].RecoveryTries++
-						l.Printf("[INFO] %s not query able", counter.Addr)
-						continue
-					}
-					if c.Counters[i].IsDead {
-						c.Counters[i].IsDead = false
-						c.Counters[i].RecoveryTries = 0
-					}
-				}
+		for range time.Tick(config.HealthInterval) {
+			if election.IsLeader() {
+				c.checkCounters()
+			}
+		}
+	}()
+
+	go func() {
+		for range time.Tick(config.TxLogRetention) {
+			if !election.IsLeader() {
+				continue
+			}
+			if err := txlog.Compact(); err != nil {
+				l.Printf("[ERROR] Unable to compact transaction log: %s", err.Error())
 			}
 		}
 	}()
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
 	signal.Notify(sigChan, os.Kill)
 
 	sig := <-sigChan
 	l.Println("Received terminate, graceful shutdown", sig)
 
-	tc, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	tc, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	s.Shutdown(tc)
+	election.Resign()
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// header of POST /items response and GET /items/{tenant}/count request
+// with sequence of the commit of the write the client wants to read
+const ConsistencyTokenHeader = "X-Consistency-Token"
+
+var (
+	errReadQuorum      = errors.New("read quorum not reached")
+	errTokenNotApplied = errors.New("no counter applied the token sequence")
+	errNoOwner         = errors.New("no owner of the tenant is alive")
+)
+
+// sends GET request to every alive counter
+// returns count of the counter which applied the latest write,
+// with W+R>N at least one of R counters has every acknowledged write
+func (c *Coordinator) getQuorumCount(tenantID string) (*Count, error) {
+	latest, responded := c.latestCount(tenantID)
+	if responded < c.config.ReadQuorum || latest == nil {
+		return nil, fmt.Errorf("%w: %d of %d counters responded", errReadQuorum, responded, c.config.ReadQuorum)
+	}
+	return latest, nil
+}
+
+// asks counters until one of them applied given sequence
+// or CONSISTENCY_WAIT passes, counters still waiting for the commit
+// from the delivery queue catch up in the meantime,
+// commits arrive out of order, so the sequence up to which the counter
+// applied every commit is compared, not the highest one it applied
+func (c *Coordinator) getConsistentCount(tenantID string, seq uint64) (*Count, error) {
+	seq = c.readSeq(tenantID, seq)
+	deadline := time.Now().Add(c.config.ConsistencyWait)
+	for {
+		if count := c.appliedCount(tenantID, seq); count != nil {
+			return count, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errTokenNotApplied
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// returns count of a counter which applied every commit up to given sequence
+func (c *Coordinator) appliedCount(tenantID string, seq uint64) *Count {
+	results := c.fanout(c.readers(tenantID), http.MethodGet, fmt.Sprintf("/items/%s/count", tenantID), nil)
+	for _, r := range results {
+		count := Count{}
+		if !r.ok() || json.Unmarshal(r.Body, &count) != nil {
+			continue
+		}
+		if count.Seq >= seq {
+			return &count
+		}
+	}
+	return nil
+}
+
+// returns count with the highest version and number of counters which responded
+func (c *Coordinator) latestCount(tenantID string) (*Count, int) {
+	results := c.fanout(c.readers(tenantID), http.MethodGet, fmt.Sprintf("/items/%s/count", tenantID), nil)
+
+	var latest *Count
+	responded := 0
+	for _, r := range results {
+		if !r.ok() {
+			l.Printf("[ERROR] Cannot get count from %s", r)
+			continue
+		}
+
+		count := Count{}
+		if err := json.Unmarshal(r.Body, &count); err != nil {
+			l.Printf("[ERROR] Cannot unmarshal json from %s: %s", r.Counter.Addr, err.Error())
+			continue
+		}
+
+		responded++
+		if latest == nil || count.Version > latest.Version {
+			latest = &count
+		}
+	}
+
+	return latest, responded
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	ReplicationCommit = "commit"
+	ReplicationRaft   = "raft"
+)
+
+// maximum number of leader redirects followed by a single proposal
+const maxRedirects = 3
+
+var errNoLeader = errors.New("no counter accepted the proposal")
+
+// response of a counter which is not the raft leader
+type notLeader struct {
+	Leader string `json:"leader"`
+}
+
+// forwards the message to the leader of the counters raft group
+// and waits until the group commits it,
+// the last known leader is tried first and other counters after it
+func (c *Coordinator) propose(m *Message) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		l.Printf("[ERROR] Unable to marshall message %+v: %s", m, err.Error())
+		return err
+	}
+
+	c.mu.RLock()
+	candidates := []string{}
+	if c.leader != "" {
+		candidates = append(candidates, c.leader)
+	}
+	c.mu.RUnlock()
+	for _, counter := range c.aliveCounters() {
+		candidates = append(candidates, counter.Addr)
+	}
+
+	tried := map[string]bool{}
+	for _, addr := range candidates {
+		for hop := 0; hop <= maxRedirects && addr != "" && !tried[addr]; hop++ {
+			tried[addr] = true
+
+			leader, err := c.proposeTo(addr, payload)
+			if err != nil {
+				l.Printf("[ERROR] %s refused proposal %s: %s", addr, m.ID, err.Error())
+				break
+			}
+			if leader == "" {
+				c.mu.Lock()
+				c.leader = addr
+				c.mu.Unlock()
+				return nil
+			}
+			addr = leader
+		}
+	}
+
+	return errNoLeader
+}
+
+// returns address of the leader when the counter is not the one
+func (c *Coordinator) proposeTo(addr string, payload []byte) (string, error) {
+	resp, err := c.Do(http.MethodPost, fmt.Sprintf("http://%s/raft/propose", addr), bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return "", nil
+	case http.StatusMisdirectedRequest:
+		nl := notLeader{}
+		if err := json.Unmarshal(body, &nl); err != nil {
+			return "", err
+		}
+		if nl.Leader == "" {
+			return "", errors.New("leader is not known")
+		}
+		return nl.Leader, nil
+	default:
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RebalanceIdle      = "idle"
+	RebalanceStreaming = "streaming"
+	RebalanceDraining  = "draining"
+	RebalanceFailed    = "failed"
+)
+
+var errRingChanged = errors.New("ring changed during rebalancing")
+
+// range of the ring after From up to To, sources own its tenants now,
+// targets get them and drops lose them once the new ring is switched
+type Move struct {
+	From    uint32   `json:"from"`
+	To      uint32   `json:"to"`
+	Sources []string `json:"sources"`
+	Targets []string `json:"targets"`
+	Drops   []string `json:"drops,omitempty"`
+	Items   int      `json:"items"`
+	Done    bool     `json:"done"`
+	// items of the range were lost by a forced switch
+	Lost bool `json:"lost,omitempty"`
+}
+
+type RebalanceStatus struct {
+	State    string    `json:"state"`
+	Members  []string  `json:"members"`
+	Target   []string  `json:"target,omitempty"`
+	Moves    []Move    `json:"moves"`
+	Done     int       `json:"done"`
+	Items    int       `json:"items"`
+	Error    string    `json:"error,omitempty"`
+	Forced   bool      `json:"forced,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// Rebalancer moves tenants when counters join or leave a sharded cluster.
+// For every range of the ring which gets new owners it copies items
+// from an alive old owner in batches, while writes go to old and new owners.
+// Sketches of tenants counted approximately are merged from every old owner.
+// Writes which followed the old ring only are waited for and copied too,
+// then the new ring is switched in one step, so reads move to the new
+// owners at once, and counters which lost a range drop its items.
+// Range whose old owners are all dead fails the rebalancing until
+// an operator forces it, then the range moves empty and its items are lost.
+// Nil *Rebalancer does nothing.
+type Rebalancer struct {
+	coordinator *Coordinator
+	batch       int
+	retry       time.Duration
+	changed     chan struct{}
+
+	mu     sync.Mutex
+	status RebalanceStatus
+	// ring change whose unreadable ranges may be switched empty
+	forced *RingChange
+}
+
+func NewRebalancer(c *Coordinator, batch int, retry time.Duration) *Rebalancer {
+	if batch <= 0 {
+		batch = 1000
+	}
+	return &Rebalancer{
+		coordinator: c,
+		batch:       batch,
+		retry:       retry,
+		changed:     make(chan struct{}, 1),
+		status:      RebalanceStatus{State: RebalanceIdle, Moves: []Move{}},
+	}
+}
+
+// wakes the rebalancer up, changes made in the meantime are merged
+func (r *Rebalancer) notify() {
+	if r == nil {
+		return
+	}
+
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// lets the pending ring change switch ranges without any readable
+// old owner empty, returns false when no change is pending
+func (r *Rebalancer) Force() bool {
+	if r == nil {
+		return false
+	}
+
+	change := r.coordinator.pendingChange()
+	if change == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	r.forced = change
+	r.mu.Unlock()
+	l.Printf("[INFO] Rebalancing to %v forced", change.members)
+
+	r.notify()
+	return true
+}
+
+// whether the ring change was forced
+func (r *Rebalancer) isForced(change *RingChange) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.forced == change
+}
+
+// rebalances after every membership change while leading,
+// failed rebalancing is retried after a while
+func (r *Rebalancer) Run(leading func() bool) {
+	for range r.changed {
+		if !leading() {
+			continue
+		}
+
+		err := r.rebalance()
+		if err == errRingChanged {
+			l.Println("[INFO] Ring changed, rebalancing again")
+			continue
+		}
+		if err != nil {
+			l.Printf("[ERROR] Rebalancing failed, retry in %s: %s", r.retry, err.Error())
+			r.update(func(s *RebalanceStatus) {
+				s.State = RebalanceFailed
+				s.Error = err.Error()
+			})
+			time.AfterFunc(r.retry, r.notify)
+		}
+	}
+}
+
+func (r *Rebalancer) rebalance() error {
+	c := r.coordinator
+	c.mu.RLock()
+	current, members, change := c.ring, c.members, c.pending
+	c.mu.RUnlock()
+	if change == nil {
+		return nil
+	}
+
+	moves := moves(current, change.ring, c.config.ReplicationFactor)
+	forced := r.isForced(change)
+	r.update(func(s *RebalanceStatus) {
+		*s = RebalanceStatus{
+			State:   RebalanceStreaming,
+			Members: members,
+			Target:  change.members,
+			Moves:   append([]Move{}, moves...),
+			Forced:  forced,
+			Started: time.Now(),
+		}
+	})
+	l.Printf("[INFO] Rebalancing %d ranges from %v to %v", len(moves), members, change.members)
+
+	for i := range moves {
+		for _, target := range moves[i].Targets {
+			if err := r.stream(change, &moves[i], i, target); err != nil {
+				return err
+			}
+			if err := r.copySketches(change, &moves[i], i, target); err != nil {
+				return err
+			}
+		}
+		r.update(func(s *RebalanceStatus) {
+			s.Moves[i].Done = true
+			s.Done++
+		})
+	}
+
+	r.update(func(s *RebalanceStatus) {
+		s.State = RebalanceDraining
+	})
+	if err := r.drain(change, moves); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.pending != change {
+		c.mu.Unlock()
+		return errRingChanged
+	}
+	if err := c.txlog.RecordRing(change.members); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.ring, c.members, c.pending = change.ring, change.members, nil
+	c.mu.Unlock()
+	l.Printf("[INFO] Ring switched to %v", change.members)
+
+	r.cleanup(moves)
+	r.mu.Lock()
+	r.forced = nil
+	r.mu.Unlock()
+	r.update(func(s *RebalanceStatus) {
+		s.State = RebalanceIdle
+		s.Members = change.members
+		s.Target = nil
+		s.Finished = time.Now()
+	})
+	return nil
+}
+
+// copies items of the range to the target in batches,
+// from the first old owner which is alive and responds,
+// range without any readable old owner fails the rebalancing,
+// so the ring is not switched to owners which do not have its items,
+// unless the rebalancing was forced
+func (r *Rebalancer) stream(change *RingChange, move *Move, index int, target string) error {
+	// range nobody owned before has nothing to copy
+	if len(move.Sources) == 0 {
+		return nil
+	}
+
+	sources := r.alive(move.Sources)
+	if len(sources) == 0 {
+		return r.lose(change, index, fmt.Errorf("no alive owner of range %d-%d to copy to %s", move.From, move.To, target))
+	}
+
+	var err error
+	for _, source := range sources {
+		after := Item{}
+		for {
+			if r.coordinator.pendingChange() != change {
+				return errRingChanged
+			}
+
+			var items Items
+			items, err = r.page(source, move, after)
+			if err != nil {
+				l.Printf("[ERROR] Unable to read range %d-%d from %s: %s", move.From, move.To, source, err.Error())
+				err = fmt.Errorf("unable to read range %d-%d to copy to %s: %w", move.From, move.To, target, err)
+				break
+			}
+			if len(items) == 0 {
+				return nil
+			}
+
+			if err := r.push(target, items); err != nil {
+				return fmt.Errorf("unable to copy range %d-%d to %s: %w", move.From, move.To, target, err)
+			}
+			r.update(func(s *RebalanceStatus) {
+				s.Moves[index].Items += len(items)
+				s.Items += len(items)
+			})
+
+			if len(items) < r.batch {
+				return nil
+			}
+			after = items[len(items)-1]
+		}
+	}
+	return r.lose(change, index, err)
+}
+
+// merges sketches of the range from every alive old owner into the target,
+// as each of them may have missed some commits, range fails
+// when none of the old owners gives its sketches, unless forced
+func (r *Rebalancer) copySketches(change *RingChange, move *Move, index int, target string) error {
+	sources := r.alive(move.Sources)
+	if len(sources) == 0 {
+		return nil
+	}
+
+	copied := false
+	path := fmt.Sprintf("/range/%d/%d/sketches", move.From, move.To)
+	for _, source := range sources {
+		res := r.coordinator.fanout([]*Counter{NewCounter(source)}, http.MethodGet, path, nil)[0]
+		sketches := map[string]json.RawMessage{}
+		if !res.ok() || json.Unmarshal(res.Body, &sketches) != nil {
+			l.Printf("[ERROR] Unable to read sketches of range %d-%d from %s: %s", move.From, move.To, source, res.problem())
+			continue
+		}
+		copied = true
+		if len(sketches) == 0 {
+			continue
+		}
+
+		res = r.coordinator.fanout([]*Counter{NewCounter(target)}, http.MethodPost, "/range/sketches", res.Body)[0]
+		if !res.ok() {
+			return fmt.Errorf("unable to copy sketches of range %d-%d to %s: %s", move.From, move.To, target, res.problem())
+		}
+	}
+	if !copied {
+		return r.lose(change, index, fmt.Errorf("no old owner of range %d-%d gave its sketches for %s", move.From, move.To, target))
+	}
+	return nil
+}
+
+// fails the move which cannot be read, or reports loss of its items
+// when the rebalancing was forced, so the range moves with what was copied
+func (r *Rebalancer) lose(change *RingChange, index int, err error) error {
+	if !r.isForced(change) {
+		return err
+	}
+
+	l.Printf("[ERROR] Data loss, range switched without its items: %s", err.Error())
+	r.update(func(s *RebalanceStatus) {
+		s.Moves[index].Lost = true
+		s.Error = err.Error()
+	})
+	return nil
+}
+
+// waits until writes which followed the old ring only are decided,
+// then copies their items of moved ranges to the new owners
+func (r *Rebalancer) drain(change *RingChange, moves []Move) error {
+	c := r.coordinator
+	for {
+		if c.pendingChange() != change {
+			return errRingChanged
+		}
+
+		undecided := false
+		for _, tx := range c.txlog.InDoubt() {
+			if !tx.decided() && tx.Message.Version <= change.version {
+				undecided = true
+			}
+		}
+		if !undecided {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	inDoubt := map[string]bool{}
+	for _, tx := range c.txlog.InDoubt() {
+		inDoubt[tx.Message.ID] = true
+	}
+
+	// writes are copied one by one in order, a delete may follow an addition
+	for _, m := range c.txlog.Committed() {
+		if m.Version > change.version || (m.Seq <= change.seq && !inDoubt[m.ID]) {
+			continue
+		}
+
+		targets := map[string]Items{}
+		for _, i := range m.Content {
+			for _, move := range moves {
+				if !inRange(ringHash(i.Tenant), move.From, move.To) {
+					continue
+				}
+				for _, target := range move.Targets {
+					targets[target] = append(targets[target], i)
+				}
+			}
+		}
+
+		for target, items := range targets {
+			if err := r.pushWrite(target, m, items); err != nil {
+				return fmt.Errorf("unable to copy late writes to %s: %w", target, err)
+			}
+		}
+	}
+	return nil
+}
+
+// counters which lost a range drop its items, failures only waste space
+func (r *Rebalancer) cleanup(moves []Move) {
+	for _, move := range moves {
+		for _, addr := range r.alive(move.Drops) {
+			path := fmt.Sprintf("/range/%d/%d", move.From, move.To)
+			results := r.coordinator.fanout([]*Counter{NewCounter(addr)}, http.MethodDelete, path, nil)
+			for _, res := range results.Failed() {
+				l.Printf("[ERROR] Unable to drop range %d-%d from %s", move.From, move.To, res)
+			}
+		}
+	}
+}
+
+func (r *Rebalancer) page(source string, move *Move, after Item) (Items, error) {
+	q := url.Values{}
+	q.Set("limit", fmt.Sprint(r.batch))
+	q.Set("tenant", after.Tenant)
+	q.Set("id", after.ID)
+	path := fmt.Sprintf("/range/%d/%d?%s", move.From, move.To, q.Encode())
+
+	res := r.coordinator.fanout([]*Counter{NewCounter(source)}, http.MethodGet, path, nil)[0]
+	if !res.ok() {
+		return nil, errors.New(res.problem())
+	}
+
+	items := Items{}
+	if err := json.Unmarshal(res.Body, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *Rebalancer) push(target string, items Items) error {
+	return r.post(target, "/range", items)
+}
+
+// copies items of a late write with its version, sequence and operation,
+// so the target neither loses a delete nor an addition made after one
+func (r *Rebalancer) pushWrite(target string, m *Message, items Items) error {
+	q := url.Values{}
+	q.Set("version", fmt.Sprint(m.Version))
+	q.Set("seq", fmt.Sprint(m.Seq))
+	if m.Op != "" {
+		q.Set("op", m.Op)
+	}
+	return r.post(target, "/range?"+q.Encode(), items)
+}
+
+func (r *Rebalancer) post(target string, path string, items Items) error {
+	payload, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	res := r.coordinator.fanout([]*Counter{NewCounter(target)}, http.MethodPost, path, payload)[0]
+	if !res.ok() {
+		return errors.New(res.problem())
+	}
+	return nil
+}
+
+// returns given counters which are registered and alive
+func (r *Rebalancer) alive(addrs []string) []string {
+	alive := []string{}
+	for _, counter := range r.coordinator.aliveCounters() {
+		if contains(addrs, counter.Addr) {
+			alive = append(alive, counter.Addr)
+		}
+	}
+	return alive
+}
+
+func (r *Rebalancer) update(f func(s *RebalanceStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f(&r.status)
+}
+
+func (r *Rebalancer) Status() RebalanceStatus {
+	if r == nil {
+		return RebalanceStatus{State: RebalanceIdle, Moves: []Move{}}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	status.Moves = make([]Move, len(r.status.Moves))
+	copy(status.Moves, r.status.Moves)
+	return status
+}
+
+// returns ring change in progress
+func (c *Coordinator) pendingChange() *RingChange {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.pending
+}
+
+// returns ranges of the ring whose owners differ between the rings,
+// neighbouring ranges with the same owners are merged
+func moves(from *Ring, to *Ring, n int) []Move {
+	points := []uint32{}
+	seen := map[uint32]bool{}
+	for _, r := range []*Ring{from, to} {
+		if r == nil {
+			continue
+		}
+		for _, p := range r.points {
+			if !seen[p] {
+				seen[p] = true
+				points = append(points, p)
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i] < points[j]
+	})
+
+	moves := []Move{}
+	for i, p := range points {
+		prev := points[(i+len(points)-1)%len(points)]
+		old, owners := from.ownersOf(p, n), to.ownersOf(p, n)
+		targets, drops := difference(owners, old), difference(old, owners)
+		if len(targets) == 0 && len(drops) == 0 {
+			continue
+		}
+
+		if len(moves) > 0 {
+			last := &moves[len(moves)-1]
+			if last.To == prev && equal(last.Sources, old) && equal(last.Targets, targets) && equal(last.Drops, drops) {
+				last.To = p
+				continue
+			}
+		}
+		moves = append(moves, Move{From: prev, To: p, Sources: old, Targets: targets, Drops: drops})
+	}
+	return moves
+}
+
+// returns addresses of a missing from b
+func difference(a []string, b []string) []string {
+	diff := []string{}
+	for _, addr := range a {
+		if !contains(b, addr) {
+			diff = append(diff, addr)
+		}
+	}
+	return diff
+}
+
+// whether hash falls into the range of the ring after from up to to,
+// range may wrap around zero and equal ends mean the whole ring
+func inRange(h uint32, from uint32, to uint32) bool {
+	switch {
+	case from == to:
+		return true
+	case from < to:
+		return h > from && h <= to
+	default:
+		return h > from || h <= to
+	}
+}
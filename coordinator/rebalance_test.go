@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMoves(t *testing.T) {
+	from := NewRing([]string{"counter-1", "counter-2", "counter-3"}, 16)
+	to := NewRing([]string{"counter-1", "counter-2", "counter-3", "counter-4"}, 16)
+
+	moved := moves(from, to, 2)
+	if len(moved) == 0 {
+		t.Fatal("Want ranges moved to the new counter, got none")
+	}
+	for _, m := range moved {
+		if len(m.Targets) != 1 || m.Targets[0] != "counter-4" {
+			t.Errorf("Want only counter-4 to gain range %d-%d, got %v", m.From, m.To, m.Targets)
+		}
+		if len(m.Drops) != 1 || !contains(m.Sources, m.Drops[0]) {
+			t.Errorf("Want one old owner to lose range %d-%d, got %v of %v", m.From, m.To, m.Drops, m.Sources)
+		}
+	}
+
+	// every tenant changing owners falls into a moved range
+	for i := 0; i < 1000; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		changed := !equal(from.Owners(tenant, 2), to.Owners(tenant, 2))
+		inMoved := false
+		for _, m := range moved {
+			inMoved = inMoved || inRange(ringHash(tenant), m.From, m.To)
+		}
+		if changed != inMoved {
+			t.Errorf("Want %s moved %t, got %t", tenant, changed, inMoved)
+		}
+	}
+
+	if same := moves(to, to, 2); len(same) != 0 {
+		t.Errorf("Want nothing moved between equal rings, got %+v", same)
+	}
+}
+
+// counters keeping items and sketches in memory and serving ranges of them
+type rangeCounters struct {
+	mu       sync.Mutex
+	items    map[string]map[Item]bool
+	sketches map[string]map[string]json.RawMessage
+}
+
+func (rc *rangeCounters) serve(req *http.Request) *http.Response {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	items := rc.items[req.URL.Host]
+	if items == nil {
+		items = map[Item]bool{}
+		rc.items[req.URL.Host] = items
+	}
+	if rc.sketches == nil {
+		rc.sketches = map[string]map[string]json.RawMessage{}
+	}
+	sketches := rc.sketches[req.URL.Host]
+	if sketches == nil {
+		sketches = map[string]json.RawMessage{}
+		rc.sketches[req.URL.Host] = sketches
+	}
+
+	if req.Method == http.MethodPost && req.URL.Path == "/range/sketches" {
+		posted := map[string]json.RawMessage{}
+		json.NewDecoder(req.Body).Decode(&posted)
+		for tenant, sketch := range posted {
+			sketches[tenant] = sketch
+		}
+		return resp(200)
+	}
+
+	if req.Method == http.MethodPost {
+		posted := Items{}
+		json.NewDecoder(req.Body).Decode(&posted)
+		for _, i := range posted {
+			items[i] = true
+		}
+		return resp(200)
+	}
+
+	g := regexp.MustCompile(`^/range/(\d+)/(\d+)(/sketches)?$`).FindStringSubmatch(req.URL.Path)
+	from, _ := strconv.ParseUint(g[1], 10, 32)
+	to, _ := strconv.ParseUint(g[2], 10, 32)
+
+	inRangeSketches := map[string]json.RawMessage{}
+	for tenant, sketch := range sketches {
+		if !inRange(ringHash(tenant), uint32(from), uint32(to)) {
+			continue
+		}
+		if req.Method == http.MethodDelete {
+			delete(sketches, tenant)
+			continue
+		}
+		inRangeSketches[tenant] = sketch
+	}
+	if g[3] != "" {
+		r := resp(200)
+		b, _ := json.Marshal(inRangeSketches)
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		return r
+	}
+	after := Item{Tenant: req.URL.Query().Get("tenant"), ID: req.URL.Query().Get("id")}
+
+	selected := Items{}
+	for i := range items {
+		if !inRange(ringHash(i.Tenant), uint32(from), uint32(to)) {
+			continue
+		}
+		if req.Method == http.MethodDelete {
+			delete(items, i)
+			continue
+		}
+		if i.Tenant > after.Tenant || (i.Tenant == after.Tenant && i.ID > after.ID) {
+			selected = append(selected, i)
+		}
+	}
+	sort.Slice(selected, func(a, b int) bool {
+		if selected[a].Tenant != selected[b].Tenant {
+			return selected[a].Tenant < selected[b].Tenant
+		}
+		return selected[a].ID < selected[b].ID
+	})
+	if limit, _ := strconv.Atoi(req.URL.Query().Get("limit")); len(selected) > limit {
+		selected = selected[:limit]
+	}
+
+	r := resp(200)
+	b, _ := json.Marshal(selected)
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return r
+}
+
+func TestRebalancer_Rebalance(t *testing.T) {
+	rc := &rangeCounters{items: map[string]map[Item]bool{}}
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "counter-1"}, {Addr: "counter-2"}},
+		config:   Config{ReplicationFactor: 1, VirtualNodes: 16, CounterTimeout: time.Second},
+		http:     NewTestClient(rc.serve),
+	}
+	c.rebalancer = NewRebalancer(c, 3, time.Second)
+	c.rebuildRing()
+
+	tenants := []string{}
+	for i := 0; i < 20; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		tenants = append(tenants, tenant)
+		owner := c.owners(tenant)[0]
+		if rc.items[owner] == nil {
+			rc.items[owner] = map[Item]bool{}
+		}
+		for j := 0; j < 5; j++ {
+			rc.items[owner][Item{ID: fmt.Sprintf("item-%d", j), Tenant: tenant}] = true
+		}
+	}
+	// approximate tenants are kept in sketches only
+	rc.sketches = map[string]map[string]json.RawMessage{}
+	for _, tenant := range tenants {
+		owner := c.owners(tenant)[0]
+		if rc.sketches[owner] == nil {
+			rc.sketches[owner] = map[string]json.RawMessage{}
+		}
+		rc.sketches[owner][tenant] = json.RawMessage(`{"registers":"` + tenant + `"}`)
+	}
+
+	c.acceptNewCounter("counter-3")
+	if c.pendingChange() == nil {
+		t.Fatal("Want ring change pending, got none")
+	}
+
+	// reads stay on the old ring until the items moved
+	before := map[string]string{}
+	for _, tenant := range tenants {
+		before[tenant] = c.readers(tenant)[0].Addr
+	}
+	if err := c.rebalancer.rebalance(); err != nil {
+		t.Fatalf("Rebalance error: %s", err.Error())
+	}
+
+	moved := 0
+	for _, tenant := range tenants {
+		owner := c.readers(tenant)[0].Addr
+		if owner != before[tenant] {
+			moved++
+			if owner != "counter-3" {
+				t.Errorf("Want %s moved to counter-3, got %s", tenant, owner)
+			}
+		}
+
+		for addr, items := range rc.items {
+			stored := 0
+			for i := range items {
+				if i.Tenant == tenant {
+					stored++
+				}
+			}
+			if want := map[bool]int{true: 5, false: 0}[addr == owner]; stored != want {
+				t.Errorf("Want %d items of %s on %s, got %d", want, tenant, addr, stored)
+			}
+		}
+		for addr, sketches := range rc.sketches {
+			if _, ok := sketches[tenant]; ok != (addr == owner) {
+				t.Errorf("Want sketch of %s on %s %t, got %t", tenant, addr, addr == owner, ok)
+			}
+		}
+	}
+
+	if moved == 0 {
+		t.Error("Want some tenants moved to counter-3, got none")
+	}
+
+	status := c.rebalancer.Status()
+	if status.State != RebalanceIdle || status.Items != moved*5 || status.Done != len(status.Moves) {
+		t.Errorf("Want %d items moved and rebalancing finished, got %+v", moved*5, status)
+	}
+	if c.pendingChange() != nil || len(c.members) != 3 {
+		t.Errorf("Want ring switched to 3 counters, got %v", c.members)
+	}
+}
+
+func TestRebalancer_RebalanceDeadSource(t *testing.T) {
+	rc := &rangeCounters{items: map[string]map[Item]bool{}}
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "counter-1"}, {Addr: "counter-2"}},
+		config:   Config{ReplicationFactor: 1, VirtualNodes: 16, CounterTimeout: time.Second},
+		http:     NewTestClient(rc.serve),
+	}
+	c.rebalancer = NewRebalancer(c, 3, time.Second)
+	c.rebuildRing()
+
+	c.acceptNewCounter("counter-3")
+	change := c.pendingChange()
+	c.Counters[0].IsDead = true
+
+	// new owners would serve ranges of the dead counter empty
+	if err := c.rebalancer.rebalance(); err == nil {
+		t.Error("Want rebalance error, got nil")
+	}
+	if c.pendingChange() != change || len(c.members) != 2 {
+		t.Errorf("Want ring of 2 counters kept, got %v", c.members)
+	}
+}
+
+func TestRebalancer_RebalanceForced(t *testing.T) {
+	rc := &rangeCounters{items: map[string]map[Item]bool{}}
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "counter-1"}, {Addr: "counter-2"}},
+		config:   Config{ReplicationFactor: 1, VirtualNodes: 16, CounterTimeout: time.Second},
+		http:     NewTestClient(rc.serve),
+	}
+	c.rebalancer = NewRebalancer(c, 3, time.Second)
+	c.rebuildRing()
+
+	if c.rebalancer.Force() {
+		t.Error("Want nothing to force without ring change, got forced")
+	}
+
+	c.acceptNewCounter("counter-3")
+	c.Counters[0].IsDead = true
+
+	// operator accepts losing items of the dead counter
+	if !c.rebalancer.Force() {
+		t.Fatal("Want ring change forced, got none pending")
+	}
+	if err := c.rebalancer.rebalance(); err != nil {
+		t.Fatalf("Rebalance error: %s", err.Error())
+	}
+	if c.pendingChange() != nil || len(c.members) != 3 {
+		t.Errorf("Want ring switched to 3 counters, got %v", c.members)
+	}
+
+	lost := 0
+	status := c.rebalancer.Status()
+	for _, move := range status.Moves {
+		if move.Lost {
+			lost++
+			if !contains(move.Sources, "counter-1") {
+				t.Errorf("Want only ranges of the dead counter lost, got %+v", move)
+			}
+		}
+	}
+	if lost == 0 || !status.Forced || status.Error == "" {
+		t.Errorf("Want data loss reported, got %+v", status)
+	}
+
+	// next change is not forced
+	c.acceptNewCounter("counter-4")
+	if c.rebalancer.isForced(c.pendingChange()) {
+		t.Error("Want next ring change not forced, got forced")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Ring places tenants on counters with consistent hashing.
+// Every counter owns a number of virtual points on the ring and a tenant
+// is stored by the first distinct counters found clockwise from its hash,
+// so a joining or leaving counter moves only the tenants next to its points.
+// Nil *Ring owns nothing.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func NewRing(addrs []string, vnodes int) *Ring {
+	r := &Ring{owners: map[uint32]string{}}
+	for _, addr := range addrs {
+		for i := 0; i < vnodes; i++ {
+			p := ringHash(fmt.Sprintf("%s#%d", addr, i))
+			if _, ok := r.owners[p]; ok {
+				continue
+			}
+			r.owners[p] = addr
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// first bytes of sha256, similar names like tenant-1 and tenant-2
+// must land far apart on the ring
+func ringHash(s string) uint32 {
+	h := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+// returns up to n distinct counters storing the tenant, primary first
+func (r *Ring) Owners(tenant string, n int) []string {
+	return r.ownersOf(ringHash(tenant), n)
+}
+
+// returns up to n distinct counters storing tenants with given hash
+func (r *Ring) ownersOf(h uint32, n int) []string {
+	if r == nil || len(r.points) == 0 {
+		return nil
+	}
+
+	owners := []string{}
+	seen := map[string]bool{}
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		addr := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[addr] {
+			seen[addr] = true
+			owners = append(owners, addr)
+		}
+	}
+	return owners
+}
+
+// whether tenants are sharded instead of stored by every counter
+func (c *Coordinator) sharded() bool {
+	return c.config.ReplicationFactor > 0
+}
+
+// ring the cluster moves to after membership changed,
+// version and sequence tell writes which still follow the old ring
+type RingChange struct {
+	ring    *Ring
+	members []string
+	version uint64
+	seq     uint64
+}
+
+// builds the ring of registered counters, the first one is used at once,
+// later ones become owners only once the rebalancer moved their tenants,
+// dead counters keep their tenants until they are removed
+// must be called with the lock held
+func (c *Coordinator) rebuildRing() {
+	if !c.sharded() {
+		return
+	}
+
+	members := make([]string, 0, len(c.Counters))
+	for _, counter := range c.Counters {
+		members = append(members, counter.Addr)
+	}
+	sort.Strings(members)
+
+	if c.ring == nil {
+		c.ring = NewRing(members, c.config.VirtualNodes)
+		c.members = members
+		if err := c.txlog.RecordRing(members); err != nil {
+			l.Printf("[ERROR] Unable to log ring: %s", err.Error())
+		}
+		return
+	}
+
+	if equal(members, c.members) {
+		c.pending = nil
+		return
+	}
+	c.pending = &RingChange{
+		ring:    NewRing(members, c.config.VirtualNodes),
+		members: members,
+		version: c.version,
+		seq:     c.lastSeq(),
+	}
+	c.rebalancer.notify()
+}
+
+// members of the ring and of the ring the cluster moves to,
+// counters place tenants with it the same way the coordinator does
+type RingView struct {
+	Members           []string `json:"members"`
+	Target            []string `json:"target,omitempty"`
+	ReplicationFactor int      `json:"replicationFactor"`
+	VirtualNodes      int      `json:"vnodes"`
+}
+
+func (c *Coordinator) ringView() RingView {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	v := RingView{Members: []string{}, ReplicationFactor: c.config.ReplicationFactor, VirtualNodes: c.config.VirtualNodes}
+	if !c.sharded() {
+		return v
+	}
+	v.Members = append(v.Members, c.members...)
+	if c.pending != nil {
+		v.Target = append([]string{}, c.pending.members...)
+	}
+	return v
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// returns counters which own the tenant now or will own it
+// once the ring change completes, writes go to both
+func (c *Coordinator) owners(tenant string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owners := c.ring.Owners(tenant, c.config.ReplicationFactor)
+	if c.pending == nil {
+		return owners
+	}
+	for _, addr := range c.pending.ring.Owners(tenant, c.config.ReplicationFactor) {
+		if !contains(owners, addr) {
+			owners = append(owners, addr)
+		}
+	}
+	return owners
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// splits items between counters owning their tenants
+func (c *Coordinator) shards(items Items) map[string]Items {
+	shards := map[string]Items{}
+	owners := map[string][]string{}
+	for _, i := range items {
+		if _, ok := owners[i.Tenant]; !ok {
+			owners[i.Tenant] = c.owners(i.Tenant)
+		}
+		for _, addr := range owners[i.Tenant] {
+			shards[addr] = append(shards[addr], i)
+		}
+	}
+	return shards
+}
+
+// returns items of tenants owned by given counter
+func (c *Coordinator) owned(addr string, items Items) Items {
+	owned := Items{}
+	owns := map[string]bool{}
+	for _, i := range items {
+		is, ok := owns[i.Tenant]
+		if !ok {
+			is = contains(c.owners(i.Tenant), addr)
+			owns[i.Tenant] = is
+		}
+		if is {
+			owned = append(owned, i)
+		}
+	}
+	return owned
+}
+
+// returns alive counters which can answer count of the tenant
+func (c *Coordinator) readers(tenant string) []*Counter {
+	if !c.sharded() {
+		return c.aliveCounters()
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// new owners may still miss items moved to them
+	readers := []*Counter{}
+	for _, addr := range c.ring.Owners(tenant, c.config.ReplicationFactor) {
+		for _, counter := range c.Counters {
+			if counter.Addr == addr && !counter.IsDead {
+				readers = append(readers, counter)
+			}
+		}
+	}
+	return readers
+}
+
+// returns random alive owner of the tenant
+func (c *Coordinator) reader(tenant string) *Counter {
+	readers := c.readers(tenant)
+	if len(readers) == 0 {
+		return nil
+	}
+	return readers[rand.Intn(len(readers))]
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRing_Owners(t *testing.T) {
+	addrs := []string{"counter-1", "counter-2", "counter-3"}
+	ring := NewRing(addrs, 64)
+
+	tt := []struct {
+		name string
+		n    int
+		want int
+	}{
+		{name: "primary only", n: 1, want: 1},
+		{name: "replicas", n: 2, want: 2},
+		{name: "more replicas than counters", n: 5, want: 3},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			owners := ring.Owners("tenant-1", tc.n)
+			if len(owners) != tc.want {
+				t.Fatalf("Want %d owners, got %v", tc.want, owners)
+			}
+
+			seen := map[string]bool{}
+			for _, o := range owners {
+				if seen[o] {
+					t.Errorf("Want distinct owners, got %v", owners)
+				}
+				seen[o] = true
+			}
+		})
+	}
+
+	if owners := (*Ring)(nil).Owners("tenant-1", 1); owners != nil {
+		t.Errorf("Want no owners of nil ring, got %v", owners)
+	}
+
+	// joining counter takes over only part of the tenants
+	grown := NewRing(append(addrs, "counter-4"), 64)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		before, after := ring.Owners(tenant, 1)[0], grown.Owners(tenant, 1)[0]
+		if before != after {
+			moved++
+			if after != "counter-4" {
+				t.Errorf("Want %s moved to the new counter, got %s", tenant, after)
+			}
+		}
+	}
+	if moved == 0 || moved > 500 {
+		t.Errorf("Want about a quarter of tenants moved, got %d of 1000", moved)
+	}
+}
+
+func TestCoordinator_ringView(t *testing.T) {
+	c := &Coordinator{
+		Counters: []*Counter{{Addr: "counter-1"}, {Addr: "counter-2"}},
+		config:   Config{ReplicationFactor: 2, VirtualNodes: 16},
+	}
+	c.rebuildRing()
+	c.Counters = append(c.Counters, &Counter{Addr: "counter-3"})
+	c.rebuildRing()
+
+	want := RingView{Members: []string{"counter-1", "counter-2"}, Target: []string{"counter-1", "counter-2", "counter-3"}, ReplicationFactor: 2, VirtualNodes: 16}
+	if v := c.ringView(); !reflect.DeepEqual(want, v) {
+		t.Errorf("Want %+v, got %+v", want, v)
+	}
+
+	unsharded := &Coordinator{Counters: []*Counter{{Addr: "counter-1"}}}
+	if v := unsharded.ringView(); len(v.Members) != 0 || v.ReplicationFactor != 0 {
+		t.Errorf("Want no ring without sharding, got %+v", v)
+	}
+}
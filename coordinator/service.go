@@ -1,28 +1,68 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type Counter struct {
-	Addr          string
-	HasItems      bool
-	IsDead        bool
-	RecoveryTries int16
+	Addr          string `json:"addr"`
+	HasItems      bool   `json:"hasItems"`
+	IsDead        bool   `json:"isDead"`
+	RecoveryTries int16  `json:"recoveryTries"`
+	// highest timestamp the counter applied, reported on its health check
+	Applied Timestamp `json:"applied"`
+	// every commit up to the sequence is applied, counters drop tombstones
+	// of deletes applied by all of them
+	Seq uint64 `json:"seq"`
+	// how far applied timestamp is behind the latest decided one
+	// of the shards the counter stores
+	Lag time.Duration `json:"lag"`
+}
+
+// health reported by a counter
+type Health struct {
+	Applied Timestamp `json:"applied"`
+	Seq     uint64    `json:"seq,omitempty"`
 }
 
 type Coordinator struct {
 	Counters []*Counter
 
-	http *http.Client
+	mu          sync.RWMutex
+	config      Config
+	http        *http.Client
+	txlog       *TxLog
+	idempotency *Idempotency
+	delivery    *Delivery
+	history     *History
+	leader      string
+	version     uint64
+	commitMu    sync.Mutex
+	seq         uint64
+	commitLog   *CommitLog
+	ring        *Ring
+	members     []string
+	pending     *RingChange
+	rebalancer  *Rebalancer
+	clock       *Clock
+	election    *Election
+	// timestamp of the latest decided message
+	timestamp Timestamp
+	// timestamp of the latest decided message to every counter, only kept when sharded
+	shardTimestamps map[string]Timestamp
+	// sequence of the latest commit to every tenant, only kept when sharded
+	tenantSeqs map[string]uint64
 }
 
 type Item struct {
@@ -30,17 +70,67 @@ type Item struct {
 	Tenant string `json:"tenant"`
 }
 
+// item deleted by a committed message with given version and sequence
+type Tombstone struct {
+	ID      string `json:"id"`
+	Tenant  string `json:"tenant"`
+	Version uint64 `json:"version"`
+	Seq     uint64 `json:"seq,omitempty"`
+}
+
 type Items []Item
 
 type Count struct {
-	Value int `json:"count"`
+	Value   int    `json:"count"`
+	Version uint64 `json:"version,omitempty"`
+	Applied uint64 `json:"applied,omitempty"`
+	// every commit up to the sequence is applied by the counter
+	Seq uint64 `json:"seq,omitempty"`
+	// estimate of a tenant in approximate mode and its standard error
+	Approximate bool `json:"approximate,omitempty"`
+	Error       int  `json:"error,omitempty"`
 }
 
 type Message struct {
-	ID      string `json:"id"`
-	Content Items  `json:"content"`
+	ID       string           `json:"id"`
+	Op       string           `json:"op,omitempty"`
+	Content  Items            `json:"content"`
+	Protocol string           `json:"protocol,omitempty"`
+	Version  uint64           `json:"version,omitempty"`
+	Seq      uint64           `json:"seq,omitempty"`
+	Shards   map[string]Items `json:"shards,omitempty"`
+	// counters asked to prepare a three-phase commit message,
+	// they ask each other about it when the coordinator is gone
+	Participants []string `json:"participants,omitempty"`
+	// counters which did not prepare the message the quorum agreed on
+	Refused []string `json:"refused,omitempty"`
+	// hybrid logical clock time the message was created at
+	Timestamp Timestamp `json:"timestamp"`
 }
 
+const (
+	Protocol2PC = "2pc"
+	Protocol3PC = "3pc"
+)
+
+// operation of the message, items are added when it is empty
+const OpDelete = "delete"
+
+// reason of a counter refusing or failing to prepare a message
+type Reason struct {
+	Counter string `json:"counter"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+const ReasonUnavailable = "unavailable"
+
+const (
+	OutcomeCommitted = "committed"
+	OutcomeAborted   = "aborted"
+	OutcomePending   = "pending"
+)
+
 func (i *Items) Validate() error {
 	for _, v := range *i {
 		if v.ID == "" || v.Tenant == "" {
@@ -58,84 +148,489 @@ func NewCounter(addr string) *Counter {
 	}
 }
 
-func NewCoordinator() *Coordinator {
-	return &Coordinator{
+func NewCoordinator(config Config, txlog *TxLog) *Coordinator {
+	c := &Coordinator{
 		Counters: []*Counter{},
 
+		config: config,
 		http: &http.Client{
-			Timeout: 1 * time.Second,
+			Timeout: config.CounterTimeout,
 		},
+		txlog:       txlog,
+		idempotency: NewIdempotency(config.IdempotencyWindow),
+		history:     NewHistory(config.TxHistory),
+		commitLog:   NewCommitLog(config.CommitLogSize),
+		clock:       NewClock(),
+	}
+	c.delivery = NewDelivery(c, config.CommitRetryMin, config.CommitRetryMax)
+	c.rebalancer = NewRebalancer(c, config.RebalanceBatch, config.RebalanceRetry)
+	c.restore()
+
+	return c
+}
+
+// restores registry, versions and commit log from the transaction log
+func (c *Coordinator) restore() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Counters = []*Counter{}
+	for _, addr := range c.txlog.Counters() {
+		c.Counters = append(c.Counters, NewCounter(addr))
+	}
+	if v := c.txlog.Version(); v > c.version {
+		c.version = v
+	}
+
+	c.commitMu.Lock()
+	if seq := c.txlog.Seq(); seq > c.seq {
+		c.seq = seq
+	}
+	for _, m := range c.txlog.Committed() {
+		c.commitLog.Append(m)
+		c.tenantSeq(m)
+		c.decidedAt(m)
+		c.clock.Update(m.Timestamp)
 	}
+	c.commitMu.Unlock()
+
+	// ring change interrupted by restart starts again
+	c.ring, c.members, c.pending = nil, nil, nil
+	if members, ok := c.txlog.Ring(); ok && c.sharded() {
+		c.ring = NewRing(members, c.config.VirtualNodes)
+		c.members = members
+	}
+	c.rebuildRing()
 }
 
 func NewMessage(items Items) *Message {
 	return &Message{ID: uuid(), Content: items}
 }
 
-// naive uuid, do not use in production
-// @todo: add uuid package
+// returns new message adding or deleting items, committed with the configured protocol
+// stamps the message with the next version,
+// so readers can tell which counter applied the latest write
+func (c *Coordinator) newMessage(op string, items Items) *Message {
+	m := NewMessage(items)
+	m.Op = op
+	if c.config.Protocol == Protocol3PC {
+		m.Protocol = Protocol3PC
+	}
+
+	c.mu.Lock()
+	c.version++
+	m.Version = c.version
+	c.mu.Unlock()
+	m.Timestamp = c.clock.Now()
+
+	// the assignment is logged with the message,
+	// so every phase and recovery reach the same counters
+	if c.sharded() {
+		m.Shards = c.shards(items)
+	}
+	return m
+}
+
+// returns part of the message stored by given counter,
+// message without shards is stored by every counter
+// which did not refuse it
+func (m *Message) shard(addr string) *Message {
+	if m.Shards == nil && len(m.Refused) == 0 {
+		return m
+	}
+
+	part := *m
+	if m.Shards != nil {
+		part.Content = m.Shards[addr]
+	}
+	if m.refused(addr) {
+		part.Content = nil
+	}
+	if part.Content == nil {
+		part.Content = Items{}
+	}
+	part.Shards, part.Refused = nil, nil
+	return &part
+}
+
+// whether given counter did not prepare the message
+func (m *Message) refused(addr string) bool {
+	for _, refused := range m.Refused {
+		if refused == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// returns alive counters taking part in the transaction
+func (c *Coordinator) participants(m *Message) []*Counter {
+	counters := c.aliveCounters()
+	if m.Shards == nil {
+		return counters
+	}
+
+	participants := []*Counter{}
+	for _, counter := range counters {
+		if _, ok := m.Shards[counter.Addr]; ok {
+			participants = append(participants, counter)
+		}
+	}
+	return participants
+}
+
+// marshals part of the message of every given counter
+func payloads(m *Message, counters []*Counter) (map[string][]byte, error) {
+	payloads := map[string][]byte{}
+	if m.Shards == nil && len(m.Refused) == 0 {
+		payload, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, counter := range counters {
+			payloads[counter.Addr] = payload
+		}
+		return payloads, nil
+	}
+
+	for _, counter := range counters {
+		payload, err := json.Marshal(m.shard(counter.Addr))
+		if err != nil {
+			return nil, err
+		}
+		payloads[counter.Addr] = payload
+	}
+	return payloads, nil
+}
+
+// whether enough alive owners of every tenant of the message prepared it
+func (c *Coordinator) shardsPrepared(m *Message, results Results) bool {
+	type owners struct {
+		alive    int
+		prepared int
+	}
+
+	byAddr := map[string]*Result{}
+	for _, r := range results {
+		byAddr[r.Counter.Addr] = r
+	}
+
+	tenants := map[string]*owners{}
+	for addr, items := range m.Shards {
+		seen := map[string]bool{}
+		for _, i := range items {
+			if seen[i.Tenant] {
+				continue
+			}
+			seen[i.Tenant] = true
+
+			if tenants[i.Tenant] == nil {
+				tenants[i.Tenant] = &owners{}
+			}
+			if r, ok := byAddr[addr]; ok {
+				tenants[i.Tenant].alive++
+				if r.ok() {
+					tenants[i.Tenant].prepared++
+				}
+			}
+		}
+	}
+
+	for tenant, o := range tenants {
+		if o.alive == 0 || o.prepared < c.writeQuorum(o.alive) {
+			l.Printf("[ERROR] %d of %d owners of %s prepared %s", o.prepared, o.alive, tenant, m.ID)
+			return false
+		}
+	}
+	return true
+}
+
+// remembers sequence of the latest commit to tenants of the message,
+// must be called with commit lock held
+func (c *Coordinator) tenantSeq(m *Message) {
+	if !c.sharded() {
+		return
+	}
+	if c.tenantSeqs == nil {
+		c.tenantSeqs = map[string]uint64{}
+	}
+	for _, i := range m.Content {
+		if m.Seq > c.tenantSeqs[i.Tenant] {
+			c.tenantSeqs[i.Tenant] = m.Seq
+		}
+	}
+}
+
+// returns sequence of the latest commit to the tenant not newer than given one,
+// so a token of a write to another shard does not wait for commits after it
+func (c *Coordinator) readSeq(tenant string, seq uint64) uint64 {
+	if !c.sharded() {
+		return seq
+	}
+
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	if s := c.tenantSeqs[tenant]; s < seq {
+		return s
+	}
+	return seq
+}
+
+// returns number of counters which must prepare the message,
+// all alive counters unless the write quorum is set
+func (c *Coordinator) writeQuorum(alive int) int {
+	if c.config.WriteQuorum > 0 {
+		return c.config.WriteQuorum
+	}
+	return alive
+}
+
+// random version 4 uuid, ids must not repeat across restarts
+// because outcomes of transactions are kept in the log
 func uuid() string {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
 	if err != nil {
 		return time.Now().String()
 	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
 	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
 func (c *Coordinator) acceptNewCounter(counterAddr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.txlog.Join(counterAddr); err != nil {
+		l.Printf("[ERROR] Unable to log counter %s: %s", counterAddr, err.Error())
+	}
+
+	// restarted counter signs in again with the same address
+	for i, counter := range c.Counters {
+		if counter.Addr == counterAddr {
+			c.Counters[i] = NewCounter(counterAddr)
+			return
+		}
+	}
+
 	counter := NewCounter(counterAddr)
 	c.Counters = append(c.Counters, counter)
+	c.rebuildRing()
 }
 
-// sends GET request to alive and populated counter
-// returns all items
-func (c *Coordinator) getItems() Items {
-	items := Items{}
-	var body []byte
+// returns snapshot of counters which are not marked as dead
+func (c *Coordinator) aliveCounters() []*Counter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counters := make([]*Counter, 0, len(c.Counters))
 	for _, counter := range c.Counters {
-		if counter.IsDead || counter.HasItems == false {
-			continue
+		if !counter.IsDead {
+			counters = append(counters, counter)
 		}
+	}
+	return counters
+}
 
-		resp, err := c.Do(http.MethodGet, fmt.Sprintf("http://%s/items", counter.Addr), nil)
-		if err != nil {
-			l.Printf("[ERROR] Cannot get items from counter %s: %s", counter.Addr, err.Error())
+// sends GET request to every counter
+// marks not responding ones as dead and removes them after RecoveryTries
+func (c *Coordinator) checkCounters() {
+	c.mu.RLock()
+	counters := make([]*Counter, len(c.Counters))
+	copy(counters, c.Counters)
+	c.mu.RUnlock()
+
+	results := c.fanout(counters, http.MethodGet, "/health", nil)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range results {
+		counter := r.Counter
+		if r.ok() {
+			counter.IsDead = false
+			counter.RecoveryTries = 0
+
+			// counters predating timestamps answer with an empty body,
+			// restarted counter may report less than before
+			health := Health{}
+			if err := json.Unmarshal(r.Body, &health); err == nil {
+				counter.Seq = health.Seq
+				counter.Applied = health.Applied
+				c.clock.Update(health.Applied)
+			}
 			continue
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			l.Printf("[ERROR] Unexpected status code %d from %s", resp.StatusCode, counter.Addr)
+		// raft group keeps its members, the majority decides without the dead ones
+		if counter.RecoveryTries >= c.config.RecoveryTries && c.config.ReplicationMode != ReplicationRaft {
+			c.removeCounter(counter)
+			l.Printf("[INFO] %s removed", counter.Addr)
 			continue
 		}
+		counter.IsDead = true
+		counter.RecoveryTries++
+		l.Printf("[INFO] %s not query able", counter.Addr)
+	}
+}
 
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			l.Printf("[ERROR] Cannot read response body from %s: %s", counter.Addr, err.Error())
+// must be called with the lock held
+func (c *Coordinator) removeCounter(counter *Counter) {
+	for i := range c.Counters {
+		if c.Counters[i] != counter {
 			continue
 		}
 
-		if resp != nil {
-			resp.Body.Close()
+		if err := c.txlog.Leave(counter.Addr); err != nil {
+			l.Printf("[ERROR] Unable to log counter %s: %s", counter.Addr, err.Error())
 		}
+		c.Counters = append(c.Counters[:i], c.Counters[i+1:]...)
+		c.rebuildRing()
+		if c.delivery != nil {
+			c.delivery.drop(counter.Addr)
+		}
+		return
 	}
+}
 
-	if body != nil {
-		err := json.Unmarshal(body, &items)
-		if err != nil {
-			l.Printf("[ERROR] Cannot unmarshal json: %s ", err.Error())
+// returns copy of registered counters
+func (c *Coordinator) listCounters() []Counter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	counters := make([]Counter, 0, len(c.Counters))
+	for _, counter := range c.Counters {
+		listed := *counter
+		latest := c.timestamp
+		if c.sharded() {
+			latest = c.shardTimestamps[counter.Addr]
+		}
+		if lag := latest.Wall - listed.Applied.Wall; lag > 0 {
+			listed.Lag = time.Duration(lag)
+		}
+		counters = append(counters, listed)
+	}
+	return counters
+}
+
+// returns registered counter with given address or nil
+func (c *Coordinator) counter(addr string) *Counter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, counter := range c.Counters {
+		if counter.Addr == addr {
+			return counter
+		}
+	}
+	return nil
+}
+
+func (c *Coordinator) markPopulated(counter *Counter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counter.HasItems = true
+}
+
+// sequence the counter applied when it listed its items
+const AppliedSeqHeader = "X-Applied-Seq"
+
+// sends GET request to alive and populated counters
+// returns union of their items, as any of them may have missed a commit,
+// and of their tombstones, item of a counter which did not apply its delete
+// is left out, while the one of a counter which did was added again
+func (c *Coordinator) getItems() (Items, []Tombstone) {
+	populated := []*Counter{}
+	c.mu.RLock()
+	for _, counter := range c.Counters {
+		if !counter.IsDead && counter.HasItems {
+			populated = append(populated, counter)
+		}
+	}
+	c.mu.RUnlock()
+
+	deleted := map[Item]Tombstone{}
+	for _, r := range c.fanout(populated, http.MethodGet, "/tombstones", nil) {
+		counterTombstones := []Tombstone{}
+		if !r.ok() || json.Unmarshal(r.Body, &counterTombstones) != nil {
+			// counters predating deletes have no tombstones
+			continue
+		}
+		for _, t := range counterTombstones {
+			i := Item{ID: t.ID, Tenant: t.Tenant}
+			if t.Version > deleted[i].Version {
+				deleted[i] = t
+			}
+		}
+	}
+
+	items := Items{}
+	seen := map[Item]bool{}
+	for _, r := range c.fanout(populated, http.MethodGet, "/items", nil) {
+		if !r.ok() {
+			l.Printf("[ERROR] Cannot get items from %s", r)
+			continue
+		}
+
+		counterItems := Items{}
+		if err := json.Unmarshal(r.Body, &counterItems); err != nil {
+			l.Printf("[ERROR] Cannot unmarshal json from %s: %s", r.Counter.Addr, err.Error())
+			continue
+		}
+		// counter predating sequences of deletes never applied one
+		seq, _ := strconv.ParseUint(r.Header.Get(AppliedSeqHeader), 10, 64)
+		for _, i := range counterItems {
+			if t, ok := deleted[i]; ok && (t.Seq == 0 || t.Seq > seq) {
+				continue
+			}
+			if !seen[i] {
+				seen[i] = true
+				items = append(items, i)
+			}
 		}
 	}
 
-	return items
+	tombstones := []Tombstone{}
+	for i, t := range deleted {
+		if !seen[i] {
+			tombstones = append(tombstones, t)
+		}
+	}
+	sort.Slice(tombstones, func(a, b int) bool {
+		return tombstones[a].Tenant < tombstones[b].Tenant || (tombstones[a].Tenant == tombstones[b].Tenant && tombstones[a].ID < tombstones[b].ID)
+	})
+	return items, tombstones
 }
 
-// sends GET request to random counter
-// returns counted items for given tenantID
-func (c *Coordinator) getItemsCountPerTenant(tenantID string) (*Count, error) {
+// sends GET request to random counter, or to random owner of the tenant
+// when sharded, returns counted items for given tenantID
+// with sequence from a consistency token only counters
+// which applied it are asked, raft reads are linearizable anyway
+func (c *Coordinator) getItemsCountPerTenant(tenantID string, seq uint64) (*Count, error) {
+	if seq > 0 && c.config.ReplicationMode != ReplicationRaft {
+		return c.getConsistentCount(tenantID, seq)
+	}
+	if c.config.ReadQuorum > 1 {
+		return c.getQuorumCount(tenantID)
+	}
+
 	count := Count{}
 
+	// docker balances requests between counters storing every tenant
 	url := fmt.Sprintf("http://counter/items/%s/count", tenantID)
+	if c.sharded() {
+		owner := c.reader(tenantID)
+		if owner == nil {
+			return nil, errNoOwner
+		}
+		url = fmt.Sprintf("http://%s/items/%s/count", owner.Addr, tenantID)
+	}
 	resp, err := c.Do(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
@@ -168,110 +663,315 @@ func (c *Coordinator) getItemsCountPerTenant(tenantID string) (*Count, error) {
 
 // sends POST request to every counter
 // returns information whether all counters are ready to save data
-func (c *Coordinator) canCommit(m *Message) bool {
-	payload, err := json.Marshal(m)
+// and reasons given by the ones which are not
+func (c *Coordinator) canCommit(m *Message) (bool, []Reason) {
+	counters := c.participants(m)
+	if m.Protocol == Protocol3PC {
+		m.Participants = make([]string, 0, len(counters))
+		for _, counter := range counters {
+			m.Participants = append(m.Participants, counter.Addr)
+		}
+	}
+	payloads, err := payloads(m, counters)
 	if err != nil {
 		l.Printf("[ERROR] Unable to marshall message %+v: %s", m, err.Error())
+		return false, nil
 	}
 
-	checked := 0
-	agrees := make([]bool, 0)
-	for _, counter := range c.Counters {
-		if counter.IsDead {
-			continue
-		}
+	if err := c.record(m, PhasePrepared); err != nil {
+		l.Printf("[ERROR] Unable to log message %s: %s", m.ID, err.Error())
+		return false, nil
+	}
 
-		url := fmt.Sprintf("http://%s/init", counter.Addr)
-		resp, err := c.Do(http.MethodPost, url, bytes.NewBuffer(payload))
-		if err != nil {
-			l.Printf("[ERROR] Cannot init for %s: %s", counter.Addr, err.Error())
-			continue
-		}
+	results := c.fanoutEach(counters, http.MethodPost, "/init", payloads)
+	c.history.votes(m, results)
 
-		if resp.StatusCode == http.StatusOK {
-			agrees = append(agrees, true)
-		}
+	reasons := []Reason{}
+	m.Refused = nil
+	for _, r := range results.Failed() {
+		l.Printf("[ERROR] Cannot init for %s", r)
+		reasons = append(reasons, rejection(r))
+		m.Refused = append(m.Refused, r.Counter.Addr)
+	}
 
-		checked++
-		if resp != nil {
-			resp.Body.Close()
-		}
+	if m.Shards != nil {
+		return c.shardsPrepared(m, results), reasons
 	}
 
-	return len(agrees) == checked
+	// counters which did not prepare miss the write when the quorum agreed
+	prepared := len(results) - len(reasons)
+	return prepared >= c.writeQuorum(len(results)), reasons
+}
+
+// counter voting no responds with 409 and a json reason,
+// any other failure means the counter is unavailable
+func rejection(r *Result) Reason {
+	reason := Reason{Counter: r.Counter.Addr, Reason: ReasonUnavailable, Message: r.problem()}
+	if r.Err != nil || r.StatusCode != http.StatusConflict {
+		return reason
+	}
+
+	if err := json.Unmarshal(r.Body, &reason); err != nil || reason.Reason == "" {
+		l.Printf("[ERROR] Cannot unmarshal rejection from %s: %s", r.Counter.Addr, r.Body)
+		reason.Reason = ReasonUnavailable
+	}
+	return reason
 }
 
 // sends POST request to every counter
 // to delete a previously initiated message
 func (c *Coordinator) abort(m *Message) {
-	payload, err := json.Marshal(m)
+	counters := c.participants(m)
+	payloads, err := payloads(m, counters)
 	if err != nil {
 		l.Printf("[ERROR] Unable to marshall message %+v: %s", m, err.Error())
+		return
 	}
 
-	for _, counter := range c.Counters {
-		if counter.IsDead {
-			continue
-		}
+	// without a logged decision the transaction is presumed aborted anyway
+	if err := c.record(m, PhaseAborted); err != nil {
+		l.Printf("[ERROR] Unable to log message %s: %s", m.ID, err.Error())
+	}
 
-		url := fmt.Sprintf("http://%s/abort", counter.Addr)
-		resp, err := c.Do(http.MethodPost, url, bytes.NewBuffer(payload))
-		if err != nil {
-			l.Printf("[ERROR] Unable to abort %s: %s", counter.Addr, err.Error())
-			return
-		}
+	results := c.fanoutEach(counters, http.MethodPost, "/abort", payloads)
+	c.history.errors(m, PhaseAborted, results)
+	for _, r := range results.Failed() {
+		l.Printf("[ERROR] Unable to abort %s", r)
+	}
+}
 
-		if resp.StatusCode != http.StatusOK {
-			l.Printf("[ERROR] Unable to abort %s: %d", counter.Addr, resp.StatusCode)
-			return
+// sends POST request to every counter which prepared the message to tell them all agreed,
+// counters which got it commit on their own if the coordinator disappears
+// and the rest aborts, so the transaction does not block like in 2PC
+// returns error when any counter did not acknowledge it, the transaction
+// must be aborted then, as the counters would decide differently on timeout
+func (c *Coordinator) preCommit(m *Message) error {
+	counters := []*Counter{}
+	for _, counter := range c.participants(m) {
+		if !m.refused(counter.Addr) {
+			counters = append(counters, counter)
 		}
+	}
+	payloads, err := payloads(m, counters)
+	if err != nil {
+		l.Printf("[ERROR] Unable to marshall message %+v: %s", m, err.Error())
+		return err
+	}
 
-		if resp != nil {
-			resp.Body.Close()
-		}
+	if err := c.record(m, PhasePreCommitted); err != nil {
+		l.Printf("[ERROR] Unable to log message %s: %s", m.ID, err.Error())
+		return err
+	}
+
+	results := c.fanoutEach(counters, http.MethodPost, "/precommit", payloads)
+	c.history.errors(m, PhasePreCommitted, results)
+	failed := results.Failed()
+	for _, r := range failed {
+		l.Printf("[ERROR] Unable to precommit %s", r)
 	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d counters did not precommit %s", len(failed), len(results), m.ID)
+	}
+	return nil
 }
 
 // sends POST request to every counter
 // to save data from previously initiated message
-func (c *Coordinator) commit(m *Message) error {
-	payload, err := json.Marshal(m)
+// once the commit is logged it is decided, counters which fail
+// to acknowledge it get it later from the delivery queue
+// returns number of counters the commit is still pending for
+func (c *Coordinator) commit(m *Message) (int, error) {
+	// decision must be durable before any counter applies it
+	if err := c.decide(m); err != nil {
+		l.Printf("[ERROR] Unable to log message %s: %s", m.ID, err.Error())
+		return 0, err
+	}
+
+	// counters which do not own any item of a sharded message
+	// or did not prepare it get its sequence with empty content,
+	// so their sequence has no gaps and they miss the write
+	counters := c.aliveCounters()
+	payloads, err := payloads(m, counters)
 	if err != nil {
 		l.Printf("[ERROR] Unable to marshall message %+v: %s", m, err.Error())
+		return 0, err
 	}
 
-	for _, counter := range c.Counters {
-		if counter.IsDead {
+	results := c.fanoutEach(counters, http.MethodPost, "/commit", payloads)
+	c.history.errors(m, PhaseCommitting, results)
+
+	failed := []*Counter{}
+	c.mu.Lock()
+	for _, r := range results {
+		if r.ok() {
+			r.Counter.HasItems = true
 			continue
 		}
+		l.Printf("[ERROR] Unable to commit %s", r)
+		failed = append(failed, r.Counter)
+	}
+	c.mu.Unlock()
 
-		url := fmt.Sprintf("http://%s/commit", counter.Addr)
-		resp, err := c.Do(http.MethodPost, url, bytes.NewBuffer(payload))
-		if err != nil {
-			l.Printf("[ERROR] Unable to commit %s: %s", counter.Addr, err.Error())
-			return err
-		}
+	if len(failed) > 0 {
+		c.delivery.enqueue(m, payloads, failed)
+		return len(failed), nil
+	}
+
+	if err := c.record(m, PhaseCommitted); err != nil {
+		l.Printf("[ERROR] Unable to log message %s: %s", m.ID, err.Error())
+	}
+	return 0, nil
+}
 
-		if resp.StatusCode != http.StatusOK {
-			l.Printf("[ERROR] Unable to commit %s: %d", counter.Addr, resp.StatusCode)
-			return errors.New("unable to commit")
+// gives the message the next commit sequence and logs the decision,
+// decisions are logged one at a time so sequence has no gaps
+func (c *Coordinator) decide(m *Message) error {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	fresh := m.Seq == 0
+	if fresh {
+		m.Seq = c.seq + 1
+	}
+	if err := c.record(m, PhaseCommitting); err != nil {
+		if fresh {
+			m.Seq = 0
 		}
+		return err
+	}
 
-		counter.HasItems = true
-		if resp != nil {
-			resp.Body.Close()
+	if m.Seq > c.seq {
+		c.seq = m.Seq
+	}
+	c.commitLog.Append(m)
+	c.tenantSeq(m)
+	c.decidedAt(m)
+	return nil
+}
+
+// remembers timestamp of the latest decided message and,
+// when sharded, of the latest one to every counter getting a part of it
+// must be called with the commit lock held
+func (c *Coordinator) decidedAt(m *Message) {
+	if c.timestamp.Before(m.Timestamp) {
+		c.timestamp = m.Timestamp
+	}
+	if !c.sharded() {
+		return
+	}
+	if c.shardTimestamps == nil {
+		c.shardTimestamps = map[string]Timestamp{}
+	}
+	for addr := range m.Shards {
+		if c.shardTimestamps[addr].Before(m.Timestamp) {
+			c.shardTimestamps[addr] = m.Timestamp
 		}
 	}
+}
+
+// returns sequence of the last decided commit
+func (c *Coordinator) lastSeq() uint64 {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	return c.seq
+}
+
+// durably records the phase of given message and remembers it in the history
+func (c *Coordinator) record(m *Message, p Phase) error {
+	if err := c.txlog.Record(m, p); err != nil {
+		return err
+	}
+	c.history.phase(m, p)
 	return nil
 }
 
+// returns outcome of given transaction for counters which missed it,
+// unknown transaction was never decided to commit and is presumed aborted
+func (c *Coordinator) outcome(id string) (*Outcome, bool) {
+	tx, ok := c.txlog.Get(id)
+	if !ok {
+		return nil, false
+	}
+
+	switch tx.Phase {
+	case PhaseCommitting, PhaseCommitted:
+		return &Outcome{ID: id, Outcome: OutcomeCommitted}, true
+	case PhaseAborted:
+		return &Outcome{ID: id, Outcome: OutcomeAborted}, true
+	default:
+		return &Outcome{ID: id, Outcome: OutcomePending}, true
+	}
+}
+
+// returns whether commit of given message was decided
+func (c *Coordinator) decided(m *Message) bool {
+	tx, ok := c.txlog.Get(m.ID)
+	return ok && tx.decided()
+}
+
+// finishes transactions left in doubt by a previous run,
+// committed ones are delivered again and the rest is aborted
+// gives up once ctx is cancelled, the next leader recovers the rest
+func (c *Coordinator) recover(ctx context.Context) {
+	for _, tx := range c.txlog.InDoubt() {
+		if ctx.Err() != nil {
+			l.Println("[INFO] Recovery cancelled, leadership lost")
+			return
+		}
+
+		switch tx.Phase {
+		case PhasePreCommitted, PhaseCommitting:
+			l.Printf("[INFO] Recovering commit of %s", tx.Message.ID)
+			if _, err := c.commit(tx.Message); err != nil {
+				l.Printf("[ERROR] Unable to recover commit of %s: %s", tx.Message.ID, err.Error())
+			}
+		default:
+			l.Printf("[INFO] Recovering abort of %s", tx.Message.ID)
+			c.abort(tx.Message)
+		}
+	}
+}
+
+// takes over after another coordinator: restores counters
+// and in-doubt transactions it left in the shared log and resolves them
+// until ctx is cancelled
+func (c *Coordinator) takeOver(ctx context.Context) {
+	if err := c.txlog.Reload(); err != nil {
+		l.Printf("[ERROR] Unable to reload transaction log: %s", err.Error())
+		return
+	}
+	if err := c.txlog.Compact(); err != nil {
+		l.Printf("[ERROR] Unable to compact transaction log: %s", err.Error())
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.restore()
+	c.recover(ctx)
+}
+
 func (c *Coordinator) Do(method string, url string, body io.Reader) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, body)
+	return c.DoContext(context.Background(), method, url, body)
+}
+
+func (c *Coordinator) DoContext(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if epoch := c.election.Epoch(); epoch > 0 {
+		req.Header.Set(EpochHeader, strconv.FormatUint(epoch, 10))
+	}
 	resp, err := c.http.Do(req)
 	return resp, err
 }
+
+// whether this coordinator may act, a deposed leader
+// leaves commits in doubt to the new one
+func (c *Coordinator) leading() bool {
+	return c.election.IsLeader()
+}
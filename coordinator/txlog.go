@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Phase string
+
+const (
+	PhasePrepared     Phase = "prepared"
+	PhasePreCommitted Phase = "precommitted"
+	PhaseCommitting   Phase = "committing"
+	PhaseCommitted    Phase = "committed"
+	PhaseAborted      Phase = "aborted"
+)
+
+const (
+	recordTx      = "tx"
+	recordJoin    = "join"
+	recordLeave   = "leave"
+	recordVersion = "version"
+	recordRing    = "ring"
+)
+
+// single line of the transaction log
+type record struct {
+	Type    string    `json:"type"`
+	Phase   Phase     `json:"phase,omitempty"`
+	Message *Message  `json:"message,omitempty"`
+	Addr    string    `json:"addr,omitempty"`
+	Version uint64    `json:"version,omitempty"`
+	Seq     uint64    `json:"seq,omitempty"`
+	Members []string  `json:"members,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// transaction state rebuilt from the log
+type Tx struct {
+	Message *Message
+	Phase   Phase
+	Updated time.Time
+}
+
+func (tx *Tx) done() bool {
+	return tx.Phase == PhaseCommitted || tx.Phase == PhaseAborted
+}
+
+// whether the coordinator decided to commit the transaction,
+// in three-phase commit it still aborts when a counter misses the precommit
+func (tx *Tx) decided() bool {
+	return tx.Phase == PhaseCommitting || tx.Phase == PhaseCommitted
+}
+
+// Write-ahead log of transaction phases and counters membership.
+// Every record is appended as one json line and synced to disk
+// before the coordinator acts on it, so after a crash the log
+// tells which transactions were left in doubt.
+// Finished transactions are kept for the retention period
+// so counters can still ask about their outcome.
+// Nil *TxLog is valid and records nothing.
+type TxLog struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	retention time.Duration
+	txs       map[string]*Tx
+	counters  map[string]bool
+	version   uint64
+	seq       uint64
+	ring      []string
+	// whether this coordinator may still write, e.g. holds the lease
+	fence func() bool
+}
+
+var errFenced = errors.New("transaction log is written by another coordinator")
+
+// stops writes once given function returns false,
+// so a deposed leader does not append to the log shared with the new one
+func (t *TxLog) Fence(f func() bool) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.fence = f
+}
+
+// opens the log under given path and replays it without rewriting it,
+// replicas share the file, so only the leader compacts it with Compact
+func OpenTxLog(path string, retention time.Duration) (*TxLog, error) {
+	t := &TxLog{
+		path:      path,
+		retention: retention,
+		txs:       map[string]*Tx{},
+		counters:  map[string]bool{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := t.replay(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t.file = f
+
+	return t, nil
+}
+
+func (t *TxLog) replay() error {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		r := record{}
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			// the last line may be torn by a crash in the middle of a write
+			l.Printf("[ERROR] Skipping corrupted log record: %s", err.Error())
+			continue
+		}
+		t.apply(&r)
+	}
+
+	return s.Err()
+}
+
+func (t *TxLog) apply(r *record) {
+	switch r.Type {
+	case recordJoin:
+		t.counters[r.Addr] = true
+	case recordLeave:
+		delete(t.counters, r.Addr)
+	case recordRing:
+		t.ring = append([]string{}, r.Members...)
+	case recordVersion:
+		if r.Version > t.version {
+			t.version = r.Version
+		}
+		if r.Seq > t.seq {
+			t.seq = r.Seq
+		}
+	case recordTx:
+		if r.Message == nil {
+			return
+		}
+		if r.Message.Version > t.version {
+			t.version = r.Message.Version
+		}
+		if r.Message.Seq > t.seq {
+			t.seq = r.Message.Seq
+		}
+		t.txs[r.Message.ID] = &Tx{Message: r.Message, Phase: r.Phase, Updated: r.Time}
+	}
+}
+
+// rewrites the log with the current state only,
+// finished transactions older than retention period are forgotten
+// so only counters, in-doubt and recently finished transactions are kept
+func (t *TxLog) compact() error {
+	for id, tx := range t.txs {
+		if tx.done() && time.Since(tx.Updated) > t.retention {
+			delete(t.txs, id)
+		}
+	}
+
+	tmp := t.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	// the highest version and sequence outlive transactions which carried them
+	if err := enc.Encode(&record{Type: recordVersion, Version: t.version, Seq: t.seq, Time: time.Now()}); err != nil {
+		f.Close()
+		return err
+	}
+	for addr := range t.counters {
+		if err := enc.Encode(&record{Type: recordJoin, Addr: addr, Time: time.Now()}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if t.ring != nil {
+		if err := enc.Encode(&record{Type: recordRing, Members: t.ring, Time: time.Now()}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for _, tx := range t.txs {
+		r := &record{Type: recordTx, Phase: tx.Phase, Message: tx.Message, Time: tx.Updated}
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, t.path)
+}
+
+func (t *TxLog) append(r *record) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.fence != nil && !t.fence() {
+		return errFenced
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+
+	t.apply(r)
+	return nil
+}
+
+// compacts the log while it is in use
+func (t *TxLog) Compact() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.fence != nil && !t.fence() {
+		return errFenced
+	}
+
+	if err := t.compact(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	t.file.Close()
+	t.file = f
+
+	return nil
+}
+
+// replays the log again to pick up records appended by another
+// coordinator sharing the same file, and reopens it in case
+// the other one replaced it by compacting
+func (t *TxLog) Reload() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.txs = map[string]*Tx{}
+	t.counters = map[string]bool{}
+	t.version = 0
+	t.seq = 0
+	t.ring = nil
+	if err := t.replay(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	t.file.Close()
+	t.file = f
+
+	return nil
+}
+
+// durably records the phase of given message
+func (t *TxLog) Record(m *Message, p Phase) error {
+	return t.append(&record{Type: recordTx, Phase: p, Message: m, Time: time.Now()})
+}
+
+// durably records registration of a counter
+func (t *TxLog) Join(addr string) error {
+	return t.append(&record{Type: recordJoin, Addr: addr, Time: time.Now()})
+}
+
+// durably records removal of a counter
+func (t *TxLog) Leave(addr string) error {
+	return t.append(&record{Type: recordLeave, Addr: addr, Time: time.Now()})
+}
+
+// durably records counters owning the ring once their tenants moved
+func (t *TxLog) RecordRing(members []string) error {
+	return t.append(&record{Type: recordRing, Members: members, Time: time.Now()})
+}
+
+// returns counters owning the ring, false when it was never recorded
+func (t *TxLog) Ring() ([]string, bool) {
+	if t == nil {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ring == nil {
+		return nil, false
+	}
+	return append([]string{}, t.ring...), true
+}
+
+// returns transactions which are neither committed nor aborted
+func (t *TxLog) InDoubt() []*Tx {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	txs := make([]*Tx, 0)
+	for _, tx := range t.txs {
+		if !tx.done() {
+			txs = append(txs, tx)
+		}
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i].Updated.Before(txs[j].Updated)
+	})
+	return txs
+}
+
+// returns the last recorded state of given transaction
+func (t *TxLog) Get(id string) (Tx, bool) {
+	if t == nil {
+		return Tx{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx, ok := t.txs[id]
+	if !ok {
+		return Tx{}, false
+	}
+	return *tx, true
+}
+
+// returns addresses of registered counters
+func (t *TxLog) Counters() []string {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	addrs := make([]string, 0, len(t.counters))
+	for addr := range t.counters {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// returns the highest version of logged messages
+func (t *TxLog) Version() uint64 {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.version
+}
+
+// returns the highest commit sequence of logged messages
+func (t *TxLog) Seq() uint64 {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.seq
+}
+
+// returns retained messages which are decided to commit,
+// ordered by their commit sequence
+func (t *TxLog) Committed() []*Message {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	messages := []*Message{}
+	for _, tx := range t.txs {
+		if tx.Message.Seq > 0 && tx.decided() {
+			messages = append(messages, tx.Message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Seq < messages[j].Seq
+	})
+	return messages
+}
+
+func (t *TxLog) Close() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.file.Close()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTxLog_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "txlog")
+	txlog, err := OpenTxLog(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Open error: %s", err.Error())
+	}
+
+	prepared := &Message{ID: "prepared", Content: Items{{ID: "item-1", Tenant: "test"}}}
+	committing := &Message{ID: "committing", Content: Items{{ID: "item-2", Tenant: "test"}}}
+	committed := &Message{ID: "committed", Content: Items{{ID: "item-3", Tenant: "test"}}}
+
+	records := []struct {
+		m *Message
+		p Phase
+	}{
+		{prepared, PhasePrepared},
+		{committing, PhasePrepared},
+		{committing, PhaseCommitting},
+		{committed, PhasePrepared},
+		{committed, PhaseCommitting},
+		{committed, PhaseCommitted},
+	}
+	for _, r := range records {
+		if err := txlog.Record(r.m, r.p); err != nil {
+			t.Fatalf("Record error: %s", err.Error())
+		}
+	}
+	txlog.Join("counter-1")
+	txlog.Join("counter-2")
+	txlog.Leave("counter-1")
+	txlog.Close()
+
+	txlog, err = OpenTxLog(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Reopen error: %s", err.Error())
+	}
+	defer txlog.Close()
+
+	phases := map[string]Phase{}
+	for _, tx := range txlog.InDoubt() {
+		phases[tx.Message.ID] = tx.Phase
+	}
+	want := map[string]Phase{"prepared": PhasePrepared, "committing": PhaseCommitting}
+	if !reflect.DeepEqual(want, phases) {
+		t.Errorf("Want %+v, got %+v", want, phases)
+	}
+
+	if tx, ok := txlog.Get("committed"); !ok || tx.Phase != PhaseCommitted {
+		t.Errorf("Want committed transaction to be retained, got %+v", tx)
+	}
+
+	if counters := txlog.Counters(); !reflect.DeepEqual([]string{"counter-2"}, counters) {
+		t.Errorf("Want [counter-2], got %+v", counters)
+	}
+}
+
+func TestTxLog_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "txlog")
+	follower, err := OpenTxLog(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Open error: %s", err.Error())
+	}
+	defer follower.Close()
+
+	// the previous leader appends to the shared log
+	leader, err := OpenTxLog(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Open error: %s", err.Error())
+	}
+	leader.Join("counter-1")
+	leader.Record(&Message{ID: "committing", Version: 7}, PhaseCommitting)
+	leader.Close()
+
+	if err := follower.Reload(); err != nil {
+		t.Fatalf("Reload error: %s", err.Error())
+	}
+
+	if counters := follower.Counters(); !reflect.DeepEqual([]string{"counter-1"}, counters) {
+		t.Errorf("Want [counter-1], got %+v", counters)
+	}
+	if txs := follower.InDoubt(); len(txs) != 1 || txs[0].Message.ID != "committing" {
+		t.Errorf("Want committing transaction in doubt, got %+v", txs)
+	}
+	if v := follower.Version(); v != 7 {
+		t.Errorf("Want version 7, got %d", v)
+	}
+}
+
+func TestTxLog_OpenKeepsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "txlog")
+	leader, err := OpenTxLog(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Open error: %s", err.Error())
+	}
+	defer leader.Close()
+	leader.Join("counter-1")
+
+	// replica started while the leader runs must not replace its file
+	follower, err := OpenTxLog(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Open error: %s", err.Error())
+	}
+	defer follower.Close()
+	follower.Fence(func() bool { return false })
+	if err := follower.Compact(); err != errFenced {
+		t.Errorf("Want fenced compaction, got %v", err)
+	}
+
+	leader.Join("counter-2")
+	if err := follower.Reload(); err != nil {
+		t.Fatalf("Reload error: %s", err.Error())
+	}
+	counters := follower.Counters()
+	sort.Strings(counters)
+	if want := []string{"counter-1", "counter-2"}; !reflect.DeepEqual(want, counters) {
+		t.Errorf("Want %+v, got %+v", want, counters)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// number of leaves of a tenant Merkle tree,
+// item belongs to the leaf given by the first byte of its id hash
+const merkleBuckets = 256
+
+// root of a tenant Merkle tree with the latest version of the tenant
+// and the sequence the counter applied when it built the tree
+type TreeRoot struct {
+	Hash    string `json:"hash"`
+	Version uint64 `json:"version,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+}
+
+// Merkle tree of a tenant item set, leaves are hashes of sorted item ids
+// and of tombstones in the bucket, inner nodes hash their two children
+type Tree struct {
+	Leaves [merkleBuckets]string `json:"leaves"`
+	Root   string                `json:"root"`
+}
+
+func bucket(id string) int {
+	h := sha256.Sum256([]byte(id))
+	return int(h[0])
+}
+
+func hash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// builds the tree from distinct item ids and versions of deletes by item id,
+// leaf without tombstones hashes its item ids only
+func newTree(ids map[string]bool, deleted map[string]uint64) *Tree {
+	buckets := [merkleBuckets][]string{}
+	for id := range ids {
+		b := bucket(id)
+		buckets[b] = append(buckets[b], id)
+	}
+	tombstones := [merkleBuckets][]string{}
+	for id, version := range deleted {
+		b := bucket(id)
+		tombstones[b] = append(tombstones[b], fmt.Sprintf("%s@%d", id, version))
+	}
+
+	t := &Tree{}
+	for i, b := range buckets {
+		sort.Strings(b)
+		j, _ := json.Marshal(b)
+		if len(tombstones[i]) > 0 {
+			sort.Strings(tombstones[i])
+			d, _ := json.Marshal(tombstones[i])
+			j = append(j, d...)
+		}
+		t.Leaves[i] = hash(j)
+	}
+
+	level := t.Leaves[:]
+	for len(level) > 1 {
+		next := make([]string, len(level)/2)
+		for i := range next {
+			next[i] = hash([]byte(level[2*i] + level[2*i+1]))
+		}
+		level = next
+	}
+	t.Root = level[0]
+
+	return t
+}
+
+func (c *Counter) merkleRoots() map[string]TreeRoot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// tenant whose items were all deleted still has tombstones
+	deleted := c.deletedIDs()
+	roots := map[string]TreeRoot{}
+	for _, tenant := range c.store.Tenants() {
+		roots[tenant] = TreeRoot{}
+	}
+	for tenant := range deleted {
+		roots[tenant] = TreeRoot{}
+	}
+	for tenant := range roots {
+		roots[tenant] = TreeRoot{Hash: newTree(c.tenantIDs(tenant), deleted[tenant]).Root, Version: c.versions[tenant], Seq: c.seq}
+	}
+	return roots
+}
+
+func (c *Counter) merkleTree(tenant string) *Tree {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return newTree(c.tenantIDs(tenant), c.deletedIDs()[tenant])
+}
+
+// returns versions of deletes by tenant and item id
+// must be called with the lock held
+func (c *Counter) deletedIDs() map[string]map[string]uint64 {
+	deleted := map[string]map[string]uint64{}
+	for i, t := range c.tombstones {
+		if deleted[i.Tenant] == nil {
+			deleted[i.Tenant] = map[string]uint64{}
+		}
+		deleted[i.Tenant][i.ID] = t.Version
+	}
+	return deleted
+}
+
+// returns item ids of the tenant
+// must be called with the lock held
+func (c *Counter) tenantIDs(tenant string) map[string]bool {
+	ids := map[string]bool{}
+	c.store.Range(tenant, func(i Item) {
+		ids[i.ID] = true
+	})
+	return ids
+}
+
+// returns items of the tenant which fall into the bucket
+func (c *Counter) bucketItems(tenant string, b int) Items {
+	c.mu.Lock()
+	items := Items{}
+	c.store.Range(tenant, func(i Item) {
+		if bucket(i.ID) == b {
+			items = append(items, i)
+		}
+	})
+	c.mu.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+// returns tombstones of the tenant which fall into the bucket
+func (c *Counter) bucketTombstones(tenant string, b int) []Tombstone {
+	c.mu.Lock()
+	tombstones := []Tombstone{}
+	for i, t := range c.tombstones {
+		if i.Tenant == tenant && bucket(i.ID) == b {
+			tombstones = append(tombstones, t)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(tombstones, func(i, j int) bool {
+		return tombstones[i].ID < tombstones[j].ID
+	})
+	return tombstones
+}
+
+// adds items missing locally, returns the number of added ones,
+// once the counter has every item of the peer it takes over the peer version,
+// peer applied every commit up to the sequence
+func (c *Counter) repair(tenant string, items Items, version uint64, seq uint64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	added, err := c.repairLocked(tenant, items, version, seq)
+	if err != nil {
+		return 0, err
+	}
+	if added > 0 || version > 0 {
+		c.journalLocked(&JournalEntry{Tenant: tenant, Items: items, Version: version, Seq: seq})
+	}
+	return added, nil
+}
+
+// version is not taken over when items could not be stored
+// must be called with the lock held
+func (c *Counter) repairLocked(tenant string, items Items, version uint64, seq uint64) (int, error) {
+	// peer which missed a delete must not bring its items back,
+	// peer which applied it has items added again since then,
+	// items of approximate tenants moved with a range go to their sketches
+	added, err := c.store.Add(c.liveSinceLocked(c.sketches.Add(items), seq))
+	if err != nil {
+		l.Printf("[ERROR] Unable to store repaired items of %s: %s", tenant, err.Error())
+		return 0, err
+	}
+
+	if c.versions == nil {
+		c.versions = map[string]uint64{}
+	}
+	if version > c.versions[tenant] {
+		c.versions[tenant] = version
+	}
+	return added, nil
+}
+
+// removes items deleted by a peer, returns the number of removed ones
+func (c *Counter) repairDeletes(tombstones []Tombstone) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deleted, err := c.mergeTombstonesLocked(tombstones)
+	if err != nil {
+		l.Printf("[ERROR] Unable to delete repaired items: %s", err.Error())
+		return 0, err
+	}
+	if len(tombstones) > 0 {
+		c.journalLocked(&JournalEntry{Tombstones: tombstones})
+	}
+	return deleted, nil
+}
+
+type AntiEntropyStats struct {
+	Rounds          int       `json:"rounds"`
+	Failures        int       `json:"failures"`
+	TenantsCompared int       `json:"tenantsCompared"`
+	TenantsDiverged int       `json:"tenantsDiverged"`
+	BucketsFetched  int       `json:"bucketsFetched"`
+	ItemsRepaired   int       `json:"itemsRepaired"`
+	ItemsDeleted    int       `json:"itemsDeleted"`
+	LastPeer        string    `json:"lastPeer,omitempty"`
+	LastRound       time.Time `json:"lastRound"`
+}
+
+// AntiEntropy repairs items a counter missed, e.g. because it did not
+// get a commit. Every round the counter compares Merkle roots of its
+// tenants with a random peer, descends into leaves of the ones which
+// differ and pulls items and tombstones of buckets it does not have.
+// Every counter ends up with the union of the items of its peers
+// without the ones deleted by any of them.
+// Sharded counter compares only tenants the coordinator ring places on it,
+// including ones it missed entirely, the peer may own other tenants.
+type AntiEntropy struct {
+	counter *Counter
+	sharded bool
+
+	mu    sync.Mutex
+	stats AntiEntropyStats
+}
+
+func NewAntiEntropy(c *Counter, sharded bool) *AntiEntropy {
+	return &AntiEntropy{counter: c, sharded: sharded}
+}
+
+func (a *AntiEntropy) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		peers, err := a.counter.peers()
+		if err != nil {
+			l.Printf("[ERROR] Unable to get peers for anti-entropy: %s", err.Error())
+			continue
+		}
+		if len(peers) == 0 {
+			continue
+		}
+
+		peer := peers[rand.Intn(len(peers))]
+		if err := a.round(peer); err != nil {
+			l.Printf("[ERROR] Anti-entropy with %s failed: %s", peer, err.Error())
+		}
+	}
+}
+
+func (a *AntiEntropy) round(peer string) error {
+	stats := AntiEntropyStats{}
+	err := a.sync(peer, &stats)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stats.Rounds++
+	if err != nil {
+		a.stats.Failures++
+	}
+	a.stats.TenantsCompared += stats.TenantsCompared
+	a.stats.TenantsDiverged += stats.TenantsDiverged
+	a.stats.BucketsFetched += stats.BucketsFetched
+	a.stats.ItemsRepaired += stats.ItemsRepaired
+	a.stats.ItemsDeleted += stats.ItemsDeleted
+	a.stats.LastPeer = peer
+	a.stats.LastRound = time.Now()
+
+	return err
+}
+
+func (a *AntiEntropy) sync(peer string, stats *AntiEntropyStats) error {
+	theirs := map[string]TreeRoot{}
+	if err := a.get(peer, "/merkle", &theirs); err != nil {
+		return err
+	}
+	ours := a.counter.merkleRoots()
+
+	var placement *Placement
+	if a.sharded {
+		p, err := a.counter.placement()
+		if err != nil {
+			return err
+		}
+		placement = p
+	}
+
+	for tenant, root := range theirs {
+		if !placement.Owns(a.counter.Me, tenant) {
+			continue
+		}
+		stats.TenantsCompared++
+		if ours[tenant].Hash == root.Hash {
+			if _, err := a.counter.repair(tenant, nil, root.Version, root.Seq); err != nil {
+				return err
+			}
+			continue
+		}
+		stats.TenantsDiverged++
+
+		tree := Tree{}
+		if err := a.get(peer, fmt.Sprintf("/merkle/%s", tenant), &tree); err != nil {
+			return err
+		}
+
+		local := a.counter.merkleTree(tenant)
+		complete := true
+		for b := range tree.Leaves {
+			if tree.Leaves[b] == local.Leaves[b] {
+				continue
+			}
+
+			// deletes go first, so a delete of the peer is not undone by its own items
+			tombstones := []Tombstone{}
+			items := Items{}
+			if err := a.get(peer, fmt.Sprintf("/merkle/%s/%d/tombstones", tenant, b), &tombstones); err != nil {
+				complete = false
+				continue
+			}
+			if err := a.get(peer, fmt.Sprintf("/merkle/%s/%d", tenant, b), &items); err != nil {
+				complete = false
+				continue
+			}
+
+			stats.BucketsFetched++
+			deleted, err := a.counter.repairDeletes(tombstones)
+			if err != nil {
+				complete = false
+				continue
+			}
+			stats.ItemsDeleted += deleted
+			added, err := a.counter.repair(tenant, items, 0, root.Seq)
+			if err != nil {
+				complete = false
+				continue
+			}
+			stats.ItemsRepaired += added
+		}
+
+		if complete {
+			if _, err := a.counter.repair(tenant, nil, root.Version, root.Seq); err != nil {
+				return err
+			}
+		}
+	}
+
+	if stats.ItemsRepaired > 0 || stats.ItemsDeleted > 0 {
+		l.Printf("[INFO] %s repaired %d and deleted %d items from %s", a.counter.Me, stats.ItemsRepaired, stats.ItemsDeleted, peer)
+	}
+	return nil
+}
+
+func (a *AntiEntropy) get(peer string, path string, v interface{}) error {
+	resp, err := a.counter.Do(http.MethodGet, fmt.Sprintf("http://%s%s", peer, path), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (a *AntiEntropy) Stats() AntiEntropyStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.stats
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAntiEntropy_round(t *testing.T) {
+	peer := NewCounter("peer", nil, nil)
+	peer.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}}})
+	peer.apply(&Message{ID: "message-2", Version: 2, Content: Items{{ID: "item-3", Tenant: "other"}}})
+
+	c := NewCounter("counter", nil, nil)
+	c.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}}})
+	c.apply(&Message{ID: "message-3", Version: 3, Content: Items{{ID: "item-4", Tenant: "test"}}})
+	c.http = NewTestClient(func(req *http.Request) *http.Response {
+		rr := httptest.NewRecorder()
+		NewMerkle(peer).ServeHTTP(rr, req)
+		return rr.Result()
+	})
+
+	a := NewAntiEntropy(c, false)
+	if err := a.round("peer"); err != nil {
+		t.Fatalf("Round error: %s", err.Error())
+	}
+
+	if count := c.countItemsForTenant("other"); count.Value != 1 || count.Version != 2 {
+		t.Errorf("Want repaired tenant with 1 item at version 2, got %+v", count)
+	}
+	if count := c.countItemsForTenant("test"); count.Value != 3 || count.Version != 3 {
+		t.Errorf("Want untouched tenant with 3 items at version 3, got %+v", count)
+	}
+
+	stats := a.Stats()
+	if stats.Rounds != 1 || stats.TenantsCompared != 2 || stats.TenantsDiverged != 2 || stats.ItemsRepaired != 1 {
+		t.Errorf("Want 2 tenants diverged and 1 item repaired, got %+v", stats)
+	}
+
+	// nothing to repair once the counter has every item of the peer
+	if err := a.round("peer"); err != nil {
+		t.Fatalf("Round error: %s", err.Error())
+	}
+	if stats := a.Stats(); stats.ItemsRepaired != 1 {
+		t.Errorf("Want no more repairs, got %+v", stats)
+	}
+}
+
+func TestAntiEntropy_roundSharded(t *testing.T) {
+	ring := NewRing([]string{"counter", "peer"}, 16)
+	owned, other := "", ""
+	for i := 0; owned == "" || other == ""; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		if ring.Owners(tenant, 1)[0] == "counter" {
+			owned = tenant
+		} else {
+			other = tenant
+		}
+	}
+
+	// peer keeps a tenant it lost and has one the counter missed entirely
+	peer := NewCounter("peer", nil, nil)
+	peer.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: owned}, {ID: "item-2", Tenant: other}}})
+
+	c := NewCounter("counter", nil, nil)
+	c.http = NewTestClient(func(req *http.Request) *http.Response {
+		rr := httptest.NewRecorder()
+		if req.URL.Path == "/ring" {
+			rr.WriteString(`{"members":["counter","peer"],"replicationFactor":1,"vnodes":16}`)
+			return rr.Result()
+		}
+		NewMerkle(peer).ServeHTTP(rr, req)
+		return rr.Result()
+	})
+
+	a := NewAntiEntropy(c, true)
+	if err := a.round("peer"); err != nil {
+		t.Fatalf("Round error: %s", err.Error())
+	}
+
+	if count := c.countItemsForTenant(owned); count.Value != 1 {
+		t.Errorf("Want missed tenant %s repaired, got %+v", owned, count)
+	}
+	if count := c.countItemsForTenant(other); count.Value != 0 {
+		t.Errorf("Want tenant %s of another counter skipped, got %+v", other, count)
+	}
+	if stats := a.Stats(); stats.TenantsCompared != 1 {
+		t.Errorf("Want 1 tenant compared, got %+v", stats)
+	}
+}
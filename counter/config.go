@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// returns value of the environment variable
+// or given default when it is not set
+func env(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// returns duration parsed from the environment variable
+// or given default when it is not set or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		l.Printf("[ERROR] Invalid %s, using %s: %s", key, def, err.Error())
+		return def
+	}
+	return d
+}
+
+// returns integer parsed from the environment variable
+// or given default when it is not set or invalid
+func envInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		l.Printf("[ERROR] Invalid %s, using %d: %s", key, def, err.Error())
+		return def
+	}
+	return i
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	diskAdd    = "add"
+	diskDelete = "delete"
+	diskDrop   = "drop"
+	diskReset  = "reset"
+)
+
+// number of records after which the items log is truncated
+const diskCompactAfter = 1000
+
+// change of the items stored as one line of the log
+type diskRecord struct {
+	Op     string `json:"op"`
+	Items  Items  `json:"items,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// items of one tenant stored in a file of its own
+type diskTenant struct {
+	Tenant string   `json:"tenant"`
+	IDs    []string `json:"ids"`
+}
+
+// DiskStorage keeps items of every tenant in a file of its own,
+// so only items of the tenant being read or written are loaded
+// and memory holds just the number of items of every tenant.
+// Every change is appended to a log of json lines and synced
+// before the files of its tenants are written, so a change
+// interrupted by a crash is written again when the log is replayed.
+// Replaying a change twice is harmless, so once the log holds
+// many records, all of them written already, it is truncated.
+type DiskStorage struct {
+	*PreparedSet
+	dir     string
+	path    string
+	log     *os.File
+	records int
+	counts  map[string]int
+}
+
+func OpenDiskStorage(dir string) (*DiskStorage, error) {
+	prepared, err := NewPreparedStore(preparedPath(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DiskStorage{
+		PreparedSet: NewPreparedSet(prepared),
+		dir:         filepath.Join(dir, "tenants"),
+		path:        filepath.Join(dir, "items.log"),
+		counts:      map[string]int{},
+	}
+	if err := s.LoadPrepared(); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+
+	return s, nil
+}
+
+// finishes reset interrupted by a crash, counts items of every tenant
+// and replays the log written by the previous run
+func (s *DiskStorage) load() error {
+	if _, err := os.Stat(s.dir); os.IsNotExist(err) {
+		if err := os.Rename(s.dir+".tmp", s.dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	os.RemoveAll(s.dir + ".tmp")
+	os.RemoveAll(s.dir + ".old")
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		t, err := s.readFile(filepath.Join(s.dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		s.counts[t.Tenant] = len(t.IDs)
+	}
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		r := diskRecord{}
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			// the last line may be torn by a crash in the middle of a write
+			l.Printf("[ERROR] Skipping corrupted items record: %s", err.Error())
+			continue
+		}
+
+		switch r.Op {
+		case diskAdd:
+			err = s.write(r.Items, true)
+		case diskDelete:
+			err = s.write(r.Items, false)
+		case diskDrop:
+			err = s.drop(r.Tenant)
+		case diskReset:
+			// log of the previous versions kept all items in one record
+			err = s.reset(r.Items)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	// every record is written to the files of its tenants now
+	return writeFile(s.path, nil)
+}
+
+func (s *DiskStorage) Apply(m *Message) (int, error) {
+	if m.Op == OpDelete {
+		return s.Delete(m.Content)
+	}
+	return s.Add(m.Content)
+}
+
+func (s *DiskStorage) Add(items Items) (int, error) {
+	return s.change(diskAdd, items)
+}
+
+func (s *DiskStorage) Delete(items Items) (int, error) {
+	return s.change(diskDelete, items)
+}
+
+// logs items which change and writes them to the files of their tenants
+func (s *DiskStorage) change(op string, items Items) (int, error) {
+	changed := Items{}
+	tenants := map[string]map[string]bool{}
+	for _, i := range items {
+		ids, ok := tenants[i.Tenant]
+		if !ok {
+			ids = s.ids(i.Tenant)
+			tenants[i.Tenant] = ids
+		}
+		// ids are updated, so a repeated item changes only once
+		if ids[i.ID] != (op == diskAdd) {
+			ids[i.ID] = op == diskAdd
+			changed = append(changed, i)
+		}
+	}
+	if len(changed) == 0 {
+		return 0, nil
+	}
+
+	if err := s.append(&diskRecord{Op: op, Items: changed}); err != nil {
+		return 0, err
+	}
+	if err := s.write(changed, op == diskAdd); err != nil {
+		return 0, err
+	}
+	s.compact()
+	return len(changed), nil
+}
+
+// writes the whole set of items to a new directory and swaps it
+// with the current one, the log is truncated first, as its records
+// are written already and replaying them would change the new set
+func (s *DiskStorage) Reset(items Items) error {
+	if err := s.truncate(); err != nil {
+		return err
+	}
+	return s.reset(items)
+}
+
+func (s *DiskStorage) reset(items Items) error {
+	tmp := s.dir + ".tmp"
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	index := NewIndex(items)
+	for _, tenant := range index.Tenants() {
+		t := diskTenant{Tenant: tenant, IDs: []string{}}
+		index.Range(tenant, func(i Item) {
+			t.IDs = append(t.IDs, i.ID)
+		})
+		if err := s.writeFile(filepath.Join(tmp, tenantFile(tenant)), t); err != nil {
+			return err
+		}
+		counts[tenant] = len(t.IDs)
+	}
+
+	if err := os.Rename(s.dir, s.dir+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.dir); err != nil {
+		return err
+	}
+	os.RemoveAll(s.dir + ".old")
+	s.counts = counts
+	return nil
+}
+
+func (s *DiskStorage) Drop(tenant string) (int, error) {
+	dropped := s.counts[tenant]
+	if dropped == 0 {
+		return 0, nil
+	}
+
+	if err := s.append(&diskRecord{Op: diskDrop, Tenant: tenant}); err != nil {
+		return 0, err
+	}
+	if err := s.drop(tenant); err != nil {
+		return 0, err
+	}
+	s.compact()
+	return dropped, nil
+}
+
+func (s *DiskStorage) drop(tenant string) error {
+	if err := os.Remove(filepath.Join(s.dir, tenantFile(tenant))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.counts, tenant)
+	return nil
+}
+
+func (s *DiskStorage) Count(tenant string) int {
+	return s.counts[tenant]
+}
+
+func (s *DiskStorage) Has(i Item) bool {
+	if s.counts[i.Tenant] == 0 {
+		return false
+	}
+	return s.ids(i.Tenant)[i.ID]
+}
+
+func (s *DiskStorage) Tenants() []string {
+	tenants := make([]string, 0, len(s.counts))
+	for tenant := range s.counts {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+func (s *DiskStorage) Range(tenant string, f func(i Item)) {
+	if s.counts[tenant] == 0 {
+		return
+	}
+	for id := range s.ids(tenant) {
+		f(Item{ID: id, Tenant: tenant})
+	}
+}
+
+func (s *DiskStorage) Items() Items {
+	items := Items{}
+	for _, tenant := range s.Tenants() {
+		ids := make([]string, 0, s.counts[tenant])
+		for id := range s.ids(tenant) {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			items = append(items, Item{ID: id, Tenant: tenant})
+		}
+	}
+	return items
+}
+
+func (s *DiskStorage) Durable() bool {
+	return true
+}
+
+func (s *DiskStorage) Close() error {
+	return s.log.Close()
+}
+
+// name of the file of the tenant, tenant ids may be any strings
+func tenantFile(tenant string) string {
+	return fmt.Sprintf("%x.json", sha256.Sum256([]byte(tenant)))
+}
+
+// returns ids of the tenant, read errors leave it empty
+func (s *DiskStorage) ids(tenant string) map[string]bool {
+	ids := map[string]bool{}
+	t, err := s.readFile(filepath.Join(s.dir, tenantFile(tenant)))
+	if err != nil && !os.IsNotExist(err) {
+		l.Printf("[ERROR] Unable to read items of %s: %s", tenant, err.Error())
+	}
+	for _, id := range t.IDs {
+		ids[id] = true
+	}
+	return ids
+}
+
+// adds or deletes items in the files of their tenants
+func (s *DiskStorage) write(items Items, add bool) error {
+	byTenant := map[string]Items{}
+	for _, i := range items {
+		byTenant[i.Tenant] = append(byTenant[i.Tenant], i)
+	}
+
+	for tenant, items := range byTenant {
+		ids := s.ids(tenant)
+		n := len(ids)
+		for _, i := range items {
+			if add {
+				ids[i.ID] = true
+			} else {
+				delete(ids, i.ID)
+			}
+		}
+		if len(ids) == n {
+			continue
+		}
+
+		path := filepath.Join(s.dir, tenantFile(tenant))
+		if len(ids) == 0 {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(s.counts, tenant)
+			continue
+		}
+
+		t := diskTenant{Tenant: tenant, IDs: make([]string, 0, len(ids))}
+		for id := range ids {
+			t.IDs = append(t.IDs, id)
+		}
+		sort.Strings(t.IDs)
+		if err := s.writeFile(path, t); err != nil {
+			return err
+		}
+		s.counts[tenant] = len(ids)
+	}
+	return nil
+}
+
+func (s *DiskStorage) readFile(path string) (diskTenant, error) {
+	t := diskTenant{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(b, &t)
+	return t, err
+}
+
+func (s *DiskStorage) writeFile(path string, t diskTenant) error {
+	b, err := json.Marshal(&t)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, b)
+}
+
+func (s *DiskStorage) append(r *diskRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// truncates the log once it grew, its records are written already,
+// so a failure only leaves the log longer
+func (s *DiskStorage) compact() {
+	if s.records < diskCompactAfter {
+		return
+	}
+	if err := s.truncate(); err != nil {
+		l.Printf("[ERROR] Unable to truncate items log: %s", err.Error())
+	}
+}
+
+func (s *DiskStorage) truncate() error {
+	if err := writeFile(s.path, nil); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log = f
+	s.records = 0
+
+	return nil
+}
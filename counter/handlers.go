@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"regexp"
+	"strconv"
+	"time"
 )
 
 type Init struct {
@@ -14,6 +16,10 @@ type Abort struct {
 	counter *Counter
 }
 
+type PreCommit struct {
+	counter *Counter
+}
+
 type Commit struct {
 	counter *Counter
 }
@@ -26,10 +32,53 @@ type ItemsGet struct {
 	counter *Counter
 }
 
+type Expired struct {
+	sweeper *Sweeper
+}
+
 type HealthCheck struct {
 	counter *Counter
 }
 
+type CoordinatorLease struct {
+	leases *Leases
+}
+
+// Fencing refuses requests of a coordinator which is no longer the leader
+type Fencing struct {
+	leases *Leases
+	next   http.Handler
+}
+
+type Merkle struct {
+	counter *Counter
+}
+
+type AntiEntropyMetrics struct {
+	antiEntropy *AntiEntropy
+}
+
+type SnapshotServe struct {
+	snapshots *Snapshots
+}
+
+type TombstonesGet struct {
+	counter *Counter
+}
+
+type SketchServe struct {
+	counter *Counter
+}
+
+type Ranges struct {
+	counter *Counter
+}
+
+type RaftRPC struct {
+	raft    *Raft
+	timeout time.Duration
+}
+
 func NewInit(c *Counter) *Init {
 	return &Init{c}
 }
@@ -38,6 +87,10 @@ func NewAbort(c *Counter) *Abort {
 	return &Abort{c}
 }
 
+func NewPreCommit(c *Counter) *PreCommit {
+	return &PreCommit{c}
+}
+
 func NewCommit(c *Counter) *Commit {
 	return &Commit{c}
 }
@@ -50,10 +103,70 @@ func NewItemsGet(c *Counter) *ItemsGet {
 	return &ItemsGet{c}
 }
 
+func NewExpired(s *Sweeper) *Expired {
+	return &Expired{s}
+}
+
 func NewHealthCheck(c *Counter) *HealthCheck {
 	return &HealthCheck{c}
 }
 
+func NewCoordinatorLease(s *Leases) *CoordinatorLease {
+	return &CoordinatorLease{s}
+}
+
+func NewFencing(s *Leases, next http.Handler) *Fencing {
+	return &Fencing{s, next}
+}
+
+func NewMerkle(c *Counter) *Merkle {
+	return &Merkle{c}
+}
+
+func NewAntiEntropyMetrics(a *AntiEntropy) *AntiEntropyMetrics {
+	return &AntiEntropyMetrics{a}
+}
+
+func NewSnapshotServe(s *Snapshots) *SnapshotServe {
+	return &SnapshotServe{s}
+}
+
+func NewTombstonesGet(c *Counter) *TombstonesGet {
+	return &TombstonesGet{c}
+}
+
+func NewSketchServe(c *Counter) *SketchServe {
+	return &SketchServe{c}
+}
+
+func NewRanges(c *Counter) *Ranges {
+	return &Ranges{c}
+}
+
+func NewRaftRPC(r *Raft, timeout time.Duration) *RaftRPC {
+	return &RaftRPC{r, timeout}
+}
+
+func (h *Fencing) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var epoch uint64
+	if header := r.Header.Get(EpochHeader); header != "" {
+		e, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			l.Println("[ERROR] Invalid coordinator epoch:", header)
+			http.Error(rw, "Invalid coordinator epoch", http.StatusBadRequest)
+			return
+		}
+		epoch = e
+	}
+
+	if !h.leases.Current(epoch) {
+		l.Printf("[ERROR] Refused %s %s of stale coordinator epoch %d", r.Method, r.URL, epoch)
+		http.Error(rw, "Stale coordinator epoch", http.StatusPreconditionFailed)
+		return
+	}
+	h.next.ServeHTTP(rw, r)
+}
+
 func (h *CountItems) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -69,6 +182,15 @@ func (h *CountItems) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// in raft mode the count reflects every write committed before the request
+		if h.counter.raft != nil {
+			if err := h.counter.raft.ReadBarrier(h.counter.http.Timeout); err != nil {
+				l.Println("[ERROR] Linearizable read failed:", err)
+				http.Error(rw, "Unable to read from raft group", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
 		tenantID := g[0][1]
 		count := h.counter.countItemsForTenant(tenantID)
 		if err := json.NewEncoder(rw).Encode(count); err != nil {
@@ -94,7 +216,19 @@ func (h *Init) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		h.counter.acceptMessage(&m)
+		if err := h.counter.acceptMessage(&m); err != nil {
+			if r, ok := err.(*Rejection); ok {
+				l.Printf("[INFO] %s refused %s: %s", h.counter.Me, m.ID, r.Error())
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(http.StatusConflict)
+				json.NewEncoder(rw).Encode(r)
+				return
+			}
+
+			l.Println("[ERROR] Unable to store message:", err)
+			http.Error(rw, "Unable to store message", http.StatusInternalServerError)
+			return
+		}
 		l.Printf("[INFO] %s initialized: %+v", h.counter.Me, m)
 
 	default:
@@ -122,6 +256,34 @@ func (h *Abort) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *PreCommit) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+
+		m := Message{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			l.Println("[ERROR] Unable to unmarshal json:", err)
+			http.Error(rw, "Unable to unmarshal json", http.StatusBadRequest)
+			return
+		}
+
+		if err := h.counter.preCommit(&m); err == errNotPrepared {
+			l.Printf("[ERROR] %s cannot precommit not prepared %s", h.counter.Me, m.ID)
+			http.Error(rw, "Message is not prepared", http.StatusNotFound)
+			return
+		} else if err != nil {
+			l.Printf("[ERROR] %s cannot precommit %s: %s", h.counter.Me, m.ID, err.Error())
+			http.Error(rw, "Unable to store message", http.StatusInternalServerError)
+			return
+		}
+		l.Printf("[INFO] %s precommitted: %+v", h.counter.Me, m)
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
 func (h *Commit) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
@@ -134,7 +296,12 @@ func (h *Commit) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		h.counter.commit(&m)
+		// commit which is not acknowledged is delivered again
+		if err := h.counter.commit(&m); err != nil {
+			l.Printf("[ERROR] %s unable to commit %s: %s", h.counter.Me, m.ID, err.Error())
+			http.Error(rw, "Unable to store items", http.StatusInternalServerError)
+			return
+		}
 		l.Printf("[INFO] %s committed: %+v", h.counter.Me, m)
 
 	default:
@@ -148,7 +315,45 @@ func (h *ItemsGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		l.Println("[INFO] Handle", r.Method, r.URL)
 		rw.Header().Set("Content-Type", "application/json")
 
-		if err := json.NewEncoder(rw).Encode(h.counter.Items); err != nil {
+		items, seq := h.counter.appliedItems()
+		rw.Header().Set(AppliedSeqHeader, strconv.FormatUint(seq, 10))
+		if err := json.NewEncoder(rw).Encode(items); err != nil {
+			l.Println("[ERROR] Unable to marshall json:", err)
+			http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Expired) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		// recent decisions or state of a message other participants ask about
+		reg := regexp.MustCompile(`^\/expired(?:\/([^\/]+))?\/?$`)
+		g := reg.FindStringSubmatch(r.URL.Path)
+		if g == nil {
+			l.Println("[ERROR] Invalid URI:", r.URL.Path)
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+
+		var resp interface{} = h.sweeper.Decisions()
+		if g[1] != "" {
+			state := h.sweeper.State(g[1])
+			if state == "" {
+				http.Error(rw, "Unknown message", http.StatusNotFound)
+				return
+			}
+			resp = &MessageState{ID: g[1], State: state}
+		}
+
+		if err := json.NewEncoder(rw).Encode(resp); err != nil {
 			l.Println("[ERROR] Unable to marshall json:", err)
 			http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
 			return
@@ -161,4 +366,346 @@ func (h *ItemsGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 func (h *HealthCheck) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	l.Printf("[INFO] %s healthy", h.counter.Me)
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(h.counter.health()); err != nil {
+		l.Println("[ERROR] Unable to encode health:", err)
+	}
+}
+
+func (h *CoordinatorLease) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		req := LeaseRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Holder == "" {
+			l.Println("[ERROR] Invalid lease request:", err)
+			http.Error(rw, "Invalid lease request", http.StatusBadRequest)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		lease, ok := h.leases.Grant(req.Holder, req.Duration, req.Epoch)
+		if !ok {
+			rw.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(rw).Encode(&lease)
+
+	case http.MethodDelete:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+
+		req := LeaseRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			l.Println("[ERROR] Unable to unmarshal json:", err)
+			http.Error(rw, "Unable to unmarshal json", http.StatusBadRequest)
+			return
+		}
+		h.leases.Release(req.Holder)
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Merkle) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rw.Header().Set("Content-Type", "application/json")
+
+		// roots of every tenant, leaves of a tenant, items or tombstones of a bucket
+		reg := regexp.MustCompile(`^\/merkle(?:\/([^\/]+)(?:\/(\d+)(\/tombstones)?)?)?\/?$`)
+		g := reg.FindStringSubmatch(r.URL.Path)
+		if g == nil {
+			l.Println("[ERROR] Invalid URI:", r.URL.Path)
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+
+		var resp interface{}
+		switch {
+		case g[1] == "":
+			resp = h.counter.merkleRoots()
+		case g[2] == "":
+			resp = h.counter.merkleTree(g[1])
+		default:
+			b, err := strconv.Atoi(g[2])
+			if err != nil || b >= merkleBuckets {
+				http.Error(rw, "Invalid bucket", http.StatusBadRequest)
+				return
+			}
+			resp = h.counter.bucketItems(g[1], b)
+			if g[3] != "" {
+				resp = h.counter.bucketTombstones(g[1], b)
+			}
+		}
+
+		if err := json.NewEncoder(rw).Encode(resp); err != nil {
+			l.Println("[ERROR] Unable to marshall json:", err)
+			http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *AntiEntropyMetrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(rw).Encode(h.antiEntropy.Stats()); err != nil {
+			l.Println("[ERROR] Unable to marshall json:", err)
+			http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *SnapshotServe) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		// manifest of a new snapshot or one of its chunks
+		reg := regexp.MustCompile(`^\/snapshot(?:\/([^\/]+)\/(\d+))?\/?$`)
+		g := reg.FindStringSubmatch(r.URL.Path)
+		if g == nil {
+			l.Println("[ERROR] Invalid URI:", r.URL.Path)
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+
+		if g[1] == "" {
+			manifest, err := h.snapshots.Create()
+			if err != nil {
+				l.Println("[ERROR] Unable to create snapshot:", err)
+				http.Error(rw, "Unable to create snapshot", http.StatusInternalServerError)
+				return
+			}
+			if err := json.NewEncoder(rw).Encode(manifest); err != nil {
+				l.Println("[ERROR] Unable to marshall json:", err)
+				http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		index, _ := strconv.Atoi(g[2])
+		chunk, ok := h.snapshots.Chunk(g[1], index)
+		if !ok {
+			http.Error(rw, "Snapshot chunk not found", http.StatusNotFound)
+			return
+		}
+		rw.Write(chunk)
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Ranges) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	l.Println("[INFO] Handle", r.Method, r.URL)
+	rw.Header().Set("Content-Type", "application/json")
+
+	// sketches of approximate tenants of a moved range
+	if r.Method == http.MethodPost && r.URL.Path == "/range/sketches" {
+		sketches := map[string]*Sketch{}
+		if err := json.NewDecoder(r.Body).Decode(&sketches); err != nil {
+			l.Println("[ERROR] Unable to unmarshal json:", err)
+			http.Error(rw, "Unable to unmarshal json", http.StatusBadRequest)
+			return
+		}
+		h.counter.mergeSketches(sketches)
+		json.NewEncoder(rw).Encode(map[string]int{"merged": len(sketches)})
+		return
+	}
+
+	// items moved to the counter are posted without the range
+	if r.Method == http.MethodPost {
+		items := Items{}
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			l.Println("[ERROR] Unable to unmarshal json:", err)
+			http.Error(rw, "Unable to unmarshal json", http.StatusBadRequest)
+			return
+		}
+
+		// late writes carry their version, sequence and operation
+		q := r.URL.Query()
+		version, _ := strconv.ParseUint(q.Get("version"), 10, 64)
+		seq, _ := strconv.ParseUint(q.Get("seq"), 10, 64)
+		key, merge := "added", h.counter.mergeItems
+		if q.Get("op") == OpDelete {
+			key, merge = "deleted", h.counter.deleteItems
+		}
+		n, err := merge(items, version, seq)
+		if err != nil {
+			l.Printf("[ERROR] %s unable to store moved items: %s", h.counter.Me, err.Error())
+			http.Error(rw, "Unable to store items", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(rw).Encode(map[string]int{key: n})
+		return
+	}
+
+	reg := regexp.MustCompile(`^\/range\/(\d+)\/(\d+)(\/sketches)?\/?$`)
+	g := reg.FindStringSubmatch(r.URL.Path)
+	if g == nil {
+		l.Println("[ERROR] Invalid URI:", r.URL.Path)
+		http.Error(rw, "Invalid URI", http.StatusBadRequest)
+		return
+	}
+	from, err := strconv.ParseUint(g[1], 10, 32)
+	if err != nil {
+		http.Error(rw, "Invalid range", http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.ParseUint(g[2], 10, 32)
+	if err != nil {
+		http.Error(rw, "Invalid range", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && g[3] != "":
+		if err := json.NewEncoder(rw).Encode(h.counter.rangeSketches(uint32(from), uint32(to))); err != nil {
+			l.Println("[ERROR] Unable to marshall json:", err)
+			http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+			return
+		}
+
+	case r.Method == http.MethodGet:
+		q := r.URL.Query()
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		after := Item{ID: q.Get("id"), Tenant: q.Get("tenant")}
+
+		if err := json.NewEncoder(rw).Encode(h.counter.rangeItems(uint32(from), uint32(to), after, limit)); err != nil {
+			l.Println("[ERROR] Unable to marshall json:", err)
+			http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+			return
+		}
+
+	case r.Method == http.MethodDelete:
+		dropped := h.counter.dropRange(uint32(from), uint32(to))
+		l.Printf("[INFO] %s dropped %d items of range %d-%d", h.counter.Me, dropped, from, to)
+		json.NewEncoder(rw).Encode(map[string]int{"dropped": dropped})
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *RaftRPC) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	var resp interface{}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/raft/vote":
+		req := VoteRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, "Unable to unmarshal json", http.StatusBadRequest)
+			return
+		}
+		resp = h.raft.handleVote(&req)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/raft/append":
+		req := AppendRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, "Unable to unmarshal json", http.StatusBadRequest)
+			return
+		}
+		resp = h.raft.handleAppend(&req)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/raft/propose":
+		l.Println("[INFO] Handle", r.Method, r.URL)
+
+		m := Message{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			l.Println("[ERROR] Unable to unmarshal json:", err)
+			http.Error(rw, "Unable to unmarshal json", http.StatusBadRequest)
+			return
+		}
+
+		err := h.raft.Propose(&m, h.timeout)
+		if e, ok := err.(*NotLeaderError); ok {
+			rw.WriteHeader(http.StatusMisdirectedRequest)
+			json.NewEncoder(rw).Encode(e)
+			return
+		}
+		if err != nil {
+			l.Printf("[ERROR] %s cannot commit %s: %s", h.raft.me, m.ID, err.Error())
+			http.Error(rw, "Unable to commit message", http.StatusServiceUnavailable)
+			return
+		}
+		l.Printf("[INFO] %s committed: %+v", h.raft.me, m)
+		resp = &m
+
+	case r.Method == http.MethodGet && r.URL.Path == "/raft/readindex":
+		index, err := h.raft.ReadIndex()
+		if e, ok := err.(*NotLeaderError); ok {
+			rw.WriteHeader(http.StatusMisdirectedRequest)
+			json.NewEncoder(rw).Encode(e)
+			return
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		resp = &ReadIndex{Index: index}
+
+	case r.Method == http.MethodGet && r.URL.Path == "/raft/status":
+		resp = h.raft.Status()
+
+	case r.URL.Path == "/raft/vote" || r.URL.Path == "/raft/append" || r.URL.Path == "/raft/propose" ||
+		r.URL.Path == "/raft/readindex" || r.URL.Path == "/raft/status":
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+
+	default:
+		http.NotFound(rw, r)
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(resp); err != nil {
+		l.Println("[ERROR] Unable to marshall json:", err)
+		http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+	}
+}
+
+func (h *SketchServe) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(rw).Encode(h.counter.getSketches()); err != nil {
+			l.Println("[ERROR] Unable to marshall json:", err)
+			http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *TombstonesGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.Println("[INFO] Handle", r.Method, r.URL)
+		rw.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(rw).Encode(h.counter.getTombstones()); err != nil {
+			l.Println("[ERROR] Unable to marshall json:", err)
+			http.Error(rw, "Unable to marshall json", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
 }
@@ -1,6 +1,12 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
 
 type RoundTripFunc func(req *http.Request) *http.Response
 
@@ -15,3 +21,225 @@ func NewTestClient(fn RoundTripFunc) *http.Client {
 		Transport: fn,
 	}
 }
+
+func TestInit_ServeHTTP(t *testing.T) {
+	tt := []struct {
+		name       string
+		method     string
+		body       string
+		heap       uint64
+		want       string
+		statusCode int
+		prepared   int
+	}{
+		{
+			name:       "wrong HTTP method",
+			method:     http.MethodGet,
+			body:       ``,
+			want:       ``,
+			statusCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "invalid body",
+			method:     http.MethodPost,
+			body:       `[]`,
+			want:       `Unable to unmarshal json`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "accepted",
+			method:     http.MethodPost,
+			body:       `{"id":"message-2","content":[{"id":"item-2","tenant":"test"}]}`,
+			want:       ``,
+			statusCode: http.StatusOK,
+			prepared:   2,
+		},
+		{
+			name:       "duplicate message",
+			method:     http.MethodPost,
+			body:       `{"id":"message-1","content":[{"id":"item-2","tenant":"test"}]}`,
+			want:       `{"reason":"duplicate_message","message":"message message-1 is already prepared"}`,
+			statusCode: http.StatusConflict,
+		},
+		{
+			name:       "retried prepare",
+			method:     http.MethodPost,
+			body:       `{"id":"message-1","content":[{"id":"item-1","tenant":"test"}]}`,
+			want:       ``,
+			statusCode: http.StatusOK,
+			prepared:   1,
+		},
+		{
+			name:       "heap limit",
+			method:     http.MethodPost,
+			body:       `{"id":"message-2","content":[{"id":"item-2","tenant":"test"}]}`,
+			heap:       2048,
+			want:       `{"reason":"memory_limit","message":"heap size 2048 exceeds 1024 bytes"}`,
+			statusCode: http.StatusConflict,
+		},
+		{
+			name:       "locked item",
+			method:     http.MethodPost,
+			body:       `{"id":"message-2","content":[{"id":"item-1","tenant":"test"}]}`,
+			want:       `{"reason":"items_locked","message":"item item-1 of test is locked by message-1"}`,
+			statusCode: http.StatusConflict,
+		},
+		{
+			name:       "tenant limit",
+			method:     http.MethodPost,
+			body:       `{"id":"message-2","content":[{"id":"item-2","tenant":"test"},{"id":"item-3","tenant":"test"}]}`,
+			want:       `{"reason":"tenant_limit","message":"tenant test would have 3 items, limit is 2"}`,
+			statusCode: http.StatusConflict,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(tc.method, "/init", strings.NewReader(tc.body))
+			rr := httptest.NewRecorder()
+
+			heap := &HeapSampler{heapAlloc: tc.heap}
+			c := NewCounter("counter", nil, Policies{DuplicateMessage{}, LockedItems{}, MemoryLimit{MaxHeapBytes: 1024, Heap: heap}, TenantLimit{MaxItems: 2}})
+			c.store.Prepare(Message{ID: "message-1", Content: Items{{ID: "item-1", Tenant: "test"}}})
+			NewInit(c).ServeHTTP(rr, request)
+
+			if rr.Code != tc.statusCode {
+				t.Errorf("Want status '%d', got '%d'", tc.statusCode, rr.Code)
+			}
+
+			if strings.TrimSpace(rr.Body.String()) != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, rr.Body)
+			}
+			if n := len(c.getMessages()); tc.prepared > 0 && n != tc.prepared {
+				t.Errorf("Want %d prepared messages, got %d", tc.prepared, n)
+			}
+		})
+	}
+}
+
+func TestCoordinatorLease_ServeHTTP(t *testing.T) {
+	tt := []struct {
+		name       string
+		method     string
+		body       string
+		holder     string
+		statusCode int
+	}{
+		{
+			name:       "granted",
+			method:     http.MethodPost,
+			body:       `{"holder":"coordinator-1","duration":1000000000}`,
+			holder:     "coordinator-1",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "renewed",
+			method:     http.MethodPost,
+			body:       `{"holder":"coordinator-1","duration":1000000000}`,
+			holder:     "coordinator-1",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "held by another coordinator",
+			method:     http.MethodPost,
+			body:       `{"holder":"coordinator-2","duration":1000000000}`,
+			holder:     "coordinator-1",
+			statusCode: http.StatusConflict,
+		},
+		{
+			name:       "released",
+			method:     http.MethodDelete,
+			body:       `{"holder":"coordinator-1"}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "granted after release",
+			method:     http.MethodPost,
+			body:       `{"holder":"coordinator-2","duration":1000000000}`,
+			holder:     "coordinator-2",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "missing holder",
+			method:     http.MethodPost,
+			body:       `{}`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	h := NewCoordinatorLease(NewLeases(0))
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(tc.method, "/lease", strings.NewReader(tc.body))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, request)
+
+			if rr.Code != tc.statusCode {
+				t.Errorf("Want status '%d', got '%d'", tc.statusCode, rr.Code)
+			}
+
+			if tc.holder != "" && !strings.Contains(rr.Body.String(), `"holder":"`+tc.holder+`"`) {
+				t.Errorf("Want lease of '%s', got '%s'", tc.holder, rr.Body)
+			}
+		})
+	}
+
+	if _, ok := NewLeases(time.Minute).Grant("coordinator-1", time.Second, 0); ok {
+		t.Errorf("Want no lease granted during grace period, got one")
+	}
+}
+
+func TestFencing_ServeHTTP(t *testing.T) {
+	leases := NewLeases(0)
+	leases.Grant("coordinator-1", time.Minute, 0)
+	leases.Release("coordinator-1")
+	leases.Grant("coordinator-2", time.Minute, 0)
+
+	tt := []struct {
+		name       string
+		epoch      string
+		statusCode int
+	}{
+		{
+			name:       "current epoch",
+			epoch:      "2",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "later epoch",
+			epoch:      "3",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "deposed leader",
+			epoch:      "1",
+			statusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "missing epoch",
+			epoch:      "",
+			statusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "invalid epoch",
+			epoch:      "abc",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	h := NewFencing(leases, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/commit", strings.NewReader(`{}`))
+			if tc.epoch != "" {
+				request.Header.Set(EpochHeader, tc.epoch)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, request)
+
+			if rr.Code != tc.statusCode {
+				t.Errorf("Want status '%d', got '%d'", tc.statusCode, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+// hybrid logical clock timestamp the coordinator stamps messages with,
+// wall time in unix nanoseconds and a logical counter
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+}
+
+func (t Timestamp) Before(o Timestamp) bool {
+	return t.Wall < o.Wall || (t.Wall == o.Wall && t.Logical < o.Logical)
+}
+
+// health reported to the coordinator
+type Health struct {
+	Applied Timestamp `json:"applied"`
+	// every commit up to the sequence is applied
+	Seq uint64 `json:"seq,omitempty"`
+}
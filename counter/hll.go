@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+)
+
+// Sketch is a HyperLogLog estimating the number of distinct item ids.
+// Each id is hashed into one of 2^precision registers, which keeps
+// the longest run of leading zeros seen, so memory does not grow
+// with the ids and sketches of two counters merge by taking maxima.
+type Sketch struct {
+	Precision uint8  `json:"precision"`
+	Registers []byte `json:"registers"`
+}
+
+func NewSketch(precision uint8) *Sketch {
+	return &Sketch{Precision: precision, Registers: make([]byte, 1<<precision)}
+}
+
+func (s *Sketch) Add(id string) {
+	h := sha256.Sum256([]byte(id))
+	x := binary.BigEndian.Uint64(h[:8])
+
+	// first bits pick the register, the rest count leading zeros
+	r := x >> (64 - s.Precision)
+	rank := byte(bits.LeadingZeros64(x<<s.Precision|1<<(s.Precision-1)) + 1)
+	if rank > s.Registers[r] {
+		s.Registers[r] = rank
+	}
+}
+
+func (s *Sketch) Merge(o *Sketch) error {
+	if o.Precision != s.Precision || len(o.Registers) != len(s.Registers) {
+		return fmt.Errorf("precision %d differs from %d", o.Precision, s.Precision)
+	}
+	for i, r := range o.Registers {
+		if r > s.Registers[i] {
+			s.Registers[i] = r
+		}
+	}
+	return nil
+}
+
+func (s *Sketch) Estimate() int {
+	m := float64(len(s.Registers))
+	sum, zeros := 0.0, 0
+	for _, r := range s.Registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// linear counting is more accurate while many registers are empty
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(e))
+}
+
+// relative standard error of the estimate
+func (s *Sketch) StdError() float64 {
+	return 1.04 / math.Sqrt(float64(len(s.Registers)))
+}
+
+func (s *Sketch) copy() *Sketch {
+	c := &Sketch{Precision: s.Precision, Registers: make([]byte, len(s.Registers))}
+	copy(c.Registers, s.Registers)
+	return c
+}
+
+// Sketches keeps tenants in approximate mode, their items
+// are added to a sketch instead of the storage.
+// Nil *Sketches counts every tenant exactly.
+type Sketches struct {
+	precision uint8
+	tenants   map[string]bool
+	sketches  map[string]*Sketch
+}
+
+// precision is limited to 4-16, 16384 registers of the default 14
+// take 16 KB per tenant with a standard error of 0.8%
+func NewSketches(tenants []string, precision int) *Sketches {
+	if precision < 4 || precision > 16 {
+		precision = 14
+	}
+	s := &Sketches{precision: uint8(precision), tenants: map[string]bool{}, sketches: map[string]*Sketch{}}
+	for _, tenant := range tenants {
+		s.tenants[tenant] = true
+	}
+	return s
+}
+
+func (s *Sketches) Approximate(tenant string) bool {
+	return s != nil && s.tenants[tenant]
+}
+
+// adds items of approximate tenants to their sketches,
+// returns the rest
+func (s *Sketches) Add(items Items) Items {
+	if s == nil {
+		return items
+	}
+
+	exact := Items{}
+	for _, i := range items {
+		if !s.tenants[i.Tenant] {
+			exact = append(exact, i)
+			continue
+		}
+		sk, ok := s.sketches[i.Tenant]
+		if !ok {
+			sk = NewSketch(s.precision)
+			s.sketches[i.Tenant] = sk
+		}
+		sk.Add(i.ID)
+	}
+	return exact
+}
+
+// returns estimate of the tenant and its standard error
+func (s *Sketches) Count(tenant string) (int, int) {
+	sk, ok := s.sketches[tenant]
+	if !ok {
+		return 0, 0
+	}
+	e := sk.Estimate()
+	return e, int(math.Ceil(float64(e) * sk.StdError()))
+}
+
+// merges sketches of approximate tenants, others are ignored
+func (s *Sketches) Merge(sketches map[string]*Sketch) {
+	if s == nil {
+		return
+	}
+
+	for tenant, o := range sketches {
+		if !s.tenants[tenant] || o == nil {
+			continue
+		}
+		sk, ok := s.sketches[tenant]
+		if !ok {
+			sk = NewSketch(s.precision)
+			s.sketches[tenant] = sk
+		}
+		if err := sk.Merge(o); err != nil {
+			l.Printf("[ERROR] Unable to merge sketch of %s: %s", tenant, err.Error())
+		}
+	}
+}
+
+// replaces sketches, e.g. with a snapshot
+func (s *Sketches) Reset(sketches map[string]*Sketch) {
+	if s == nil {
+		return
+	}
+
+	s.sketches = map[string]*Sketch{}
+	s.Merge(sketches)
+}
+
+// returns tenants which have a sketch
+func (s *Sketches) Tenants() []string {
+	tenants := []string{}
+	if s == nil {
+		return tenants
+	}
+	for tenant := range s.sketches {
+		tenants = append(tenants, tenant)
+	}
+	return tenants
+}
+
+// forgets sketch of the tenant
+func (s *Sketches) Drop(tenant string) {
+	if s == nil {
+		return
+	}
+	delete(s.sketches, tenant)
+}
+
+func (s *Sketches) Copy() map[string]*Sketch {
+	sketches := map[string]*Sketch{}
+	if s == nil {
+		return sketches
+	}
+	for tenant, sk := range s.sketches {
+		sketches[tenant] = sk.copy()
+	}
+	return sketches
+}
+
+// returns sketches of approximate tenants
+func (c *Counter) getSketches() map[string]*Sketch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sketches.Copy()
+}
+
+// returns sketches of approximate tenants in the range
+func (c *Counter) rangeSketches(from uint32, to uint32) map[string]*Sketch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sketches := c.sketches.Copy()
+	for tenant := range sketches {
+		if !inRange(tenantHash(tenant), from, to) {
+			delete(sketches, tenant)
+		}
+	}
+	return sketches
+}
+
+// merges sketches of a range moved to the counter
+func (c *Counter) mergeSketches(sketches map[string]*Sketch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sketches.Merge(sketches)
+	c.journalLocked(&JournalEntry{Sketches: sketches})
+}
+
+// merges sketches of peers, their items may be missing
+// from the commit log and the items the coordinator sends
+func (c *Counter) mergePeerSketches() {
+	if c.sketches == nil {
+		return
+	}
+
+	peers, err := c.peers()
+	if err != nil {
+		l.Printf("[ERROR] Unable to get peers to merge sketches: %s", err.Error())
+		return
+	}
+
+	for _, peer := range peers {
+		sketches, err := c.peerSketches(peer)
+		if err != nil {
+			l.Printf("[ERROR] Unable to get sketches from %s: %s", peer, err.Error())
+			continue
+		}
+
+		c.mu.Lock()
+		c.sketches.Merge(sketches)
+		c.mu.Unlock()
+		l.Printf("[INFO] %s merged %d sketches from %s", c.Me, len(sketches), peer)
+	}
+}
+
+func (c *Counter) peerSketches(peer string) (map[string]*Sketch, error) {
+	resp, err := c.Do(http.MethodGet, fmt.Sprintf("http://%s/sketches", peer), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d for sketches", resp.StatusCode)
+	}
+
+	sketches := map[string]*Sketch{}
+	if err := json.NewDecoder(resp.Body).Decode(&sketches); err != nil {
+		return nil, err
+	}
+	return sketches, nil
+}
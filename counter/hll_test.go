@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSketch_Estimate(t *testing.T) {
+	tt := []struct {
+		name string
+		ids  int
+	}{
+		{name: "empty", ids: 0},
+		{name: "small", ids: 100},
+		{name: "large", ids: 100000},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewSketch(14)
+			for i := 0; i < tc.ids; i++ {
+				s.Add(fmt.Sprintf("item-%d", i))
+				// duplicates do not change the estimate
+				s.Add(fmt.Sprintf("item-%d", i))
+			}
+
+			bound := 3 * s.StdError() * float64(tc.ids)
+			if e := s.Estimate(); math.Abs(float64(e-tc.ids)) > math.Max(bound, 2) {
+				t.Errorf("Want %d ± %.0f, got %d", tc.ids, bound, e)
+			}
+		})
+	}
+}
+
+func TestCounter_SignInMergesSketches(t *testing.T) {
+	peer := NewSketches([]string{"big"}, 12)
+	for i := 0; i < 5000; i++ {
+		peer.Add(Items{{ID: fmt.Sprintf("item-%d", i), Tenant: "big"}})
+	}
+	sketches, _ := json.Marshal(peer.Copy())
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		body := `{"seq":1,"snapshot":false,"messages":[{"id":"message-1","seq":1,"content":[{"id":"item-4999","tenant":"big"},{"id":"item-5000","tenant":"big"},{"id":"item-1","tenant":"exact"}]}]}`
+		switch {
+		case req.URL.Path == "/counters" && req.Method == http.MethodGet:
+			body = `[{"addr":"counter"},{"addr":"peer"}]`
+		case req.URL.Path == "/sketches":
+			body = string(sketches)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+			Header:     make(http.Header),
+		}
+	})
+
+	c := NewCounter("counter", nil, nil)
+	c.http = client
+	c.sketches = NewSketches([]string{"big"}, 12)
+
+	if err := c.SignIn(); err != nil {
+		t.Fatalf("SignIn error: %s", err.Error())
+	}
+
+	count := c.countItemsForTenant("big")
+	if !count.Approximate || count.Error == 0 {
+		t.Errorf("Want approximate count with error, got %+v", count)
+	}
+	if math.Abs(float64(count.Value-5001)) > 3*float64(count.Error) {
+		t.Errorf("Want 5001 ± %d, got %d", 3*count.Error, count.Value)
+	}
+	if items := c.getItems(); len(items) != 1 || strings.Contains(fmt.Sprint(items), "big") {
+		t.Errorf("Want only items of exact tenants stored, got %+v", items)
+	}
+	if count := c.countItemsForTenant("exact"); count.Approximate || count.Value != 1 {
+		t.Errorf("Want exact count 1, got %+v", count)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import "sort"
+
+// Index keeps distinct item ids of every tenant, it is updated
+// on commit, so a count is the size of one set and duplicates
+// sent again by the coordinator or a peer are not stored twice.
+type Index map[string]map[string]bool
+
+func NewIndex(items Items) Index {
+	x := Index{}
+	for _, i := range items {
+		x.Add(i)
+	}
+	return x
+}
+
+// adds the item, returns whether it was not indexed yet
+func (x Index) Add(i Item) bool {
+	ids, ok := x[i.Tenant]
+	if !ok {
+		ids = map[string]bool{}
+		x[i.Tenant] = ids
+	}
+	if ids[i.ID] {
+		return false
+	}
+	ids[i.ID] = true
+	return true
+}
+
+// removes the item, returns whether it was indexed
+func (x Index) Remove(i Item) bool {
+	ids, ok := x[i.Tenant]
+	if !ok || !ids[i.ID] {
+		return false
+	}
+	delete(ids, i.ID)
+	if len(ids) == 0 {
+		delete(x, i.Tenant)
+	}
+	return true
+}
+
+func (x Index) Has(i Item) bool {
+	return x[i.Tenant][i.ID]
+}
+
+func (x Index) Count(tenant string) int {
+	return len(x[tenant])
+}
+
+// number of items of all tenants
+func (x Index) Len() int {
+	n := 0
+	for _, ids := range x {
+		n += len(ids)
+	}
+	return n
+}
+
+// returns items ordered by tenant and id
+func (x Index) Items() Items {
+	items := make(Items, 0, x.Len())
+	for tenant, ids := range x {
+		for id := range ids {
+			items = append(items, Item{ID: id, Tenant: tenant})
+		}
+	}
+	sort.Slice(items, func(a, b int) bool {
+		return itemLess(items[a], items[b])
+	})
+	return items
+}
+
+// forgets items of the tenant, returns the number of dropped ones
+func (x Index) Drop(tenant string) int {
+	n := len(x[tenant])
+	delete(x, tenant)
+	return n
+}
+
+func (x Index) Tenants() []string {
+	tenants := make([]string, 0, len(x))
+	for tenant := range x {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// calls f with every item of the tenant
+func (x Index) Range(tenant string, f func(i Item)) {
+	for id := range x[tenant] {
+		f(Item{ID: id, Tenant: tenant})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	x := NewIndex(Items{{ID: "item-2", Tenant: "test"}, {ID: "item-1", Tenant: "test"}})
+
+	tt := []struct {
+		name  string
+		item  Item
+		added bool
+		count int
+	}{
+		{name: "duplicate", item: Item{ID: "item-1", Tenant: "test"}, added: false, count: 2},
+		{name: "new item", item: Item{ID: "item-3", Tenant: "test"}, added: true, count: 3},
+		{name: "same id of another tenant", item: Item{ID: "item-1", Tenant: "other"}, added: true, count: 1},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if added := x.Add(tc.item); added != tc.added {
+				t.Errorf("Want added %t, got %t", tc.added, added)
+			}
+			if count := x.Count(tc.item.Tenant); count != tc.count {
+				t.Errorf("Want count %d, got %d", tc.count, count)
+			}
+		})
+	}
+
+	want := Items{{ID: "item-1", Tenant: "other"}, {ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}, {ID: "item-3", Tenant: "test"}}
+	if items := x.Items(); !reflect.DeepEqual(want, items) {
+		t.Errorf("Want %+v, got %+v", want, items)
+	}
+	if x.Len() != 4 {
+		t.Errorf("Want 4 items, got %d", x.Len())
+	}
+}
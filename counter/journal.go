@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// state of the counter written to the data directory,
+// items and tombstones follow it in parts of limited size
+type LocalSnapshot struct {
+	Seq        uint64             `json:"seq"`
+	Ahead      []uint64           `json:"ahead,omitempty"`
+	Applied    uint64             `json:"applied"`
+	Versions   map[string]uint64  `json:"versions"`
+	Timestamp  Timestamp          `json:"timestamp"`
+	Items      Items              `json:"items"`
+	Sketches   map[string]*Sketch `json:"sketches,omitempty"`
+	Tombstones []Tombstone        `json:"tombstones,omitempty"`
+	// items are kept by the storage engine and left out
+	Stored bool `json:"stored,omitempty"`
+}
+
+// change applied since the last snapshot, a committed message,
+// items repaired from a peer or deleted with a moved range,
+// tombstones of a peer, sketches of a moved range
+// or a range the counter no longer owns
+type JournalEntry struct {
+	Message    *Message           `json:"message,omitempty"`
+	Op         string             `json:"op,omitempty"`
+	Tenant     string             `json:"tenant,omitempty"`
+	Items      Items              `json:"items,omitempty"`
+	Version    uint64             `json:"version,omitempty"`
+	Seq        uint64             `json:"seq,omitempty"`
+	Tombstones []Tombstone        `json:"tombstones,omitempty"`
+	From       uint32             `json:"from,omitempty"`
+	To         uint32             `json:"to,omitempty"`
+	Sketches   map[string]*Sketch `json:"sketches,omitempty"`
+}
+
+// operation of the journal entry which drops a range
+const opDropRange = "drop"
+
+// items or tombstones of a snapshot in one line or chunk
+type SnapshotPart struct {
+	Items      Items       `json:"items,omitempty"`
+	Tombstones []Tombstone `json:"tombstones,omitempty"`
+}
+
+// number of items or tombstones in one part of a local snapshot
+const localSnapshotPart = 1000
+
+// Journal keeps state of the counter across restarts of the whole cluster.
+// Snapshot is written periodically like prepared messages, every change
+// applied since then is appended to the log as a json line and synced.
+// When the state is copied for the next snapshot the log is closed
+// and a new one started, the closed log is removed once the snapshot
+// is written, so the counter is not locked while it is written.
+// Nil *Journal stores nothing.
+type Journal struct {
+	dir          string
+	snapshotPath string
+	logPath      string
+	log          *os.File
+	// generation of the current log, closed logs keep theirs in the name
+	generation uint64
+
+	// snapshots are written one at a time, an older one is skipped
+	mu      sync.Mutex
+	written uint64
+}
+
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		dir:          dir,
+		snapshotPath: filepath.Join(dir, "snapshot.json"),
+		logPath:      filepath.Join(dir, "applied.log"),
+	}
+
+	closed, err := j.closedLogs()
+	if err != nil {
+		return nil, err
+	}
+	if len(closed) > 0 {
+		j.generation = closed[len(closed)-1] + 1
+	}
+
+	f, err := os.OpenFile(j.logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.log = f
+
+	return j, nil
+}
+
+// returns generations of logs closed for a snapshot which was not written yet
+func (j *Journal) closedLogs() ([]uint64, error) {
+	paths, err := filepath.Glob(j.logPath + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	generations := []uint64{}
+	for _, path := range paths {
+		g, err := strconv.ParseUint(strings.TrimPrefix(path, j.logPath+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		generations = append(generations, g)
+	}
+	sort.Slice(generations, func(a, b int) bool {
+		return generations[a] < generations[b]
+	})
+	return generations, nil
+}
+
+func (j *Journal) closedLog(generation uint64) string {
+	return fmt.Sprintf("%s.%d", j.logPath, generation)
+}
+
+// returns snapshot and changes saved by the previous run,
+// nil snapshot when there was none
+func (j *Journal) Load() (*LocalSnapshot, []JournalEntry, error) {
+	if j == nil {
+		return nil, nil, nil
+	}
+
+	snap, err := j.loadSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// closed logs go first, changes of the ones already in the snapshot are applied again
+	closed, err := j.closedLogs()
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := []string{}
+	for _, g := range closed {
+		paths = append(paths, j.closedLog(g))
+	}
+
+	entries := []JournalEntry{}
+	for _, path := range append(paths, j.logPath) {
+		if entries, err = loadLog(path, entries); err != nil {
+			return nil, nil, err
+		}
+	}
+	return snap, entries, nil
+}
+
+// appends entries of the log to given ones
+func loadLog(path string, entries []JournalEntry) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		e := JournalEntry{}
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// the last line may be torn by a crash in the middle of a write
+			l.Printf("[ERROR] Skipping corrupted journal entry: %s", err.Error())
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// snapshot written in one piece has no parts
+func (j *Journal) loadSnapshot() (*LocalSnapshot, error) {
+	f, err := os.Open(j.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snap := &LocalSnapshot{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for i := 0; sc.Scan(); i++ {
+		if i == 0 {
+			if err := json.Unmarshal(sc.Bytes(), snap); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		part := SnapshotPart{}
+		if err := json.Unmarshal(sc.Bytes(), &part); err != nil {
+			return nil, err
+		}
+		snap.Items = append(snap.Items, part.Items...)
+		snap.Tombstones = append(snap.Tombstones, part.Tombstones...)
+	}
+	return snap, sc.Err()
+}
+
+func (j *Journal) Append(e *JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.log.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.log.Sync()
+}
+
+// closes the log for a snapshot of the state copied now and starts a new one,
+// returns generation of the closed log
+// must be called with the lock of the counter held, like Append
+func (j *Journal) Rotate() (uint64, error) {
+	generation := j.generation
+	err := j.log.Close()
+	if err == nil {
+		err = os.Rename(j.logPath, j.closedLog(generation))
+	}
+	if err == nil {
+		j.generation++
+	}
+
+	// the log is reopened even if it could not be closed for the snapshot
+	f, openErr := os.OpenFile(j.logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if openErr != nil {
+		return 0, openErr
+	}
+	j.log = f
+	return generation, err
+}
+
+// writes the snapshot and removes logs closed for it,
+// a crash in between replays changes already in the snapshot,
+// which is harmless as applying them again is idempotent
+func (j *Journal) Snapshot(generation uint64, snap *LocalSnapshot) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// a later snapshot was written in the meantime
+	if generation < j.written {
+		return nil
+	}
+
+	if err := j.writeSnapshot(snap); err != nil {
+		return err
+	}
+	j.written = generation + 1
+
+	closed, err := j.closedLogs()
+	if err != nil {
+		return err
+	}
+	for _, g := range closed {
+		if g > generation {
+			break
+		}
+		if err := os.Remove(j.closedLog(g)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes state of the snapshot as the first line and its items
+// and tombstones as the following ones, so no line holds all of them
+func (j *Journal) writeSnapshot(snap *LocalSnapshot) error {
+	tmp := j.snapshotPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	state := *snap
+	state.Items, state.Tombstones = nil, nil
+	err = enc.Encode(&state)
+	for i := 0; err == nil && i < len(snap.Items); i += localSnapshotPart {
+		err = enc.Encode(&SnapshotPart{Items: snap.Items[i:min(i+localSnapshotPart, len(snap.Items))]})
+	}
+	for i := 0; err == nil && i < len(snap.Tombstones); i += localSnapshotPart {
+		err = enc.Encode(&SnapshotPart{Tombstones: snap.Tombstones[i:min(i+localSnapshotPart, len(snap.Tombstones))]})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, j.snapshotPath)
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.log.Close()
+}
+
+// restores state saved by the previous run, so the counter
+// only asks the coordinator for commits made since then
+// returns whether there was any state to restore
+func (c *Counter) restoreLocal(j *Journal) (bool, error) {
+	restored, err := c.replayLocal(j)
+	if restored {
+		// the log is compacted right away, later changes are journaled
+		c.snapshot()
+	}
+	return restored, err
+}
+
+func (c *Counter) replayLocal(j *Journal) (bool, error) {
+	snap, entries, err := j.Load()
+	if err != nil {
+		return false, err
+	}
+
+	if snap != nil && snap.Stored && !c.store.Durable() {
+		l.Printf("[ERROR] Local snapshot of %s without items of the storage engine, signing in from scratch", c.Me)
+		snap, entries = nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if snap != nil {
+		// storage engine which keeps its items is not rewritten
+		if !snap.Stored {
+			if err := c.store.Reset(snap.Items); err != nil {
+				return false, err
+			}
+		}
+		c.seq = snap.Seq
+		c.ahead = map[uint64]bool{}
+		for _, seq := range snap.Ahead {
+			c.ahead[seq] = true
+		}
+		c.applied = snap.Applied
+		c.versions = snap.Versions
+		if c.versions == nil {
+			c.versions = map[string]uint64{}
+		}
+		c.timestamp = snap.Timestamp
+		c.sketches.Reset(snap.Sketches)
+		c.setTombstones(snap.Tombstones)
+	}
+
+	for _, e := range entries {
+		switch {
+		case e.Message != nil:
+			if c.isApplied(e.Message.Seq) {
+				continue
+			}
+			if err := c.applyLocked(e.Message); err != nil {
+				return false, err
+			}
+			c.markApplied(e.Message.Seq)
+		case e.Op == OpDelete:
+			if _, err := c.deleteLocked(&Message{ID: "journal", Version: e.Version, Seq: e.Seq}, e.Items); err != nil {
+				return false, err
+			}
+		case len(e.Tombstones) > 0:
+			if _, err := c.mergeTombstonesLocked(e.Tombstones); err != nil {
+				return false, err
+			}
+		case e.Op == opDropRange:
+			c.dropRangeLocked(e.From, e.To)
+		case len(e.Sketches) > 0:
+			c.sketches.Merge(e.Sketches)
+		default:
+			if _, err := c.repairLocked(e.Tenant, e.Items, e.Version, e.Seq); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	c.journal = j
+	if snap != nil || len(entries) > 0 {
+		l.Printf("[INFO] %s restored local snapshot and %d changes at sequence %d", c.Me, len(entries), c.seq)
+		return true, nil
+	}
+	return false, nil
+}
+
+// writes snapshots every interval
+func (c *Counter) RunSnapshots(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.snapshot()
+	}
+}
+
+// copies the state with the lock held and writes it without the lock,
+// snapshot is only an optimisation of restart, so errors are just logged
+func (c *Counter) snapshot() {
+	c.mu.Lock()
+	if c.journal == nil {
+		c.mu.Unlock()
+		return
+	}
+
+	snap := &LocalSnapshot{
+		Seq:        c.seq,
+		Applied:    c.applied,
+		Versions:   map[string]uint64{},
+		Timestamp:  c.timestamp,
+		Sketches:   c.sketches.Copy(),
+		Tombstones: c.tombstoneList(),
+		Stored:     c.store.Durable(),
+	}
+	for tenant, v := range c.versions {
+		snap.Versions[tenant] = v
+	}
+	for seq := range c.ahead {
+		snap.Ahead = append(snap.Ahead, seq)
+	}
+	if !snap.Stored {
+		snap.Items = c.store.Items()
+	}
+	generation, err := c.journal.Rotate()
+	c.mu.Unlock()
+
+	if err != nil {
+		l.Printf("[ERROR] Unable to close journal for local snapshot: %s", err.Error())
+		return
+	}
+	if err := c.journal.Snapshot(generation, snap); err != nil {
+		l.Printf("[ERROR] Unable to write local snapshot: %s", err.Error())
+	}
+}
+
+// must be called with the lock held
+func (c *Counter) journalLocked(e *JournalEntry) {
+	if err := c.journal.Append(e); err != nil {
+		l.Printf("[ERROR] Unable to journal applied change: %s", err.Error())
+	}
+}
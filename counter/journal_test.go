@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCounter_restoreLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCounter("counter", nil, nil)
+	if restored, err := c.restoreLocal(j); err != nil || restored {
+		t.Fatalf("Want nothing to restore, got %t, %v", restored, err)
+	}
+
+	c.store.Prepare(Message{ID: "message-1"})
+	c.store.Prepare(Message{ID: "message-2"})
+	c.commit(&Message{ID: "message-1", Seq: 1, Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}}})
+	c.snapshot()
+	// journaled after the snapshot
+	c.commit(&Message{ID: "message-2", Seq: 2, Version: 2, Content: Items{{ID: "item-2", Tenant: "test"}}})
+	c.repair("other", Items{{ID: "item-3", Tenant: "other"}}, 5, 0)
+	j.Close()
+
+	var signIn string
+	restarted := NewCounter("counter", nil, nil)
+	restarted.http = NewTestClient(func(req *http.Request) *http.Response {
+		b, _ := ioutil.ReadAll(req.Body)
+		signIn = string(b)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"seq":3,"snapshot":false,"messages":[{"id":"message-3","seq":3,"content":[{"id":"item-4","tenant":"test"}]}]}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	j, err = OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if restored, err := restarted.restoreLocal(j); err != nil || !restored {
+		t.Fatalf("Want restored state, got %t, %v", restored, err)
+	}
+
+	want := Items{{ID: "item-3", Tenant: "other"}, {ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}}
+	if items := restarted.getItems(); !reflect.DeepEqual(want, items) {
+		t.Errorf("Want %+v, got %+v", want, items)
+	}
+	if count := restarted.countItemsForTenant("other"); count.Version != 5 {
+		t.Errorf("Want version 5 of repaired tenant, got %d", count.Version)
+	}
+
+	if err := restarted.SignIn(); err != nil {
+		t.Fatalf("SignIn error: %s", err.Error())
+	}
+	if want := `{"addr":"counter","pullSnapshot":true,"seq":2}`; signIn != want {
+		t.Errorf("Want sign in '%s', got '%s'", want, signIn)
+	}
+	if restarted.seq != 3 {
+		t.Errorf("Want sequence 3, got %d", restarted.seq)
+	}
+}
+
+type resetCounting struct {
+	Storage
+	resets int
+}
+
+func (s *resetCounting) Reset(items Items) error {
+	s.resets++
+	return s.Storage.Reset(items)
+}
+
+func TestCounter_restoreLocalDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDiskStorage(filepath.Join(dir, "items"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCounter("counter", store, nil)
+	if _, err := c.restoreLocal(j); err != nil {
+		t.Fatal(err)
+	}
+	c.store.Prepare(Message{ID: "message-1"})
+	c.commit(&Message{ID: "message-1", Seq: 1, Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "other"}}})
+	c.snapshot()
+	c.dropRange(tenantHash("other")-1, tenantHash("other"))
+	j.Close()
+	store.Close()
+
+	snap, entries, err := j.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Stored || len(snap.Items) != 0 || snap.Seq != 1 {
+		t.Errorf("Want snapshot at sequence 1 without items kept by the engine, got %+v", snap)
+	}
+	if len(entries) != 1 || entries[0].Op != opDropRange {
+		t.Errorf("Want dropped range journaled, got %+v", entries)
+	}
+
+	reopened, err := OpenDiskStorage(filepath.Join(dir, "items"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if j, err = OpenJournal(filepath.Join(dir, "local")); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	counting := &resetCounting{Storage: reopened}
+	restarted := NewCounter("counter", counting, nil)
+	if restored, err := restarted.restoreLocal(j); err != nil || !restored {
+		t.Fatalf("Want restored state, got %t, %v", restored, err)
+	}
+	if counting.resets != 0 {
+		t.Errorf("Want storage engine not rewritten, got %d resets", counting.resets)
+	}
+	if want := (Items{{ID: "item-1", Tenant: "test"}}); !reflect.DeepEqual(want, restarted.getItems()) {
+		t.Errorf("Want %+v, got %+v", want, restarted.getItems())
+	}
+	if restarted.seq != 1 {
+		t.Errorf("Want sequence 1, got %d", restarted.seq)
+	}
+}
+
+func TestJournal_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Append(&JournalEntry{Tenant: "test", Version: 1})
+	first, err := j.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Append(&JournalEntry{Tenant: "test", Version: 2})
+	second, err := j.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Append(&JournalEntry{Tenant: "test", Version: 3})
+
+	// snapshot of the second rotation is written first
+	if err := j.Snapshot(second, &LocalSnapshot{Seq: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Snapshot(first, &LocalSnapshot{Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	if j, err = OpenJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	snap, entries, err := j.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Seq != 2 {
+		t.Errorf("Want the later snapshot kept, got sequence %d", snap.Seq)
+	}
+	if len(entries) != 1 || entries[0].Version != 3 {
+		t.Errorf("Want changes made after the snapshot only, got %+v", entries)
+	}
+}
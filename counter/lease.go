@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// coordinator leadership lease granted by this counter,
+// epoch changes whenever the lease passes to another holder
+type Lease struct {
+	Holder  string    `json:"holder"`
+	Epoch   uint64    `json:"epoch"`
+	Expires time.Time `json:"expires"`
+}
+
+// epoch the holder asks for, a lower one is never granted
+type LeaseRequest struct {
+	Holder   string        `json:"holder"`
+	Duration time.Duration `json:"duration"`
+	Epoch    uint64        `json:"epoch,omitempty"`
+}
+
+// header of coordinator requests with the epoch of its lease
+const EpochHeader = "X-Coordinator-Epoch"
+
+// Leases keeps the coordinator lease granted by this counter.
+// Coordinator holding the lease on the majority of counters is the leader.
+// Lease is kept in memory only, so after a restart the counter
+// grants nothing until the grace period passes and any lease
+// granted by its previous run has expired.
+type Leases struct {
+	mu    sync.Mutex
+	lease Lease
+	grace time.Time
+}
+
+func NewLeases(grace time.Duration) *Leases {
+	return &Leases{grace: time.Now().Add(grace)}
+}
+
+// grants or renews the lease, returns the current lease
+// and whether it belongs to the requesting holder
+func (s *Leases) Grant(holder string, d time.Duration, epoch uint64) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(s.grace) {
+		return s.lease, false
+	}
+
+	if s.lease.Holder != holder && s.lease.Holder != "" && now.Before(s.lease.Expires) {
+		return s.lease, false
+	}
+
+	if s.lease.Holder != holder {
+		s.lease.Epoch++
+	}
+	if epoch > s.lease.Epoch {
+		s.lease.Epoch = epoch
+	}
+	s.lease.Holder = holder
+	s.lease.Expires = now.Add(d)
+	return s.lease, true
+}
+
+// whether a coordinator request with given epoch may be served,
+// requests of a leader deposed by a later lease are refused,
+// requests without epoch come from a coordinator without election
+// nil *Leases accepts every request
+func (s *Leases) Current(epoch uint64) bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return epoch >= s.lease.Epoch
+}
+
+// gives the lease up before it expires, only its holder can do it
+func (s *Leases) Release(holder string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lease.Holder == holder {
+		s.lease.Holder = ""
+		s.lease.Expires = time.Time{}
+	}
+}
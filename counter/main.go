@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -17,18 +19,104 @@ func main() {
 		l.Fatal("[ERROR] Cannot obtain hostname:", err.Error())
 	}
 
-	c := NewCounter(me)
+	store, err := OpenStorage(env("STORAGE_ENGINE", StorageMemory), env("DATA_DIR", "data"))
+	if err != nil {
+		l.Fatal("[ERROR] Cannot open storage:", err.Error())
+	}
+	defer store.Close()
+
+	heap := NewHeapSampler()
+	policy := Policies{
+		DuplicateMessage{},
+		LockedItems{},
+		MemoryLimit{
+			MaxPrepared:  envInt("MAX_PREPARED", 10000),
+			MaxHeapBytes: uint64(envInt("MAX_HEAP_BYTES", 0)),
+			Heap:         heap,
+		},
+		TenantLimit{MaxItems: envInt("MAX_ITEMS_PER_TENANT", 0)},
+		ApproximateDelete{},
+	}
+
+	c := NewCounter(me, store, policy)
+	if tenants := env("APPROXIMATE_TENANTS", ""); tenants != "" {
+		c.sketches = NewSketches(strings.Split(tenants, ","), envInt("HLL_PRECISION", 14))
+	}
+
+	// chunks pulled so far survive restart, so the transfer resumes
+	c.transfer = NewSnapshotTransfer(c, filepath.Join(env("DATA_DIR", "data"), "snapshot"), envInt("SNAPSHOT_RETRIES", 3), 100*time.Millisecond)
+
+	replication := env("REPLICATION_MODE", ReplicationCommit)
+	if replication == ReplicationRaft {
+		storage, err := OpenRaftStorage(filepath.Join(env("DATA_DIR", "data"), "raft"))
+		if err != nil {
+			l.Fatal("[ERROR] Cannot open raft storage:", err.Error())
+		}
+		defer storage.Close()
+
+		c.raft, err = NewRaft(c, storage, envDuration("RAFT_HEARTBEAT", 100*time.Millisecond), envDuration("RAFT_ELECTION_TIMEOUT", 1*time.Second))
+		if err != nil {
+			l.Fatal("[ERROR] Cannot restore raft state:", err.Error())
+		}
+	}
+
+	// raft log already restores items of its members
+	restored := false
+	if c.raft == nil {
+		journal, err := OpenJournal(filepath.Join(env("DATA_DIR", "data"), "local"))
+		if err != nil {
+			l.Fatal("[ERROR] Cannot open journal:", err.Error())
+		}
+		defer journal.Close()
+
+		if restored, err = c.restoreLocal(journal); err != nil {
+			l.Fatal("[ERROR] Cannot restore local snapshot:", err.Error())
+		}
+		go c.RunSnapshots(envDuration("LOCAL_SNAPSHOT_INTERVAL", 1*time.Minute))
+	}
+
+	// counter with local state starts without the coordinator
+	// and catches up once it is reachable
 	if err = c.SignIn(); err != nil {
-		log.Fatal("[ERROR] Cannot add counter:" + err.Error())
+		if !restored {
+			log.Fatal("[ERROR] Cannot add counter:" + err.Error())
+		}
+		l.Printf("[ERROR] Cannot add counter, serving local state: %s", err.Error())
+		go c.RetrySignIn(envDuration("SIGNIN_RETRY", 5*time.Second))
 	}
 
+	prepareTimeout := envDuration("PREPARE_TIMEOUT", 1*time.Minute)
+	precommitTimeout := envDuration("PRECOMMIT_TIMEOUT", 10*time.Second)
+	sweeper := NewSweeper(c, prepareTimeout, precommitTimeout, envInt("EXPIRED_HISTORY", 100))
+	antiEntropy := NewAntiEntropy(c, envInt("REPLICATION_FACTOR", 0) > 0)
+
+	// writes of a deposed coordinator leader are refused
+	leases := NewLeases(envDuration("LEASE_GRACE", 10*time.Second))
+
 	sm := http.NewServeMux()
 	sm.Handle("/items/", NewCountItems(c))
 	sm.Handle("/items", NewItemsGet(c))
-	sm.Handle("/init", NewInit(c))
-	sm.Handle("/abort", NewAbort(c))
-	sm.Handle("/commit", NewCommit(c))
+	sm.Handle("/init", NewFencing(leases, NewInit(c)))
+	sm.Handle("/abort", NewFencing(leases, NewAbort(c)))
+	sm.Handle("/precommit", NewFencing(leases, NewPreCommit(c)))
+	sm.Handle("/commit", NewFencing(leases, NewCommit(c)))
+	sm.Handle("/expired", NewExpired(sweeper))
+	sm.Handle("/expired/", NewExpired(sweeper))
 	sm.Handle("/health", NewHealthCheck(c))
+	sm.Handle("/merkle", NewMerkle(c))
+	sm.Handle("/merkle/", NewMerkle(c))
+	sm.Handle("/antientropy", NewAntiEntropyMetrics(antiEntropy))
+	snapshots := NewSnapshotServe(NewSnapshots(c, envInt("SNAPSHOT_CHUNK_ITEMS", 1000), envDuration("SNAPSHOT_TTL", 5*time.Minute)))
+	sm.Handle("/snapshot", snapshots)
+	sm.Handle("/snapshot/", snapshots)
+	sm.Handle("/sketches", NewSketchServe(c))
+	sm.Handle("/tombstones", NewTombstonesGet(c))
+	sm.Handle("/range", NewFencing(leases, NewRanges(c)))
+	sm.Handle("/range/", NewFencing(leases, NewRanges(c)))
+	sm.Handle("/lease", NewCoordinatorLease(leases))
+	if c.raft != nil {
+		sm.Handle("/raft/", NewRaftRPC(c.raft, envDuration("RAFT_PROPOSE_TIMEOUT", 1*time.Second)))
+	}
 
 	s := &http.Server{
 		Addr:         ":80",
@@ -45,13 +133,32 @@ func main() {
 		}
 	}()
 
-	sigChan := make(chan os.Signal)
+	resolver := NewResolver(c, envDuration("RESOLVE_AFTER", 5*time.Second), prepareTimeout)
+	go resolver.Run(envDuration("RESOLVE_INTERVAL", 5*time.Second))
+	go sweeper.Run(envDuration("SWEEP_INTERVAL", 10*time.Second))
+	if envInt("MAX_HEAP_BYTES", 0) > 0 {
+		go heap.Run(envDuration("HEAP_SAMPLE_INTERVAL", 1*time.Second))
+	}
+	if c.raft != nil {
+		go c.raft.Run()
+	}
+
+	// raft log already keeps members identical
+	if interval := envDuration("ANTI_ENTROPY_INTERVAL", 30*time.Second); interval > 0 && c.raft == nil {
+		go antiEntropy.Run(interval)
+	}
+	if interval := envDuration("TOMBSTONE_GC_INTERVAL", 1*time.Minute); interval > 0 && c.raft == nil {
+		go c.RunTombstoneGC(interval)
+	}
+
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
 	signal.Notify(sigChan, os.Kill)
 
 	sig := <-sigChan
 	l.Println("Received terminate, graceful shutdown", sig)
 
-	tc, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	tc, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	s.Shutdown(tc)
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Durable copy of prepared messages. Whole set is written
+// to a temporary file, synced and renamed over the previous one,
+// so a crash leaves either the old or the new set on disk.
+// Nil *PreparedStore is valid and stores nothing.
+type PreparedStore struct {
+	path string
+}
+
+func NewPreparedStore(path string) (*PreparedStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &PreparedStore{path: path}, nil
+}
+
+// returns messages saved by the previous run
+func (s *PreparedStore) Load() (Messages, error) {
+	messages := Messages{}
+	if s == nil {
+		return messages, nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return messages, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *PreparedStore) Save(messages Messages) error {
+	if s == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(s.path, b)
+}
+
+// PreparedSet keeps prepared messages in the order they were prepared
+// and the items they lock. The whole set is saved before it changes,
+// except when a message is forgotten, as a stale entry is resolved again.
+type PreparedSet struct {
+	store    *PreparedStore
+	messages Messages
+	locks    map[Item]string
+}
+
+func NewPreparedSet(store *PreparedStore) *PreparedSet {
+	return &PreparedSet{store: store, messages: Messages{}, locks: map[Item]string{}}
+}
+
+// restores messages saved by the previous run
+func (p *PreparedSet) LoadPrepared() error {
+	messages, err := p.store.Load()
+	if err != nil {
+		return err
+	}
+	p.set(messages)
+	return nil
+}
+
+func (p *PreparedSet) Prepare(m Message) error {
+	messages := make(Messages, 0, len(p.messages)+1)
+	replaced := false
+	for _, mess := range p.messages {
+		if mess.ID == m.ID {
+			mess, replaced = m, true
+		}
+		messages = append(messages, mess)
+	}
+	if !replaced {
+		messages = append(messages, m)
+	}
+
+	if err := p.store.Save(messages); err != nil {
+		return err
+	}
+	p.set(messages)
+	return nil
+}
+
+func (p *PreparedSet) Unprepare(id string) error {
+	messages := make(Messages, 0, len(p.messages))
+	for _, mess := range p.messages {
+		if mess.ID != id {
+			messages = append(messages, mess)
+		}
+	}
+	if len(messages) == len(p.messages) {
+		return nil
+	}
+
+	p.set(messages)
+	return p.store.Save(messages)
+}
+
+func (p *PreparedSet) Prepared(id string) (Message, bool) {
+	for _, mess := range p.messages {
+		if mess.ID == id {
+			return mess, true
+		}
+	}
+	return Message{}, false
+}
+
+func (p *PreparedSet) PreparedMessages() Messages {
+	messages := make(Messages, len(p.messages))
+	copy(messages, p.messages)
+	return messages
+}
+
+func (p *PreparedSet) PreparedLen() int {
+	return len(p.messages)
+}
+
+func (p *PreparedSet) LockedBy(i Item) (string, bool) {
+	id, ok := p.locks[i]
+	return id, ok
+}
+
+func (p *PreparedSet) set(messages Messages) {
+	p.messages = messages
+	p.locks = map[Item]string{}
+	for _, m := range messages {
+		for _, i := range m.Content {
+			p.locks[i] = m.ID
+		}
+	}
+}
+
+// writes the file to a temporary one, syncs it and renames it over the previous one
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// path of the prepared messages file in the data directory
+func preparedPath(dir string) string {
+	return filepath.Join(dir, "prepared.json")
+}
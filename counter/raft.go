@@ -0,0 +1,832 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ReplicationCommit = "commit"
+	ReplicationRaft   = "raft"
+)
+
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+)
+
+// maximum number of entries sent in a single append request
+const maxAppendEntries = 100
+
+var (
+	errNotLeader      = errors.New("not the leader")
+	errLeaderNotReady = errors.New("leader has not committed an entry in its term yet")
+	errLostLeadership = errors.New("leadership lost before the entry was committed")
+)
+
+// error returned to a proposal or a read sent to a follower
+type NotLeaderError struct {
+	Leader string `json:"leader"`
+}
+
+func (e *NotLeaderError) Error() string {
+	return fmt.Sprintf("%s, leader is '%s'", errNotLeader, e.Leader)
+}
+
+// single entry of the replicated log,
+// entry without a message is the no-op appended by a new leader,
+// entry with members is the configuration of the group from then on
+type Entry struct {
+	Term    uint64   `json:"term"`
+	Index   uint64   `json:"index"`
+	Message *Message `json:"message,omitempty"`
+	Members []string `json:"members,omitempty"`
+}
+
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+type AppendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflictIndex"`
+}
+
+type ReadIndex struct {
+	Index uint64 `json:"index"`
+}
+
+type RaftStatus struct {
+	Me          string   `json:"me"`
+	Role        string   `json:"role"`
+	Leader      string   `json:"leader"`
+	Term        uint64   `json:"term"`
+	LastIndex   uint64   `json:"lastIndex"`
+	CommitIndex uint64   `json:"commitIndex"`
+	LastApplied uint64   `json:"lastApplied"`
+	Members     []string `json:"members"`
+	ConfigIndex uint64   `json:"configIndex"`
+	Peers       []string `json:"peers"`
+}
+
+// proposal waiting for its entry to be applied
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Raft replicates committed messages between counters,
+// every counter applies entries of the log in the same order.
+// Members of the group are changed through the log one counter at a time:
+// the latest configuration entry in the log of a counter is in effect
+// as soon as it is appended, and the leader adds a counter registered
+// in the coordinator, or removes one which is no longer registered,
+// once the previous change is committed. Group is formed by the alive
+// registered counter with the lowest address, which writes the registered
+// counters as the first configuration, other counters do not start elections
+// until the log makes them members.
+type Raft struct {
+	counter         *Counter
+	me              string
+	storage         *RaftStorage
+	http            *http.Client
+	heartbeat       time.Duration
+	electionTimeout time.Duration
+
+	mu            sync.Mutex
+	term          uint64
+	votedFor      string
+	log           []Entry
+	commitIndex   uint64
+	lastApplied   uint64
+	role          string
+	leader        string
+	registry      []string
+	bootstrap     bool
+	members       []string
+	configIndex   uint64
+	peers         []string
+	known         bool
+	nextIndex     map[string]uint64
+	matchIndex    map[string]uint64
+	deadline      time.Time
+	lastHeartbeat time.Time
+	lastContact   time.Time
+	waiters       map[uint64]waiter
+}
+
+// creates raft member restored from the storage,
+// nil storage keeps the log in memory only
+func NewRaft(c *Counter, storage *RaftStorage, heartbeat time.Duration, electionTimeout time.Duration) (*Raft, error) {
+	r := &Raft{
+		counter:         c,
+		me:              c.Me,
+		storage:         storage,
+		heartbeat:       heartbeat,
+		electionTimeout: electionTimeout,
+		http: &http.Client{
+			Timeout: electionTimeout / 2,
+		},
+		log:        []Entry{{}},
+		role:       RoleFollower,
+		nextIndex:  map[string]uint64{},
+		matchIndex: map[string]uint64{},
+		waiters:    map[uint64]waiter{},
+	}
+
+	term, votedFor, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	r.term = term
+	r.votedFor = votedFor
+	r.log = append(r.log, entries...)
+	r.loadMembers()
+	r.resetDeadline()
+
+	return r, nil
+}
+
+// returns the number of votes needed to win, with the counter itself
+func (r *Raft) quorum() int {
+	return len(r.members)/2 + 1
+}
+
+// uses the latest configuration of the log,
+// registered counters until the group is formed
+// must be called with the lock held
+func (r *Raft) loadMembers() {
+	for i := len(r.log) - 1; i > 0; i-- {
+		if r.log[i].Members != nil {
+			r.setMembers(r.log[i].Members, r.log[i].Index)
+			return
+		}
+	}
+	r.setMembers(append([]string{r.me}, r.registry...), 0)
+}
+
+// must be called with the lock held
+func (r *Raft) setMembers(members []string, index uint64) {
+	r.members = append([]string{}, members...)
+	sort.Strings(r.members)
+	r.configIndex = index
+
+	r.peers = []string{}
+	for _, p := range r.members {
+		if p == r.me {
+			continue
+		}
+		r.peers = append(r.peers, p)
+		if _, ok := r.nextIndex[p]; !ok {
+			r.nextIndex[p] = r.lastIndex() + 1
+			r.matchIndex[p] = 0
+		}
+	}
+}
+
+// whether the counter may start an election, a counter which
+// is not a member yet would only disrupt the group with its terms
+// must be called with the lock held
+func (r *Raft) canElect() bool {
+	if r.configIndex == 0 {
+		return r.known && r.bootstrap
+	}
+	return contains(r.members, r.me)
+}
+
+// leader adds a registered counter or removes one which is no longer registered,
+// a single one at a time, so the old and the new majority always overlap,
+// and only once the previous change and an entry of its term are committed
+// must be called with the lock held
+func (r *Raft) changeMembers() {
+	if r.role != RoleLeader || r.configIndex > r.commitIndex || r.log[r.commitIndex].Term != r.term {
+		return
+	}
+
+	registered := append([]string{r.me}, r.registry...)
+	members := append([]string{}, r.members...)
+	changed := false
+	for _, addr := range registered {
+		if !contains(members, addr) {
+			members = append(members, addr)
+			changed = true
+			break
+		}
+	}
+	for i := 0; i < len(members) && !changed; i++ {
+		if !contains(registered, members[i]) {
+			members = append(members[:i], members[i+1:]...)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	l.Printf("[INFO] %s changes raft members from %v to %v", r.me, r.members, members)
+	if err := r.append(Entry{Term: r.term, Index: r.lastIndex() + 1, Members: members}); err != nil {
+		l.Printf("[ERROR] Unable to change raft members: %s", err.Error())
+		return
+	}
+	r.advanceCommit()
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *Raft) resetDeadline() {
+	d := r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout)))
+	r.deadline = time.Now().Add(d)
+}
+
+func (r *Raft) persistState() error {
+	if err := r.storage.SaveState(r.term, r.votedFor); err != nil {
+		l.Printf("[ERROR] Unable to save raft state: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// term which could not be saved is saved again with the vote
+// must be called with the lock held
+func (r *Raft) becomeFollower(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.persistState()
+	}
+
+	if r.role == RoleLeader {
+		l.Printf("[INFO] %s steps down in term %d", r.me, r.term)
+		for index, w := range r.waiters {
+			w.done <- errLostLeadership
+			delete(r.waiters, index)
+		}
+	}
+	r.role = RoleFollower
+}
+
+// must be called with the lock held
+func (r *Raft) becomeLeader() {
+	l.Printf("[INFO] %s is the leader in term %d", r.me, r.term)
+	r.role = RoleLeader
+	r.leader = r.me
+	for _, p := range r.peers {
+		r.nextIndex[p] = r.lastIndex() + 1
+		r.matchIndex[p] = 0
+	}
+
+	// entry of the current term lets the leader know its commit index,
+	// the first leader writes the first configuration of the group
+	e := Entry{Term: r.term, Index: r.lastIndex() + 1}
+	if r.configIndex == 0 {
+		e.Members = r.members
+	}
+	if err := r.append(e); err != nil {
+		l.Printf("[ERROR] %s cannot lead in term %d: %s", r.me, r.term, err.Error())
+		r.becomeFollower(r.term)
+		r.leader = ""
+		return
+	}
+	r.advanceCommit()
+	r.lastHeartbeat = time.Time{}
+}
+
+// entries are added to the log only once they are stored
+// must be called with the lock held
+func (r *Raft) append(entries ...Entry) error {
+	if err := r.storage.Append(entries); err != nil {
+		l.Printf("[ERROR] Unable to append raft log: %s", err.Error())
+		return err
+	}
+	r.log = append(r.log, entries...)
+	for _, e := range entries {
+		if e.Members != nil {
+			r.setMembers(e.Members, e.Index)
+		}
+	}
+	return nil
+}
+
+// runs elections and heartbeats, registered counters are refreshed from the coordinator
+func (r *Raft) Run() {
+	go func() {
+		for {
+			r.refreshPeers()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+
+	for range time.Tick(r.heartbeat / 2) {
+		r.tick()
+	}
+}
+
+func (r *Raft) tick() {
+	r.mu.Lock()
+	switch {
+	case r.role == RoleLeader && time.Since(r.lastHeartbeat) >= r.heartbeat:
+		r.lastHeartbeat = time.Now()
+		r.changeMembers()
+		r.mu.Unlock()
+		r.replicate()
+		return
+	case r.role != RoleLeader && r.canElect() && time.Now().After(r.deadline):
+		r.mu.Unlock()
+		r.elect()
+		return
+	}
+	r.mu.Unlock()
+}
+
+// asks the coordinator for registered counters,
+// the alive one with the lowest address forms the group
+func (r *Raft) refreshPeers() {
+	counters, err := r.counter.members()
+	if err != nil {
+		l.Printf("[ERROR] Unable to get raft peers: %s", err.Error())
+		return
+	}
+
+	peers := []string{}
+	first := r.me
+	for _, counter := range counters {
+		if counter.Addr == r.me {
+			continue
+		}
+		peers = append(peers, counter.Addr)
+		if !counter.IsDead && counter.Addr < first {
+			first = counter.Addr
+		}
+	}
+	r.setPeers(peers, first == r.me)
+}
+
+// remembers registered counters other than this one,
+// they are the members until the group is formed
+func (r *Raft) setPeers(peers []string, bootstrap bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.registry = peers
+	r.bootstrap = bootstrap
+	r.known = true
+	if r.configIndex == 0 {
+		r.loadMembers()
+	}
+}
+
+func (r *Raft) elect() {
+	r.mu.Lock()
+	r.resetDeadline()
+	// candidate which cannot vote for itself durably waits for the next timeout
+	if err := r.storage.SaveState(r.term+1, r.me); err != nil {
+		l.Printf("[ERROR] %s cannot start election: %s", r.me, err.Error())
+		r.mu.Unlock()
+		return
+	}
+	r.term++
+	r.role = RoleCandidate
+	r.votedFor = r.me
+	r.leader = ""
+
+	term := r.term
+	req := VoteRequest{
+		Term:         r.term,
+		Candidate:    r.me,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.log[len(r.log)-1].Term,
+	}
+	peers := append([]string{}, r.peers...)
+	votes := 1
+	if votes >= r.quorum() {
+		r.becomeLeader()
+	}
+	r.mu.Unlock()
+
+	l.Printf("[INFO] %s starts election in term %d", r.me, term)
+	for _, p := range peers {
+		go func(p string) {
+			resp := VoteResponse{}
+			if err := r.call(p, "/raft/vote", &req, &resp); err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if resp.Term > r.term {
+				r.becomeFollower(resp.Term)
+				return
+			}
+			if r.role != RoleCandidate || r.term != term || !resp.Granted {
+				return
+			}
+
+			votes++
+			if votes >= r.quorum() {
+				r.becomeLeader()
+				go r.replicate()
+			}
+		}(p)
+	}
+}
+
+// sends append request to every peer concurrently
+// returns number of peers which accepted the leader in its term
+func (r *Raft) replicate() int {
+	r.mu.Lock()
+	peers := append([]string{}, r.peers...)
+	r.mu.Unlock()
+
+	acks := make(chan bool, len(peers))
+	for _, p := range peers {
+		go func(p string) {
+			acks <- r.sendAppend(p)
+		}(p)
+	}
+
+	n := 0
+	for range peers {
+		if <-acks {
+			n++
+		}
+	}
+	return n
+}
+
+// returns whether the peer responded in the current term
+func (r *Raft) sendAppend(peer string) bool {
+	r.mu.Lock()
+	if r.role != RoleLeader {
+		r.mu.Unlock()
+		return false
+	}
+
+	next := r.nextIndex[peer]
+	if next == 0 || next > r.lastIndex()+1 {
+		next = r.lastIndex() + 1
+	}
+	end := next + maxAppendEntries
+	if end > r.lastIndex()+1 {
+		end = r.lastIndex() + 1
+	}
+
+	term := r.term
+	req := AppendRequest{
+		Term:         r.term,
+		Leader:       r.me,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.log[next-1].Term,
+		Entries:      append([]Entry{}, r.log[next:end]...),
+		LeaderCommit: r.commitIndex,
+	}
+	r.mu.Unlock()
+
+	resp := AppendResponse{}
+	if err := r.call(peer, "/raft/append", &req, &resp); err != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if resp.Term > r.term {
+		r.becomeFollower(resp.Term)
+		return false
+	}
+	if r.role != RoleLeader || r.term != term {
+		return false
+	}
+
+	if !resp.Success {
+		if resp.ConflictIndex > 0 {
+			r.nextIndex[peer] = resp.ConflictIndex
+		}
+		return true
+	}
+
+	match := req.PrevLogIndex + uint64(len(req.Entries))
+	if match > r.matchIndex[peer] {
+		r.matchIndex[peer] = match
+	}
+	r.nextIndex[peer] = match + 1
+	r.advanceCommit()
+	return true
+}
+
+// commits the newest entry of the current term stored on the majority
+// must be called with the lock held
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if r.log[n].Term != r.term {
+			break
+		}
+
+		count := 1
+		for _, p := range r.peers {
+			if r.matchIndex[p] >= n {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.commitIndex = n
+			r.applyCommitted()
+			return
+		}
+	}
+}
+
+// must be called with the lock held
+func (r *Raft) applyCommitted() {
+	for r.lastApplied < r.commitIndex {
+		e := r.log[r.lastApplied+1]
+		// entry which could not be stored is applied again with the next commit
+		if e.Message != nil {
+			if err := r.counter.apply(e.Message); err != nil {
+				l.Printf("[ERROR] Unable to apply entry %d: %s", e.Index, err.Error())
+				return
+			}
+		}
+		r.lastApplied++
+
+		if w, ok := r.waiters[e.Index]; ok {
+			if w.term == e.Term {
+				w.done <- nil
+			} else {
+				w.done <- errLostLeadership
+			}
+			delete(r.waiters, e.Index)
+		}
+	}
+}
+
+func (r *Raft) handleVote(req *VoteRequest) VoteResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term < r.term {
+		return VoteResponse{Term: r.term}
+	}
+	// counter which hears from the leader keeps its term, so a counter
+	// removed from the group or not added yet does not disrupt it
+	if r.role == RoleLeader || (r.leader != "" && time.Since(r.lastContact) < r.electionTimeout) {
+		return VoteResponse{Term: r.term}
+	}
+	if req.Term > r.term {
+		r.becomeFollower(req.Term)
+	}
+
+	lastTerm := r.log[len(r.log)-1].Term
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= r.lastIndex())
+	if (r.votedFor == "" || r.votedFor == req.Candidate) && upToDate {
+		// vote which is not saved could be given again to another candidate
+		votedFor := r.votedFor
+		r.votedFor = req.Candidate
+		if err := r.persistState(); err != nil {
+			r.votedFor = votedFor
+			return VoteResponse{Term: r.term}
+		}
+		r.resetDeadline()
+		return VoteResponse{Term: r.term, Granted: true}
+	}
+
+	return VoteResponse{Term: r.term}
+}
+
+func (r *Raft) handleAppend(req *AppendRequest) AppendResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term < r.term {
+		return AppendResponse{Term: r.term}
+	}
+	if req.Term > r.term || r.role != RoleFollower {
+		r.becomeFollower(req.Term)
+	}
+	r.leader = req.Leader
+	r.lastContact = time.Now()
+	r.resetDeadline()
+
+	if req.PrevLogIndex > r.lastIndex() {
+		return AppendResponse{Term: r.term, ConflictIndex: r.lastIndex() + 1}
+	}
+
+	if t := r.log[req.PrevLogIndex].Term; t != req.PrevLogTerm {
+		// skip the whole conflicting term at once
+		i := req.PrevLogIndex
+		for i > 1 && r.log[i-1].Term == t {
+			i--
+		}
+		return AppendResponse{Term: r.term, ConflictIndex: i}
+	}
+
+	for i, e := range req.Entries {
+		if e.Index <= r.lastIndex() {
+			if r.log[e.Index].Term == e.Term {
+				continue
+			}
+
+			// committed entries never conflict, so only uncommitted ones are dropped,
+			// together with a configuration among them
+			if err := r.storage.Rewrite(r.log[1:e.Index]); err != nil {
+				l.Printf("[ERROR] Unable to rewrite raft log: %s", err.Error())
+				return AppendResponse{Term: r.term}
+			}
+			r.log = r.log[:e.Index]
+			r.loadMembers()
+		}
+		// leader retries entries the follower could not store
+		if err := r.append(req.Entries[i:]...); err != nil {
+			return AppendResponse{Term: r.term}
+		}
+		break
+	}
+
+	// stale or reordered request may cover fewer entries than already committed
+	n := req.LeaderCommit
+	if last := req.PrevLogIndex + uint64(len(req.Entries)); last < n {
+		n = last
+	}
+	if n > r.commitIndex {
+		r.commitIndex = n
+		r.applyCommitted()
+	}
+
+	return AppendResponse{Term: r.term, Success: true}
+}
+
+// appends the message to the log and waits until it is applied
+func (r *Raft) Propose(m *Message, timeout time.Duration) error {
+	r.mu.Lock()
+	if r.role != RoleLeader {
+		err := &NotLeaderError{Leader: r.leader}
+		r.mu.Unlock()
+		return err
+	}
+
+	e := Entry{Term: r.term, Index: r.lastIndex() + 1, Message: m}
+	if err := r.append(e); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	done := make(chan error, 1)
+	r.waiters[e.Index] = waiter{term: e.Term, done: done}
+	r.advanceCommit()
+	r.mu.Unlock()
+
+	go r.replicate()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("entry %d not committed within %s", e.Index, timeout)
+	}
+}
+
+// returns commit index after confirming the counter is still the leader,
+// state at that index is the linearizable state of the group
+func (r *Raft) ReadIndex() (uint64, error) {
+	r.mu.Lock()
+	if r.role != RoleLeader {
+		err := &NotLeaderError{Leader: r.leader}
+		r.mu.Unlock()
+		return 0, err
+	}
+	if r.log[r.commitIndex].Term != r.term {
+		r.mu.Unlock()
+		return 0, errLeaderNotReady
+	}
+	index := r.commitIndex
+	quorum := r.quorum()
+	r.mu.Unlock()
+
+	if r.replicate()+1 < quorum {
+		return 0, errLostLeadership
+	}
+	return index, nil
+}
+
+// waits until the state of the counter is linearizable,
+// the leader confirms it itself and followers ask the leader for read index
+func (r *Raft) ReadBarrier(timeout time.Duration) error {
+	index, err := r.ReadIndex()
+	if e, ok := err.(*NotLeaderError); ok && e.Leader != "" {
+		index, err = r.askReadIndex(e.Leader)
+	}
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		r.mu.Lock()
+		applied := r.lastApplied
+		r.mu.Unlock()
+
+		if applied >= index {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("index %d not applied within %s", index, timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (r *Raft) askReadIndex(leader string) (uint64, error) {
+	resp, err := r.http.Get(fmt.Sprintf("http://%s/raft/readindex", leader))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code %d for read index from %s", resp.StatusCode, leader)
+	}
+
+	ri := ReadIndex{}
+	if err := json.NewDecoder(resp.Body).Decode(&ri); err != nil {
+		return 0, err
+	}
+	return ri.Index, nil
+}
+
+func (r *Raft) Status() RaftStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return RaftStatus{
+		Me:          r.me,
+		Role:        r.role,
+		Leader:      r.leader,
+		Term:        r.term,
+		LastIndex:   r.lastIndex(),
+		CommitIndex: r.commitIndex,
+		LastApplied: r.lastApplied,
+		Members:     append([]string{}, r.members...),
+		ConfigIndex: r.configIndex,
+		Peers:       append([]string{}, r.peers...),
+	}
+}
+
+func (r *Raft) call(peer string, path string, req interface{}, resp interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.http.Post(fmt.Sprintf("http://%s%s", peer, path), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", res.StatusCode, peer)
+	}
+	return json.Unmarshal(body, resp)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-process raft group, requests between members are dispatched
+// straight to the handler of the addressed counter
+type testCluster struct {
+	mu      sync.Mutex
+	dir     string
+	client  *http.Client
+	nodes   map[string]*Raft
+	handler map[string]http.Handler
+	down    map[string]bool
+	stop    chan struct{}
+}
+
+func newTestCluster(t *testing.T, dir string, addrs ...string) *testCluster {
+	tc := &testCluster{
+		dir:     dir,
+		nodes:   map[string]*Raft{},
+		handler: map[string]http.Handler{},
+		down:    map[string]bool{},
+		stop:    make(chan struct{}),
+	}
+
+	tc.client = NewTestClient(func(req *http.Request) *http.Response {
+		tc.mu.Lock()
+		h, ok := tc.handler[req.URL.Host]
+		down := tc.down[req.URL.Host]
+		tc.mu.Unlock()
+
+		rr := httptest.NewRecorder()
+		if !ok || down {
+			rr.WriteHeader(http.StatusServiceUnavailable)
+			return rr.Result()
+		}
+		h.ServeHTTP(rr, req)
+		return rr.Result()
+	})
+
+	for _, addr := range addrs {
+		tc.add(t, addr)
+	}
+	tc.register(addrs...)
+
+	return tc
+}
+
+// starts a member which knows of no other counter yet
+func (tc *testCluster) add(t *testing.T, addr string) *Raft {
+	storage, err := OpenRaftStorage(filepath.Join(tc.dir, addr))
+	if err != nil {
+		t.Fatalf("Open storage error: %s", err.Error())
+	}
+
+	c := NewCounter(addr, nil, nil)
+	r, err := NewRaft(c, storage, 10*time.Millisecond, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewRaft error: %s", err.Error())
+	}
+	r.http = tc.client
+	c.raft = r
+
+	tc.mu.Lock()
+	tc.nodes[addr] = r
+	tc.handler[addr] = NewRaftRPC(r, time.Second)
+	tc.mu.Unlock()
+
+	go func(r *Raft) {
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !tc.isDown(r.me) {
+					r.tick()
+				}
+			case <-tc.stop:
+				return
+			}
+		}
+	}(r)
+	return r
+}
+
+// tells every member the registered counters, the first one forms the group
+func (tc *testCluster) register(addrs ...string) {
+	for _, addr := range addrs {
+		peers := []string{}
+		for _, p := range addrs {
+			if p != addr {
+				peers = append(peers, p)
+			}
+		}
+		tc.nodes[addr].setPeers(peers, addr == addrs[0])
+	}
+}
+
+func (tc *testCluster) isDown(addr string) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.down[addr]
+}
+
+func (tc *testCluster) setDown(addr string, down bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.down[addr] = down
+}
+
+// waits for a leader among running members
+func (tc *testCluster) leader(t *testing.T) *Raft {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for addr, r := range tc.nodes {
+			if !tc.isDown(addr) && r.Status().Role == RoleLeader {
+				if _, err := r.ReadIndex(); err == nil {
+					return r
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Want a leader to be elected, got none")
+	return nil
+}
+
+func (tc *testCluster) close() {
+	close(tc.stop)
+	for _, r := range tc.nodes {
+		r.storage.Close()
+	}
+}
+
+func TestRaft_Replication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tc := newTestCluster(t, dir, "counter-1", "counter-2", "counter-3")
+	defer tc.close()
+
+	leader := tc.leader(t)
+	m := &Message{ID: "message-1", Content: Items{{ID: "item-1", Tenant: "test"}}}
+	if err := leader.Propose(m, time.Second); err != nil {
+		t.Fatalf("Propose error: %s", err.Error())
+	}
+
+	for addr, r := range tc.nodes {
+		if err := r.ReadBarrier(time.Second); err != nil {
+			t.Fatalf("ReadBarrier error on %s: %s", addr, err.Error())
+		}
+		if count := r.counter.countItemsForTenant("test"); count.Value != 1 {
+			t.Errorf("Want 1 item on %s, got %d", addr, count.Value)
+		}
+	}
+
+	follower := tc.nodes["counter-1"]
+	if follower == leader {
+		follower = tc.nodes["counter-2"]
+	}
+	if err := follower.Propose(m, time.Second); err == nil {
+		t.Errorf("Want follower to refuse proposal, got nil")
+	} else if e, ok := err.(*NotLeaderError); !ok || e.Leader != leader.me {
+		t.Errorf("Want redirect to %s, got %s", leader.me, err.Error())
+	}
+
+	// the remaining majority elects a new leader and keeps accepting writes
+	tc.setDown(leader.me, true)
+	next := tc.leader(t)
+	if next == leader {
+		t.Fatalf("Want new leader, got %s", next.me)
+	}
+	m = &Message{ID: "message-2", Content: Items{{ID: "item-2", Tenant: "test"}}}
+	if err := next.Propose(m, time.Second); err != nil {
+		t.Fatalf("Propose error: %s", err.Error())
+	}
+
+	// the old leader catches up once it is reachable again
+	tc.setDown(leader.me, false)
+	deadline := time.Now().Add(5 * time.Second)
+	for leader.counter.countItemsForTenant("test").Value != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Want old leader to catch up, got %+v", leader.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaft_AddMember(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tc := newTestCluster(t, dir, "counter-1", "counter-2", "counter-3")
+	defer tc.close()
+
+	leader := tc.leader(t)
+	m := &Message{ID: "message-1", Content: Items{{ID: "item-1", Tenant: "test"}}}
+	if err := leader.Propose(m, time.Second); err != nil {
+		t.Fatalf("Propose error: %s", err.Error())
+	}
+	term := leader.Status().Term
+
+	// registered counter joins through the log without starting elections
+	joined := tc.add(t, "counter-4")
+	tc.register("counter-1", "counter-2", "counter-3", "counter-4")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := leader.Status()
+		if len(status.Members) == 4 && status.CommitIndex >= status.ConfigIndex && joined.counter.countItemsForTenant("test").Value == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Want counter-4 added to the group, got %+v and %+v", status, joined.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := leader.Status(); status.Role != RoleLeader || status.Term != term {
+		t.Errorf("Want leader kept in term %d, got %+v", term, status)
+	}
+	if status := joined.Status(); len(status.Members) != 4 || status.Leader != leader.me {
+		t.Errorf("Want counter-4 following %s with 4 members, got %+v", leader.me, status)
+	}
+
+	// majority of 4 members is 3, two of them are not enough
+	tc.setDown(leader.me, true)
+	tc.setDown(joined.me, true)
+	time.Sleep(500 * time.Millisecond)
+	for addr, r := range tc.nodes {
+		if !tc.isDown(addr) && r.Status().Role == RoleLeader {
+			t.Errorf("Want no leader among 2 of 4 members, got %s", addr)
+		}
+	}
+}
+
+func TestRaftStorage_Restore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenRaftStorage(dir)
+	if err != nil {
+		t.Fatalf("Open error: %s", err.Error())
+	}
+	entries := []Entry{
+		{Term: 1, Index: 1},
+		{Term: 1, Index: 2, Message: &Message{ID: "message-1"}},
+		{Term: 2, Index: 3, Message: &Message{ID: "message-2"}},
+	}
+	s.Append(entries)
+	s.Rewrite(entries[:2])
+	s.Append([]Entry{{Term: 3, Index: 3, Message: &Message{ID: "message-3"}}})
+	s.SaveState(3, "counter-2")
+	s.Close()
+
+	s, err = OpenRaftStorage(dir)
+	if err != nil {
+		t.Fatalf("Reopen error: %s", err.Error())
+	}
+	defer s.Close()
+
+	term, votedFor, restored, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load error: %s", err.Error())
+	}
+	if term != 3 || votedFor != "counter-2" {
+		t.Errorf("Want term 3 and vote for counter-2, got %d and %s", term, votedFor)
+	}
+	if len(restored) != 3 || restored[2].Message.ID != "message-3" {
+		t.Errorf("Want conflicting entry replaced, got %+v", restored)
+	}
+}
+
+func TestRaft_StorageFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenRaftStorage(dir)
+	if err != nil {
+		t.Fatalf("Open storage error: %s", err.Error())
+	}
+	r, err := NewRaft(NewCounter("counter-1", nil, nil), storage, 10*time.Millisecond, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewRaft error: %s", err.Error())
+	}
+
+	// neither the log nor the state can be written any more
+	storage.Close()
+	storage.statePath = filepath.Join(dir, "missing", "raft-state.json")
+
+	vote := r.handleVote(&VoteRequest{Term: 1, Candidate: "counter-2"})
+	if vote.Granted || r.votedFor != "" {
+		t.Errorf("Want vote refused, got granted %t for '%s'", vote.Granted, r.votedFor)
+	}
+
+	resp := r.handleAppend(&AppendRequest{Term: 1, Leader: "counter-2", Entries: []Entry{{Term: 1, Index: 1}}, LeaderCommit: 1})
+	if resp.Success || r.lastIndex() != 0 || r.commitIndex != 0 {
+		t.Errorf("Want entries refused, got success %t with last index %d and commit index %d", resp.Success, r.lastIndex(), r.commitIndex)
+	}
+}
+
+func TestRaft_CommitIndexNeverDecreases(t *testing.T) {
+	r, err := NewRaft(NewCounter("counter-1", nil, nil), nil, 10*time.Millisecond, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewRaft error: %s", err.Error())
+	}
+
+	entries := []Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}, {Term: 1, Index: 4}}
+	if resp := r.handleAppend(&AppendRequest{Term: 1, Leader: "counter-2", Entries: entries, LeaderCommit: 3}); !resp.Success {
+		t.Fatal("Want entries appended")
+	}
+
+	// request sent before the follower acknowledged the rest covers only the first entry
+	if resp := r.handleAppend(&AppendRequest{Term: 1, Leader: "counter-2", PrevLogIndex: 1, PrevLogTerm: 1, LeaderCommit: 4}); !resp.Success {
+		t.Fatal("Want heartbeat accepted")
+	}
+	if r.commitIndex != 3 {
+		t.Errorf("Want commit index 3, got %d", r.commitIndex)
+	}
+}
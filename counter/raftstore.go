@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// persistent raft state
+type raftState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor"`
+}
+
+// Durable term, vote and log of the raft member.
+// Term and vote are rewritten atomically like prepared messages,
+// entries are appended to the log as json lines and synced,
+// the log is rewritten only when conflicting entries are dropped.
+// Nil *RaftStorage is valid and stores nothing.
+type RaftStorage struct {
+	statePath string
+	logPath   string
+	log       *os.File
+}
+
+func OpenRaftStorage(dir string) (*RaftStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &RaftStorage{
+		statePath: filepath.Join(dir, "raft-state.json"),
+		logPath:   filepath.Join(dir, "raft-log"),
+	}
+
+	f, err := os.OpenFile(s.logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+
+	return s, nil
+}
+
+// returns term, vote and entries saved by the previous run
+func (s *RaftStorage) Load() (uint64, string, []Entry, error) {
+	if s == nil {
+		return 0, "", nil, nil
+	}
+
+	state := raftState{}
+	b, err := ioutil.ReadFile(s.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, "", nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &state); err != nil {
+			return 0, "", nil, err
+		}
+	}
+
+	f, err := os.Open(s.logPath)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer f.Close()
+
+	entries := []Entry{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		e := Entry{}
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// the last line may be torn by a crash in the middle of a write
+			l.Printf("[ERROR] Skipping corrupted raft entry: %s", err.Error())
+			continue
+		}
+		if e.Index != uint64(len(entries))+1 {
+			l.Printf("[ERROR] Skipping raft entry %d out of order", e.Index)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return state.Term, state.VotedFor, entries, sc.Err()
+}
+
+func (s *RaftStorage) SaveState(term uint64, votedFor string) error {
+	if s == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(&raftState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	return writeFile(s.statePath, b)
+}
+
+func (s *RaftStorage) Append(entries []Entry) error {
+	if s == nil || len(entries) == 0 {
+		return nil
+	}
+
+	w := bufio.NewWriter(s.log)
+	enc := json.NewEncoder(w)
+	for i := range entries {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// replaces the whole log with given entries
+func (s *RaftStorage) Rewrite(entries []Entry) error {
+	if s == nil {
+		return nil
+	}
+
+	b := []byte{}
+	for i := range entries {
+		line, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	if err := writeFile(s.logPath, b); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.log.Close()
+	s.log = f
+
+	return nil
+}
+
+func (s *RaftStorage) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.log.Close()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// position of the tenant on the coordinator consistent-hash ring
+func tenantHash(tenant string) uint32 {
+	h := sha256.Sum256([]byte(tenant))
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+// whether hash falls into the range of the ring after from up to to,
+// range may wrap around zero and equal ends mean the whole ring
+func inRange(h uint32, from uint32, to uint32) bool {
+	switch {
+	case from == to:
+		return true
+	case from < to:
+		return h > from && h <= to
+	default:
+		return h > from || h <= to
+	}
+}
+
+// returns up to limit distinct items of tenants in the range,
+// ordered by tenant and id and following the given one,
+// so items added while the range is read are not skipped
+func (c *Counter) rangeItems(from uint32, to uint32, after Item, limit int) Items {
+	c.mu.Lock()
+	items := Items{}
+	for _, tenant := range c.store.Tenants() {
+		if tenant < after.Tenant || !inRange(tenantHash(tenant), from, to) {
+			continue
+		}
+		c.store.Range(tenant, func(i Item) {
+			if itemLess(after, i) {
+				items = append(items, i)
+			}
+		})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(items, func(a, b int) bool {
+		return itemLess(items[a], items[b])
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+func itemLess(a Item, b Item) bool {
+	if a.Tenant != b.Tenant {
+		return a.Tenant < b.Tenant
+	}
+	return a.ID < b.ID
+}
+
+// adds items of a range moved to the counter, returns the number of added ones,
+// items of a late write carry its version and sequence, so they are added back after a delete
+func (c *Counter) mergeItems(items Items, version uint64, seq uint64) (int, error) {
+	c.mu.Lock()
+	items = c.liveLocked(items, version)
+	c.mu.Unlock()
+
+	tenants := map[string]Items{}
+	for _, i := range items {
+		tenants[i.Tenant] = append(tenants[i.Tenant], i)
+	}
+
+	added := 0
+	for tenant, items := range tenants {
+		n, err := c.repair(tenant, items, 0, seq)
+		if err != nil {
+			return added, err
+		}
+		added += n
+	}
+	return added, nil
+}
+
+// deletes items of a late delete moved to the counter with the range,
+// returns the number of deleted ones
+func (c *Counter) deleteItems(items Items, version uint64, seq uint64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deleted, err := c.deleteLocked(&Message{ID: fmt.Sprintf("range-%d", version), Version: version, Seq: seq}, items)
+	if err != nil {
+		return 0, err
+	}
+	c.journalLocked(&JournalEntry{Op: OpDelete, Items: items, Version: version, Seq: seq})
+	return deleted, nil
+}
+
+// forgets items of a range the counter no longer owns,
+// returns the number of dropped ones
+func (c *Counter) dropRange(from uint32, to uint32) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dropped := c.dropRangeLocked(from, to)
+	// dropped items must not come back from the journal
+	c.journalLocked(&JournalEntry{Op: opDropRange, From: from, To: to})
+	return dropped
+}
+
+// must be called with the lock held
+func (c *Counter) dropRangeLocked(from uint32, to uint32) int {
+	dropped := 0
+	for _, tenant := range c.store.Tenants() {
+		if !inRange(tenantHash(tenant), from, to) {
+			continue
+		}
+		n, err := c.store.Drop(tenant)
+		if err != nil {
+			l.Printf("[ERROR] Unable to drop items of %s: %s", tenant, err.Error())
+		}
+		dropped += n
+	}
+	for tenant := range c.versions {
+		if inRange(tenantHash(tenant), from, to) {
+			delete(c.versions, tenant)
+		}
+	}
+	for _, tenant := range c.sketches.Tenants() {
+		if inRange(tenantHash(tenant), from, to) {
+			c.sketches.Drop(tenant)
+		}
+	}
+	return dropped
+}
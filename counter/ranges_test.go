@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRanges_ServeHTTP(t *testing.T) {
+	c := NewCounter("counter", nil, nil)
+	c.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-2", Tenant: "test"}, {ID: "item-1", Tenant: "test"}, {ID: "item-1", Tenant: "test"}}})
+	h := tenantHash("test")
+
+	get := func(path string) Items {
+		rr := httptest.NewRecorder()
+		NewRanges(c).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		items := Items{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &items); err != nil {
+			t.Fatalf("Unmarshal error: %s for %s", err.Error(), rr.Body)
+		}
+		return items
+	}
+
+	tt := []struct {
+		name string
+		path string
+		want Items
+	}{
+		{name: "first page", path: "/range/0/0?limit=1", want: Items{{ID: "item-1", Tenant: "test"}}},
+		{name: "next page", path: "/range/0/0?limit=1&tenant=test&id=item-1", want: Items{{ID: "item-2", Tenant: "test"}}},
+		{name: "outside of range", path: "/range/" + itoa(h) + "/" + itoa(h+1), want: Items{}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if items := get(tc.path); !reflect.DeepEqual(tc.want, items) {
+				t.Errorf("Want %+v, got %+v", tc.want, items)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	NewRanges(c).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/range", strings.NewReader(`[{"id":"item-1","tenant":"test"},{"id":"item-3","tenant":"test"}]`)))
+	if want := `{"added":1}`; strings.TrimSpace(rr.Body.String()) != want {
+		t.Errorf("Want '%s', got '%s'", want, rr.Body)
+	}
+
+	rr = httptest.NewRecorder()
+	NewRanges(c).ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/range/"+itoa(h-1)+"/"+itoa(h), nil))
+	if count := c.countItemsForTenant("test"); count.Value != 0 || count.Version != 0 {
+		t.Errorf("Want dropped tenant, got %+v", count)
+	}
+}
+
+func TestRanges_ServeHTTPSketches(t *testing.T) {
+	source := NewCounter("source", nil, nil)
+	source.sketches = NewSketches([]string{"big"}, 12)
+	source.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: "big"}, {ID: "item-2", Tenant: "big"}}})
+	h := tenantHash("big")
+
+	rr := httptest.NewRecorder()
+	NewRanges(source).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/range/"+itoa(h)+"/"+itoa(h+1)+"/sketches", nil))
+	if want := "{}"; strings.TrimSpace(rr.Body.String()) != want {
+		t.Errorf("Want no sketches outside of range, got '%s'", rr.Body)
+	}
+	rr = httptest.NewRecorder()
+	NewRanges(source).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/range/"+itoa(h-1)+"/"+itoa(h)+"/sketches", nil))
+	sketches := rr.Body.String()
+
+	target := NewCounter("target", nil, nil)
+	target.sketches = NewSketches([]string{"big"}, 12)
+	rr = httptest.NewRecorder()
+	NewRanges(target).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/range/sketches", strings.NewReader(sketches)))
+	if want := `{"merged":1}`; strings.TrimSpace(rr.Body.String()) != want {
+		t.Errorf("Want '%s', got '%s'", want, rr.Body)
+	}
+	if count := target.countItemsForTenant("big"); count.Value != 2 || !count.Approximate {
+		t.Errorf("Want approximate count 2, got %+v", count)
+	}
+
+	rr = httptest.NewRecorder()
+	NewRanges(source).ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/range/"+itoa(h-1)+"/"+itoa(h), nil))
+	if count := source.countItemsForTenant("big"); count.Value != 0 {
+		t.Errorf("Want dropped sketch, got %+v", count)
+	}
+}
+
+func itoa(h uint32) string {
+	return strconv.FormatUint(uint64(h), 10)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	OutcomeCommitted = "committed"
+	OutcomeAborted   = "aborted"
+	OutcomePending   = "pending"
+)
+
+type Outcome struct {
+	ID      string `json:"id"`
+	Outcome string `json:"outcome"`
+}
+
+// Resolver asks the coordinator about messages which stay prepared
+// longer than expected, e.g. because commit or abort request was lost,
+// and applies the outcome it gets. Expired messages are left to the Sweeper.
+type Resolver struct {
+	counter *Counter
+	after   time.Duration
+	timeout time.Duration
+}
+
+func NewResolver(c *Counter, after time.Duration, timeout time.Duration) *Resolver {
+	return &Resolver{
+		counter: c,
+		after:   after,
+		timeout: timeout,
+	}
+}
+
+func (r *Resolver) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.resolve()
+	}
+}
+
+func (r *Resolver) resolve() {
+	messages := r.counter.getMessages()
+	for i := range messages {
+		m := &messages[i]
+		age := time.Since(m.PreparedAt)
+		if age < r.after || age >= r.timeout {
+			continue
+		}
+
+		outcome, err := r.counter.askOutcome(m.ID)
+		if err != nil {
+			l.Printf("[ERROR] Unable to resolve %s: %s", m.ID, err.Error())
+			continue
+		}
+
+		switch outcome {
+		case OutcomeCommitted:
+			if err := r.counter.commit(m); err != nil {
+				l.Printf("[ERROR] Unable to resolve %s: %s", m.ID, err.Error())
+				continue
+			}
+			l.Printf("[INFO] %s resolved commit of %s", r.counter.Me, m.ID)
+		case OutcomeAborted:
+			r.counter.abort(m)
+			l.Printf("[INFO] %s resolved abort of %s", r.counter.Me, m.ID)
+		}
+	}
+}
+
+// asks the coordinator about the outcome of given message,
+// transaction unknown to the coordinator is presumed aborted
+func (c *Counter) askOutcome(id string) (string, error) {
+	url := fmt.Sprintf("%s/transactions/%s/outcome", coordinatorAddr, id)
+	resp, err := c.Do(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return OutcomeAborted, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	outcome := Outcome{}
+	if err := json.Unmarshal(body, &outcome); err != nil {
+		return "", err
+	}
+	return outcome.Outcome, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolver_resolve(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		switch req.URL.Path {
+		case "/transactions/committed/outcome":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id":"committed","outcome":"committed"}`)),
+				Header:     make(http.Header),
+			}
+		case "/transactions/pending/outcome":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id":"pending","outcome":"pending"}`)),
+				Header:     make(http.Header),
+			}
+		default:
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"message":"Unknown transaction"}`)),
+				Header:     make(http.Header),
+			}
+		}
+	})
+
+	c := &Counter{
+		Me:   "counter",
+		http: client,
+		store: preparedStorage(Messages{
+			{ID: "committed", Content: Items{{ID: "item-1", Tenant: "test"}}, PreparedAt: time.Now().Add(-time.Minute)},
+			{ID: "pending", Content: Items{{ID: "item-2", Tenant: "test"}}, PreparedAt: time.Now().Add(-time.Minute)},
+			{ID: "unknown", Content: Items{{ID: "item-3", Tenant: "test"}}, PreparedAt: time.Now().Add(-time.Minute)},
+			{ID: "fresh", Content: Items{{ID: "item-4", Tenant: "test"}}, PreparedAt: time.Now()},
+			{ID: "expired", Content: Items{{ID: "item-5", Tenant: "test"}}, PreparedAt: time.Now().Add(-time.Hour)},
+		}...),
+	}
+
+	NewResolver(c, time.Second, 10*time.Minute).resolve()
+
+	want := Items{{ID: "item-1", Tenant: "test"}}
+	if !reflect.DeepEqual(want, c.getItems()) {
+		t.Errorf("Want items %+v, got %+v", want, c.getItems())
+	}
+
+	ids := []string{}
+	for _, m := range c.getMessages() {
+		ids = append(ids, m.ID)
+	}
+	if want := []string{"pending", "fresh", "expired"}; !reflect.DeepEqual(want, ids) {
+		t.Errorf("Want messages %+v, got %+v", want, ids)
+	}
+}
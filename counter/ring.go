@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Ring places tenants on counters the same way the coordinator does.
+// Every counter owns a number of virtual points on the ring and a tenant
+// is stored by the first distinct counters found clockwise from its hash.
+// Nil *Ring owns nothing.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func NewRing(addrs []string, vnodes int) *Ring {
+	r := &Ring{owners: map[uint32]string{}}
+	for _, addr := range addrs {
+		for i := 0; i < vnodes; i++ {
+			p := tenantHash(fmt.Sprintf("%s#%d", addr, i))
+			if _, ok := r.owners[p]; ok {
+				continue
+			}
+			r.owners[p] = addr
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// returns up to n distinct counters storing the tenant, primary first
+func (r *Ring) Owners(tenant string, n int) []string {
+	if r == nil || len(r.points) == 0 {
+		return nil
+	}
+
+	owners := []string{}
+	seen := map[string]bool{}
+	h := tenantHash(tenant)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		addr := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[addr] {
+			seen[addr] = true
+			owners = append(owners, addr)
+		}
+	}
+	return owners
+}
+
+// members of the coordinator ring and of the ring the cluster moves to
+type RingView struct {
+	Members           []string `json:"members"`
+	Target            []string `json:"target,omitempty"`
+	ReplicationFactor int      `json:"replicationFactor"`
+	VirtualNodes      int      `json:"vnodes"`
+}
+
+// counters storing tenants now or once the ring change completes,
+// every counter stores every tenant of an unsharded cluster
+// Nil *Placement places every tenant on every counter.
+type Placement struct {
+	rings    []*Ring
+	replicas int
+}
+
+func NewPlacement(v RingView) *Placement {
+	if v.ReplicationFactor <= 0 {
+		return nil
+	}
+	p := &Placement{rings: []*Ring{NewRing(v.Members, v.VirtualNodes)}, replicas: v.ReplicationFactor}
+	if len(v.Target) > 0 {
+		p.rings = append(p.rings, NewRing(v.Target, v.VirtualNodes))
+	}
+	return p
+}
+
+// whether the counter stores the tenant on any of the rings
+func (p *Placement) Owns(addr string, tenant string) bool {
+	if p == nil {
+		return true
+	}
+	for _, r := range p.rings {
+		for _, owner := range r.Owners(tenant, p.replicas) {
+			if owner == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns placement of tenants the coordinator uses
+func (c *Counter) placement() (*Placement, error) {
+	resp, err := c.Do(http.MethodGet, fmt.Sprintf("%s/ring", coordinatorAddr), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d for ring", resp.StatusCode)
+	}
+
+	v := RingView{}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return NewPlacement(v), nil
+}
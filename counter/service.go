@@ -3,21 +3,39 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"reflect"
+	"sync"
 	"time"
 )
 
 var coordinatorAddr = "http://coordinator"
 
 type Counter struct {
-	Me       string
-	Items    Items
-	Messages Messages
+	Me string
 
-	http *http.Client
+	mu       sync.Mutex
+	http     *http.Client
+	store    Storage
+	policy   VotePolicy
+	raft     *Raft
+	versions map[string]uint64
+	applied  uint64
+	seq      uint64
+	ahead    map[uint64]bool
+	// commits applied while signing in, applied again over the snapshot
+	recent   Messages
+	transfer *SnapshotTransfer
+	journal  *Journal
+	sketches *Sketches
+	// delete of every deleted item
+	tombstones map[Item]Tombstone
+	// highest timestamp of an applied message
+	timestamp Timestamp
 }
 
 type Item struct {
@@ -26,64 +44,327 @@ type Item struct {
 }
 
 type Message struct {
-	ID      string `json:"id"`
-	Content Items  `json:"content"`
+	ID             string    `json:"id"`
+	Op             string    `json:"op,omitempty"`
+	Content        Items     `json:"content"`
+	Protocol       string    `json:"protocol,omitempty"`
+	Version        uint64    `json:"version,omitempty"`
+	Seq            uint64    `json:"seq,omitempty"`
+	State          string    `json:"state,omitempty"`
+	PreparedAt     time.Time `json:"preparedAt"`
+	PreCommittedAt time.Time `json:"preCommittedAt"`
+	Timestamp      Timestamp `json:"timestamp"`
+	// counters asked to prepare a three-phase commit message
+	Participants []string `json:"participants,omitempty"`
 }
 
+const (
+	Protocol2PC = "2pc"
+	Protocol3PC = "3pc"
+)
+
+// operation of the message, items are added when it is empty
+const OpDelete = "delete"
+
+const (
+	StatePrepared     = "prepared"
+	StatePreCommitted = "precommitted"
+)
+
 type Count struct {
-	Value int `json:"count"`
+	Value   int    `json:"count"`
+	Version uint64 `json:"version,omitempty"`
+	Applied uint64 `json:"applied,omitempty"`
+	// every commit up to the sequence is applied
+	Seq uint64 `json:"seq,omitempty"`
+	// estimate of a tenant in approximate mode and its standard error
+	Approximate bool `json:"approximate,omitempty"`
+	Error       int  `json:"error,omitempty"`
 }
 
 type Items []Item
 type Messages []Message
 
-func NewCounter(m string) *Counter {
-	return &Counter{
+// nil store keeps items in memory only
+func NewCounter(m string, store Storage, policy VotePolicy) *Counter {
+	if store == nil {
+		store = NewMemoryStorage(nil)
+	}
+	c := &Counter{
 		Me: m,
 
 		http: &http.Client{
 			Timeout: 1 * time.Second,
 		},
+		store:    store,
+		policy:   policy,
+		versions: map[string]uint64{},
 	}
+	c.transfer = NewSnapshotTransfer(c, "", 3, 100*time.Millisecond)
+	return c
 }
 
 func (c *Counter) countItemsForTenant(tenantID string) *Count {
-	items := map[string]bool{}
-	for _, i := range c.Items {
-		if i.Tenant == tenantID {
-			items[i.ID] = true
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sketches.Approximate(tenantID) {
+		estimate, stdErr := c.sketches.Count(tenantID)
+		return &Count{Value: estimate, Version: c.versions[tenantID], Applied: c.applied, Seq: c.seq, Approximate: true, Error: stdErr}
+	}
+	return &Count{Value: c.store.Count(tenantID), Version: c.versions[tenantID], Applied: c.applied, Seq: c.seq}
+}
+
+func (c *Counter) getItems() Items {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.store.Items()
+}
+
+// sequence the counter applied when it listed its items
+const AppliedSeqHeader = "X-Applied-Seq"
+
+// returns items with the sequence of commits applied to them
+func (c *Counter) appliedItems() (Items, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.store.Items(), c.seq
+}
+
+func (c *Counter) getMessages() Messages {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.store.PreparedMessages()
+}
+
+// message is accepted only when vote policy agrees
+// and it is durably stored, refused message returns *Rejection
+func (c *Counter) acceptMessage(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// coordinator retries a prepare whose vote it did not get
+	if c.isPrepared(m) {
+		return nil
+	}
+	if c.policy != nil {
+		if r := c.policy.Vote(c, m); r != nil {
+			return r
 		}
 	}
-	return &Count{Value: len(items)}
+
+	m.State = StatePrepared
+	m.PreparedAt = time.Now()
+	return c.store.Prepare(*m)
 }
 
-func (c *Counter) acceptMessage(m *Message) {
-	c.Messages = append(c.Messages, *m)
+// whether the same message is prepared already
+// must be called with the lock held
+func (c *Counter) isPrepared(m *Message) bool {
+	mess, ok := c.store.Prepared(m.ID)
+	return ok && mess.Op == m.Op && reflect.DeepEqual(mess.Content, m.Content)
 }
 
 func (c *Counter) abort(m *Message) {
-	for i, mess := range c.Messages {
-		if mess.ID == m.ID {
-			c.Messages = append(c.Messages[:i], c.Messages[i+1:]...)
-			break
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.unprepare(m.ID)
+}
+
+var errNotPrepared = errors.New("message is not prepared")
+
+// moves prepared message of three-phase commit to precommitted state,
+// from now on the counter commits it on its own after timeout
+// returns errNotPrepared when the message is not prepared
+func (c *Counter) preCommit(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mess, ok := c.store.Prepared(m.ID)
+	if !ok {
+		return errNotPrepared
+	}
+	mess.State = StatePreCommitted
+	mess.PreCommittedAt = time.Now()
+	return c.store.Prepare(mess)
+}
+
+// commit of a message which is no longer prepared, e.g. it was swept
+// or the counter signed in again, is applied by its sequence,
+// so a decided commit is never acknowledged without its items
+// returns error when items could not be stored, the message stays
+// prepared and not applied, so the commit can be retried
+func (c *Counter) commit(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.store.Prepared(m.ID); ok {
+		if !c.isApplied(m.Seq) {
+			if err := c.applyLocked(m); err != nil {
+				return err
+			}
+			c.markApplied(m.Seq)
+			c.rememberLocked(m)
 		}
+		c.unprepare(m.ID)
+		return nil
 	}
+
+	if m.Seq != 0 && !c.isApplied(m.Seq) {
+		l.Printf("[INFO] %s applies commit of %s which is not prepared", c.Me, m.ID)
+		if err := c.applyLocked(m); err != nil {
+			return err
+		}
+		c.markApplied(m.Seq)
+		c.rememberLocked(m)
+	}
+	return nil
 }
 
-func (c *Counter) commit(m *Message) {
-	for i, mess := range c.Messages {
-		if mess.ID == m.ID {
-			c.Items = append(c.Items, m.Content...)
-			c.Messages = append(c.Messages[:i], c.Messages[i+1:]...)
-			break
+// keeps commit applied while signing in, snapshot of the coordinator
+// or a peer may be taken before it and would drop its items
+// must be called with the lock held
+func (c *Counter) rememberLocked(m *Message) {
+	if c.recent != nil {
+		c.recent = append(c.recent, *m)
+	}
+}
+
+// applies message committed by the raft group
+func (c *Counter) apply(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.applyLocked(m)
+}
+
+// adds items of committed message and remembers the latest version
+// applied and the latest one of every tenant it touches,
+// nothing is remembered when items could not be stored
+// must be called with the lock held
+func (c *Counter) applyLocked(m *Message) error {
+	if m.Op == OpDelete {
+		if _, err := c.deleteLocked(m, m.Content); err != nil {
+			return err
+		}
+	} else {
+		exact := &Message{ID: m.ID, Content: c.liveLocked(c.sketches.Add(m.Content), m.Version)}
+		if _, err := c.store.Apply(exact); err != nil {
+			l.Printf("[ERROR] Unable to store items of %s: %s", m.ID, err.Error())
+			return err
+		}
+	}
+	c.journalLocked(&JournalEntry{Message: m})
+	if m.Version > c.applied {
+		c.applied = m.Version
+	}
+	if c.timestamp.Before(m.Timestamp) {
+		c.timestamp = m.Timestamp
+	}
+	if c.versions == nil {
+		c.versions = map[string]uint64{}
+	}
+	for _, i := range m.Content {
+		if m.Version > c.versions[i.Tenant] {
+			c.versions[i.Tenant] = m.Version
 		}
 	}
+	return nil
 }
 
+// stale entry left on disk is harmless, resolving it again is idempotent
+// must be called with the lock held
+func (c *Counter) unprepare(id string) {
+	if err := c.store.Unprepare(id); err != nil {
+		l.Printf("[ERROR] Unable to save prepared messages: %s", err.Error())
+	}
+}
+
+// number of sign-ins after which the counter gives up catching up with
+// the coordinator, every one of them may pull a snapshot from a peer
+const maxSignIns = 3
+
+// messages committed since the sequence of the counter,
+// or items of all counters when the coordinator no longer has them,
+// or peer to pull the snapshot from
+type CatchUp struct {
+	Seq      uint64   `json:"seq"`
+	Snapshot bool     `json:"snapshot"`
+	Peer     string   `json:"peer,omitempty"`
+	Items    Items    `json:"items"`
+	Messages Messages `json:"messages"`
+	// deletes of the items of all counters
+	Tombstones []Tombstone `json:"tombstones,omitempty"`
+}
+
+// registers the counter in the coordinator with the last sequence it applied
+// and catches up with commits it missed, snapshot is pulled from the peer
+// named by the coordinator and the counter signs in again
+// to get commits made since the snapshot was taken
 func (c *Counter) SignIn() error {
-	myAddr := []byte(c.Me)
+	c.mu.Lock()
+	c.recent = Messages{}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.recent = nil
+		c.mu.Unlock()
+	}()
+
+	for i := 0; i < maxSignIns; i++ {
+		catchUp, err := c.signIn()
+		if err != nil {
+			return err
+		}
+
+		// in raft mode items are rebuilt from the replicated log
+		if c.raft != nil {
+			return nil
+		}
+
+		if !catchUp.Snapshot || catchUp.Peer == "" {
+			c.catchUp(catchUp)
+			c.mergePeerSketches()
+			return nil
+		}
+
+		manifest, items, tombstones, err := c.transfer.Pull(catchUp.Peer)
+		if err != nil {
+			l.Printf("[ERROR] Unable to pull snapshot from %s: %s", catchUp.Peer, err.Error())
+			return err
+		}
+		if c.restore(manifest, items, tombstones, catchUp.Messages) >= catchUp.Seq {
+			c.mergePeerSketches()
+			return nil
+		}
+	}
+	return fmt.Errorf("counter did not catch up after %d sign-ins", maxSignIns)
+}
+
+// signs in every interval until it succeeds
+func (c *Counter) RetrySignIn(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := c.SignIn(); err == nil {
+			return
+		}
+	}
+}
+
+func (c *Counter) signIn() (*CatchUp, error) {
+	c.mu.Lock()
+	signIn, err := json.Marshal(map[string]interface{}{"addr": c.Me, "seq": c.seq, "pullSnapshot": true})
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
 	url := fmt.Sprintf("%s/counters", coordinatorAddr)
-	resp, err := c.Do(http.MethodPost, url, bytes.NewBuffer(myAddr))
+	resp, err := c.Do(http.MethodPost, url, bytes.NewBuffer(signIn))
 	defer func(resp *http.Response) {
 		if resp != nil {
 			resp.Body.Close()
@@ -91,28 +372,221 @@ func (c *Counter) SignIn() error {
 	}(resp)
 	if err != nil {
 		l.Printf("[ERROR] Add counter error: %s", err.Error())
-		return err
+		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		l.Printf("[ERROR] Unexpected status code %d for add counter: %s", resp.StatusCode, err)
-		return err
+		l.Printf("[ERROR] Unexpected status code %d for add counter", resp.StatusCode)
+		return nil, fmt.Errorf("unexpected status code %d for add counter", resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		l.Printf("[ERROR] Cannot read from add counter: %s", err.Error())
-		return err
+		return nil, err
 	}
 
-	items := Items{}
-	if err := json.Unmarshal(body, &items); err != nil {
-		l.Printf("[ERROR] Cannot unmarshall json: %s", body)
-		return err
+	// coordinator without the commit log sends all items
+	catchUp := CatchUp{}
+	if err := json.Unmarshal(body, &catchUp); err != nil {
+		items := Items{}
+		if err := json.Unmarshal(body, &items); err != nil {
+			l.Printf("[ERROR] Cannot unmarshall json: %s", body)
+			return nil, err
+		}
+		catchUp = CatchUp{Snapshot: true, Items: items}
 	}
-	c.Items = items
+	return &catchUp, nil
+}
 
-	return nil
+// replaces items with the snapshot pulled from a peer and applies
+// commits in progress it may miss, returns the sequence of the counter
+func (c *Counter) restore(manifest *Manifest, items Items, tombstones []Tombstone, messages Messages) uint64 {
+	c.mu.Lock()
+	if err := c.store.Reset(items); err != nil {
+		l.Printf("[ERROR] Unable to store snapshot %s: %s", manifest.ID, err.Error())
+	}
+	c.sketches.Reset(manifest.Sketches)
+	c.setTombstones(tombstones)
+	c.seq = manifest.Seq
+	c.ahead = map[uint64]bool{}
+	for _, seq := range manifest.Ahead {
+		c.ahead[seq] = true
+	}
+	c.applied = manifest.Applied
+	c.versions = manifest.Versions
+	c.timestamp = manifest.Timestamp
+	l.Printf("[INFO] %s restored %d items of snapshot %s at sequence %d", c.Me, len(items), manifest.ID, manifest.Seq)
+
+	c.applyMessagesLocked(messages)
+	c.reapplyLocked(c.recent)
+	seq := c.seq
+	c.mu.Unlock()
+
+	// replaced items are not in the journal
+	c.snapshot()
+	return seq
+}
+
+// returns health of the counter
+func (c *Counter) health() Health {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Health{Applied: c.timestamp, Seq: c.seq}
+}
+
+func (c *Counter) catchUp(catchUp *CatchUp) {
+	c.mu.Lock()
+	if catchUp.Snapshot {
+		l.Printf("[INFO] %s restored %d items at sequence %d", c.Me, len(catchUp.Items), catchUp.Seq)
+		// coordinator has no items of approximate tenants, peers merge their sketches,
+		// and a stale counter may still have items this one deleted
+		if err := c.store.Reset(c.liveLocked(c.sketches.Add(catchUp.Items), 0)); err != nil {
+			l.Printf("[ERROR] Unable to store snapshot: %s", err.Error())
+		}
+		c.addTombstones(catchUp.Tombstones)
+		c.seq = catchUp.Seq
+		c.ahead = map[uint64]bool{}
+
+		// commits in progress and commits applied since sign-in
+		// may be missing from the items
+		c.reapplyLocked(catchUp.Messages)
+		c.reapplyLocked(c.recent)
+		c.mu.Unlock()
+
+		// replaced items are not in the journal
+		c.snapshot()
+		return
+	}
+
+	applied := c.applyMessagesLocked(catchUp.Messages)
+	c.mu.Unlock()
+	l.Printf("[INFO] %s caught up with %d messages to sequence %d", c.Me, applied, catchUp.Seq)
+}
+
+// applies commits which were not applied yet, returns the number of applied ones,
+// commit which could not be stored leaves a gap and is requested again at sign-in
+// must be called with the lock held
+func (c *Counter) applyMessagesLocked(messages Messages) int {
+	applied := 0
+	for i := range messages {
+		if c.isApplied(messages[i].Seq) {
+			continue
+		}
+		if err := c.applyLocked(&messages[i]); err != nil {
+			continue
+		}
+		c.markApplied(messages[i].Seq)
+		applied++
+	}
+	return applied
+}
+
+// applies commits which may be missing from a snapshot even when
+// their sequence is not above it, applying them again is idempotent
+// must be called with the lock held
+func (c *Counter) reapplyLocked(messages Messages) {
+	for i := range messages {
+		if err := c.applyLocked(&messages[i]); err == nil {
+			c.markApplied(messages[i].Seq)
+		}
+	}
+}
+
+// returns whether commit of given sequence was already applied,
+// must be called with the lock held
+func (c *Counter) isApplied(seq uint64) bool {
+	return seq != 0 && (seq <= c.seq || c.ahead[seq])
+}
+
+// remembers sequence of applied commit, returns false when it was
+// already applied, must be called with the lock held
+func (c *Counter) markApplied(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	if c.isApplied(seq) {
+		return false
+	}
+
+	// commits may arrive out of order, sequence is reported up to the first gap
+	if c.ahead == nil {
+		c.ahead = map[uint64]bool{}
+	}
+	c.ahead[seq] = true
+	for c.ahead[c.seq+1] {
+		delete(c.ahead, c.seq+1)
+		c.seq++
+	}
+	return true
+}
+
+// returns addresses of other counters registered in the coordinator
+func (c *Counter) peers() ([]string, error) {
+	counters, err := c.members()
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []string{}
+	for _, counter := range counters {
+		if counter.Addr != c.Me {
+			peers = append(peers, counter.Addr)
+		}
+	}
+	return peers, nil
+}
+
+// returns the lowest sequence applied by registered counters,
+// counter which did not report its sequence yet keeps it at zero,
+// and so does the coordinator which does not know this one yet
+func (c *Counter) horizon() (uint64, error) {
+	counters, err := c.members()
+	if err != nil {
+		return 0, err
+	}
+
+	registered := false
+	horizon := uint64(0)
+	for i, counter := range counters {
+		if counter.Addr == c.Me {
+			registered = true
+		}
+		if i == 0 || counter.Seq < horizon {
+			horizon = counter.Seq
+		}
+	}
+	if !registered {
+		return 0, nil
+	}
+	return horizon, nil
+}
+
+// counter registered in the coordinator with the sequence it reported,
+// dead one is not the first to form the raft group
+type member struct {
+	Addr   string `json:"addr"`
+	Seq    uint64 `json:"seq"`
+	IsDead bool   `json:"isDead"`
+}
+
+func (c *Counter) members() ([]member, error) {
+	resp, err := c.Do(http.MethodGet, fmt.Sprintf("%s/counters", coordinatorAddr), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d for counters", resp.StatusCode)
+	}
+
+	counters := []member{}
+	if err := json.NewDecoder(resp.Body).Decode(&counters); err != nil {
+		return nil, err
+	}
+	return counters, nil
 }
 
 func (c *Counter) Do(method string, url string, body io.Reader) (*http.Response, error) {
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -29,11 +31,12 @@ func TestCounter_SignIn(t *testing.T) {
 	})
 
 	c := &Counter{
-		Me:   "counter",
-		http: client,
+		Me:    "counter",
+		http:  client,
+		store: NewMemoryStorage(nil),
 	}
 
-	if len(c.Items) > 0 {
+	if len(c.getItems()) > 0 {
 		t.Error("New counter must have empty items")
 	}
 
@@ -41,7 +44,127 @@ func TestCounter_SignIn(t *testing.T) {
 		t.Errorf("SignIn error: %s", err.Error())
 	}
 
-	if !reflect.DeepEqual(items, c.Items) {
-		t.Errorf("Want %+v, got %+v", items, c.Items)
+	if !reflect.DeepEqual(items, c.getItems()) {
+		t.Errorf("Want %+v, got %+v", items, c.getItems())
+	}
+}
+
+func TestCounter_SignInCatchUp(t *testing.T) {
+	var signIn string
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		b, _ := ioutil.ReadAll(req.Body)
+		signIn = string(b)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"seq":4,"snapshot":false,"messages":[{"id":"message-3","seq":3,"content":[{"id":"item-3","tenant":"test"}]},{"id":"message-4","seq":4,"content":[{"id":"item-4","tenant":"test"}]}]}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	c := NewCounter("counter", nil, nil)
+	c.http = client
+	c.store.Add(Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}})
+	c.seq = 2
+
+	// commit of sequence 4 arrived before the counter signed in again
+	c.store.Prepare(Message{ID: "message-4"})
+	c.commit(&Message{ID: "message-4", Seq: 4, Content: Items{{ID: "item-4", Tenant: "test"}}})
+	if c.seq != 2 {
+		t.Errorf("Want sequence to stop at the gap, got %d", c.seq)
+	}
+
+	if err := c.SignIn(); err != nil {
+		t.Fatalf("SignIn error: %s", err.Error())
+	}
+
+	if want := `{"addr":"counter","pullSnapshot":true,"seq":2}`; signIn != want {
+		t.Errorf("Want sign in '%s', got '%s'", want, signIn)
+	}
+	if c.seq != 4 {
+		t.Errorf("Want sequence 4, got %d", c.seq)
+	}
+	want := Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}, {ID: "item-3", Tenant: "test"}, {ID: "item-4", Tenant: "test"}}
+	if !reflect.DeepEqual(want, c.getItems()) {
+		t.Errorf("Want %+v, got %+v", want, c.getItems())
+	}
+}
+
+func TestCounter_SignInSnapshotKeepsRecent(t *testing.T) {
+	c := NewCounter("counter", nil, nil)
+	c.http = NewTestClient(func(req *http.Request) *http.Response {
+		// commit arrives after the coordinator accepted the counter
+		// and before its snapshot is applied
+		c.commit(&Message{ID: "message-5", Seq: 5, Content: Items{{ID: "item-5", Tenant: "test"}}})
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"seq":4,"snapshot":true,"items":[{"id":"item-1","tenant":"test"}],"messages":[]}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	if err := c.SignIn(); err != nil {
+		t.Fatalf("SignIn error: %s", err.Error())
+	}
+
+	want := Items{{ID: "item-1", Tenant: "test"}, {ID: "item-5", Tenant: "test"}}
+	if !reflect.DeepEqual(want, c.getItems()) {
+		t.Errorf("Want %+v, got %+v", want, c.getItems())
+	}
+	if c.seq != 5 {
+		t.Errorf("Want sequence 5, got %d", c.seq)
+	}
+}
+
+func TestCounter_PreparedSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewPreparedStore(filepath.Join(dir, "prepared.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Message{ID: "message-1", Content: Items{{ID: "item-1", Tenant: "test"}}}
+	if err := NewCounter("counter", NewMemoryStorage(store), nil).acceptMessage(&m); err != nil {
+		t.Fatalf("Accept error: %s", err.Error())
+	}
+
+	restarted := NewMemoryStorage(store)
+	if err := restarted.LoadPrepared(); err != nil {
+		t.Fatalf("Load error: %s", err.Error())
+	}
+	c := NewCounter("counter", restarted, nil)
+
+	c.commit(&m)
+	if !reflect.DeepEqual(m.Content, c.getItems()) {
+		t.Errorf("Want %+v, got %+v", m.Content, c.getItems())
+	}
+
+	messages, _ := store.Load()
+	if len(messages) != 0 {
+		t.Errorf("Want no prepared messages, got %+v", messages)
+	}
+}
+
+func TestCounter_CommitNotPrepared(t *testing.T) {
+	c := NewCounter("counter", nil, nil)
+
+	// prepare was swept before the decided commit arrived
+	m := Message{ID: "message-1", Seq: 1, Content: Items{{ID: "item-1", Tenant: "test"}}}
+	c.commit(&m)
+	if !reflect.DeepEqual(m.Content, c.getItems()) {
+		t.Errorf("Want %+v, got %+v", m.Content, c.getItems())
+	}
+	if c.seq != 1 {
+		t.Errorf("Want sequence 1, got %d", c.seq)
+	}
+
+	// commit without a sequence cannot be told apart from an applied one
+	c.commit(&Message{ID: "message-2", Content: Items{{ID: "item-2", Tenant: "test"}}})
+	if !reflect.DeepEqual(m.Content, c.getItems()) {
+		t.Errorf("Want %+v, got %+v", m.Content, c.getItems())
 	}
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// description of a snapshot served in chunks,
+// checksum is sha256 of the chunk body,
+// ahead are sequences applied past the gap-free one
+type Manifest struct {
+	ID        string             `json:"id"`
+	Seq       uint64             `json:"seq"`
+	Ahead     []uint64           `json:"ahead,omitempty"`
+	Applied   uint64             `json:"applied"`
+	Versions  map[string]uint64  `json:"versions"`
+	Timestamp Timestamp          `json:"timestamp"`
+	Sketches  map[string]*Sketch `json:"sketches,omitempty"`
+	ChunkSize int                `json:"chunkSize"`
+	Chunks    []Chunk            `json:"chunks"`
+}
+
+// chunk holds items, or tombstones after the last chunk of items
+type Chunk struct {
+	Index      int    `json:"index"`
+	Items      int    `json:"items"`
+	Tombstones int    `json:"tombstones,omitempty"`
+	Checksum   string `json:"checksum"`
+}
+
+type snapshot struct {
+	manifest Manifest
+	chunks   [][]byte
+	expires  time.Time
+}
+
+// Snapshots serves frozen copies of the items to counters signing in.
+// A snapshot is kept for the TTL after it was last used,
+// so an interrupted transfer can continue with the same chunks.
+type Snapshots struct {
+	counter   *Counter
+	chunkSize int
+	ttl       time.Duration
+
+	mu        sync.Mutex
+	snapshots map[string]*snapshot
+}
+
+func NewSnapshots(c *Counter, chunkSize int, ttl time.Duration) *Snapshots {
+	if chunkSize <= 0 {
+		chunkSize = 1000
+	}
+	return &Snapshots{
+		counter:   c,
+		chunkSize: chunkSize,
+		ttl:       ttl,
+		snapshots: map[string]*snapshot{},
+	}
+}
+
+// freezes current items and returns manifest of the new snapshot
+func (s *Snapshots) Create() (*Manifest, error) {
+	c := s.counter
+	c.mu.Lock()
+	items := c.store.Items()
+	tombstones := c.tombstoneList()
+	m := Manifest{
+		ID:        fmt.Sprintf("%s-%d", c.Me, time.Now().UnixNano()),
+		Seq:       c.seq,
+		Applied:   c.applied,
+		Timestamp: c.timestamp,
+		Sketches:  c.sketches.Copy(),
+		Versions:  map[string]uint64{},
+		ChunkSize: s.chunkSize,
+		Chunks:    []Chunk{},
+	}
+	for tenant, v := range c.versions {
+		m.Versions[tenant] = v
+	}
+	for seq := range c.ahead {
+		m.Ahead = append(m.Ahead, seq)
+	}
+	c.mu.Unlock()
+
+	snap := &snapshot{}
+	for i := 0; i == 0 || i < len(items); i += s.chunkSize {
+		end := i + s.chunkSize
+		if end > len(items) {
+			end = len(items)
+		}
+
+		b, err := json.Marshal(items[i:end])
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		m.Chunks = append(m.Chunks, Chunk{Index: len(snap.chunks), Items: end - i, Checksum: hex.EncodeToString(sum[:])})
+		snap.chunks = append(snap.chunks, b)
+	}
+	for i := 0; i < len(tombstones); i += s.chunkSize {
+		end := min(i+s.chunkSize, len(tombstones))
+		b, err := json.Marshal(tombstones[i:end])
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		m.Chunks = append(m.Chunks, Chunk{Index: len(snap.chunks), Tombstones: end - i, Checksum: hex.EncodeToString(sum[:])})
+		snap.chunks = append(snap.chunks, b)
+	}
+	snap.manifest = m
+	snap.expires = time.Now().Add(s.ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	s.snapshots[m.ID] = snap
+	l.Printf("[INFO] %s created snapshot %s with %d items", c.Me, m.ID, len(items))
+
+	return &m, nil
+}
+
+// returns body of the chunk and extends life of the snapshot
+func (s *Snapshots) Chunk(id string, index int) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	snap, ok := s.snapshots[id]
+	if !ok || index < 0 || index >= len(snap.chunks) {
+		return nil, false
+	}
+	snap.expires = time.Now().Add(s.ttl)
+	return snap.chunks[index], true
+}
+
+// must be called with the lock held
+func (s *Snapshots) expire() {
+	for id, snap := range s.snapshots {
+		if time.Now().After(snap.expires) {
+			delete(s.snapshots, id)
+		}
+	}
+}
+
+// SnapshotTransfer pulls a snapshot from a peer chunk by chunk.
+// Every chunk is verified with its checksum and retried on failure.
+// Verified chunks are kept in the directory, so after a restart
+// the transfer continues while the peer still serves the same snapshot.
+// Empty directory keeps chunks in memory only.
+type SnapshotTransfer struct {
+	counter *Counter
+	dir     string
+	retries int
+	backoff time.Duration
+}
+
+// progress of the transfer kept next to the chunks
+type transferState struct {
+	Peer     string   `json:"peer"`
+	Manifest Manifest `json:"manifest"`
+}
+
+func NewSnapshotTransfer(c *Counter, dir string, retries int, backoff time.Duration) *SnapshotTransfer {
+	return &SnapshotTransfer{counter: c, dir: dir, retries: retries, backoff: backoff}
+}
+
+// returns manifest, items and tombstones of a snapshot, interrupted transfer
+// is resumed first and a new snapshot is pulled from the peer
+// when the old one can no longer be finished
+func (t *SnapshotTransfer) Pull(peer string) (*Manifest, Items, []Tombstone, error) {
+	if state := t.state(); state != nil {
+		manifest, items, tombstones, err := t.pull(state.Peer, &state.Manifest, t.stored(&state.Manifest))
+		if err == nil {
+			return manifest, items, tombstones, nil
+		}
+		l.Printf("[ERROR] Unable to resume snapshot %s from %s: %s", state.Manifest.ID, state.Peer, err.Error())
+	}
+
+	manifest := &Manifest{}
+	if err := t.get(fmt.Sprintf("http://%s/snapshot", peer), manifest); err != nil {
+		return nil, nil, nil, err
+	}
+
+	t.clear()
+	return t.pull(peer, manifest, map[int][]byte{})
+}
+
+func (t *SnapshotTransfer) pull(peer string, manifest *Manifest, chunks map[int][]byte) (*Manifest, Items, []Tombstone, error) {
+	for _, chunk := range manifest.Chunks {
+		if _, ok := chunks[chunk.Index]; ok {
+			continue
+		}
+
+		var err error
+		for try := 0; try <= t.retries; try++ {
+			if try > 0 {
+				time.Sleep(t.backoff * time.Duration(try))
+			}
+
+			var b []byte
+			b, err = t.chunk(peer, manifest.ID, chunk)
+			if err == nil {
+				chunks[chunk.Index] = b
+				t.save(peer, manifest, chunk.Index, b)
+				break
+			}
+			l.Printf("[ERROR] Chunk %d of snapshot %s from %s: %s", chunk.Index, manifest.ID, peer, err.Error())
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	items := Items{}
+	tombstones := []Tombstone{}
+	for _, chunk := range manifest.Chunks {
+		if chunk.Tombstones > 0 {
+			part := []Tombstone{}
+			if err := json.Unmarshal(chunks[chunk.Index], &part); err != nil {
+				return nil, nil, nil, err
+			}
+			tombstones = append(tombstones, part...)
+			continue
+		}
+
+		part := Items{}
+		if err := json.Unmarshal(chunks[chunk.Index], &part); err != nil {
+			return nil, nil, nil, err
+		}
+		items = append(items, part...)
+	}
+
+	t.clear()
+	return manifest, items, tombstones, nil
+}
+
+func (t *SnapshotTransfer) chunk(peer string, id string, chunk Chunk) ([]byte, error) {
+	resp, err := t.counter.Do(http.MethodGet, fmt.Sprintf("http://%s/snapshot/%s/%d", peer, id, chunk.Index), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(b)
+	if hex.EncodeToString(sum[:]) != chunk.Checksum {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return b, nil
+}
+
+// returns interrupted transfer or nil
+func (t *SnapshotTransfer) state() *transferState {
+	if t.dir == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(t.dir, "state.json"))
+	if err != nil {
+		return nil
+	}
+	state := &transferState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil
+	}
+	return state
+}
+
+// returns verified chunks of the interrupted transfer
+func (t *SnapshotTransfer) stored(manifest *Manifest) map[int][]byte {
+	chunks := map[int][]byte{}
+	for _, chunk := range manifest.Chunks {
+		b, err := ioutil.ReadFile(filepath.Join(t.dir, fmt.Sprintf("chunk-%d.json", chunk.Index)))
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(b)
+		if hex.EncodeToString(sum[:]) == chunk.Checksum {
+			chunks[chunk.Index] = b
+		}
+	}
+	l.Printf("[INFO] Resuming snapshot %s with %d of %d chunks", manifest.ID, len(chunks), len(manifest.Chunks))
+	return chunks
+}
+
+// stored chunk only helps to resume, so errors are just logged
+func (t *SnapshotTransfer) save(peer string, manifest *Manifest, index int, b []byte) {
+	if t.dir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		l.Printf("[ERROR] Unable to store snapshot chunk: %s", err.Error())
+		return
+	}
+
+	err := writeFile(filepath.Join(t.dir, fmt.Sprintf("chunk-%d.json", index)), b)
+	if err == nil {
+		var state []byte
+		state, err = json.Marshal(&transferState{Peer: peer, Manifest: *manifest})
+		if err == nil {
+			err = writeFile(filepath.Join(t.dir, "state.json"), state)
+		}
+	}
+	if err != nil {
+		l.Printf("[ERROR] Unable to store snapshot chunk: %s", err.Error())
+	}
+}
+
+func (t *SnapshotTransfer) clear() {
+	if t.dir == "" {
+		return
+	}
+	if err := os.RemoveAll(t.dir); err != nil {
+		l.Printf("[ERROR] Unable to remove snapshot chunks: %s", err.Error())
+	}
+}
+
+func (t *SnapshotTransfer) get(url string, v interface{}) error {
+	resp, err := t.counter.Do(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d for %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotTransfer_Pull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	peer := NewCounter("peer", nil, nil)
+	for _, id := range []string{"item-1", "item-2", "item-3", "item-4", "item-5"} {
+		peer.apply(&Message{ID: id, Version: 1, Content: Items{{ID: id, Tenant: "test"}}})
+	}
+	peer.seq = 5
+	snapshots := NewSnapshotServe(NewSnapshots(peer, 2, time.Minute))
+
+	corrupt := true
+	paths := []string{}
+	c := NewCounter("counter", nil, nil)
+	c.http = NewTestClient(func(req *http.Request) *http.Response {
+		paths = append(paths, req.URL.Path)
+		rr := httptest.NewRecorder()
+		snapshots.ServeHTTP(rr, req)
+		resp := rr.Result()
+		if corrupt && strings.HasSuffix(req.URL.Path, "/1") {
+			resp.Body = ioutil.NopCloser(strings.NewReader(`[]`))
+		}
+		return resp
+	})
+
+	transfer := NewSnapshotTransfer(c, filepath.Join(dir, "snapshot"), 1, time.Millisecond)
+	if _, _, _, err := transfer.Pull("peer"); err == nil {
+		t.Fatal("Want checksum error, got nil")
+	}
+	if want := 4; len(paths) != want {
+		t.Errorf("Want manifest, chunk and two tries of the corrupted one, got %v", paths)
+	}
+
+	// restarted transfer continues with the stored chunk
+	corrupt = false
+	paths = []string{}
+	manifest, items, _, err := transfer.Pull("peer")
+	if err != nil {
+		t.Fatalf("Pull error: %s", err.Error())
+	}
+	if len(paths) != 2 || !strings.HasSuffix(paths[0], "/1") || !strings.HasSuffix(paths[1], "/2") {
+		t.Errorf("Want the missing chunks only, got %v", paths)
+	}
+
+	if manifest.Seq != 5 || len(manifest.Chunks) != 3 {
+		t.Errorf("Want 3 chunks at sequence 5, got %+v", manifest)
+	}
+	if !reflect.DeepEqual(peer.getItems(), items) {
+		t.Errorf("Want %+v, got %+v", peer.getItems(), items)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "snapshot")); !os.IsNotExist(err) {
+		t.Errorf("Want chunks removed after transfer, got %v", err)
+	}
+}
+
+func TestSnapshotTransfer_PullTombstones(t *testing.T) {
+	peer := NewCounter("peer", nil, nil)
+	peer.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}, {ID: "item-3", Tenant: "test"}}})
+	peer.apply(&Message{ID: "message-2", Version: 2, Seq: 2, Op: OpDelete, Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}}})
+	snapshots := NewSnapshotServe(NewSnapshots(peer, 1, time.Minute))
+
+	c := NewCounter("counter", nil, nil)
+	c.http = NewTestClient(func(req *http.Request) *http.Response {
+		rr := httptest.NewRecorder()
+		snapshots.ServeHTTP(rr, req)
+		return rr.Result()
+	})
+
+	manifest, items, tombstones, err := NewSnapshotTransfer(c, "", 0, 0).Pull("peer")
+	if err != nil {
+		t.Fatalf("Pull error: %s", err.Error())
+	}
+
+	chunks := []Chunk{}
+	for _, chunk := range manifest.Chunks {
+		chunks = append(chunks, Chunk{Index: chunk.Index, Items: chunk.Items, Tombstones: chunk.Tombstones})
+	}
+	if want := []Chunk{{Index: 0, Items: 1}, {Index: 1, Tombstones: 1}, {Index: 2, Tombstones: 1}}; !reflect.DeepEqual(want, chunks) {
+		t.Errorf("Want chunks %+v, got %+v", want, chunks)
+	}
+	if want := (Items{{ID: "item-3", Tenant: "test"}}); !reflect.DeepEqual(want, items) {
+		t.Errorf("Want %+v, got %+v", want, items)
+	}
+	if len(tombstones) != 2 || tombstones[0].Seq != 2 || tombstones[1].Seq != 2 {
+		t.Errorf("Want 2 tombstones of sequence 2, got %+v", tombstones)
+	}
+}
+
+func TestCounter_SignInSnapshot(t *testing.T) {
+	peer := NewCounter("peer", nil, nil)
+	peer.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}}})
+	peer.seq = 1
+	snapshots := NewSnapshotServe(NewSnapshots(peer, 1, time.Minute))
+
+	signIns := []string{}
+	c := NewCounter("counter", nil, nil)
+	c.http = NewTestClient(func(req *http.Request) *http.Response {
+		if req.URL.Host == "peer" {
+			rr := httptest.NewRecorder()
+			snapshots.ServeHTTP(rr, req)
+			return rr.Result()
+		}
+
+		b, _ := ioutil.ReadAll(req.Body)
+		signIns = append(signIns, string(b))
+
+		// peer snapshot misses commit of sequence 2
+		body := `{"seq":2,"snapshot":true,"peer":"peer","messages":[]}`
+		if len(signIns) > 1 {
+			body = `{"seq":2,"snapshot":false,"messages":[{"id":"message-2","seq":2,"content":[{"id":"item-2","tenant":"test"}]}]}`
+		}
+		rr := httptest.NewRecorder()
+		rr.WriteString(body)
+		return rr.Result()
+	})
+
+	if err := c.SignIn(); err != nil {
+		t.Fatalf("SignIn error: %s", err.Error())
+	}
+
+	if want := `{"addr":"counter","pullSnapshot":true,"seq":1}`; len(signIns) != 2 || signIns[1] != want {
+		t.Errorf("Want second sign in '%s', got %v", want, signIns)
+	}
+	if c.seq != 2 {
+		t.Errorf("Want sequence 2, got %d", c.seq)
+	}
+	want := Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}}
+	if !reflect.DeepEqual(want, c.getItems()) {
+		t.Errorf("Want %+v, got %+v", want, c.getItems())
+	}
+}
+
+func TestCounter_restoreAhead(t *testing.T) {
+	peer := NewCounter("peer", nil, nil)
+	peer.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}}})
+	peer.seq = 1
+	// commit of sequence 3 applied before the one of sequence 2
+	peer.ahead = map[uint64]bool{3: true}
+	snapshots := NewSnapshotServe(NewSnapshots(peer, 1, time.Minute))
+
+	c := NewCounter("counter", nil, nil)
+	c.http = NewTestClient(func(req *http.Request) *http.Response {
+		rr := httptest.NewRecorder()
+		snapshots.ServeHTTP(rr, req)
+		return rr.Result()
+	})
+
+	manifest, items, tombstones, err := NewSnapshotTransfer(c, "", 0, 0).Pull("peer")
+	if err != nil {
+		t.Fatalf("Pull error: %s", err.Error())
+	}
+	if want := []uint64{3}; !reflect.DeepEqual(want, manifest.Ahead) {
+		t.Errorf("Want ahead %v, got %v", want, manifest.Ahead)
+	}
+
+	c.restore(manifest, items, tombstones, nil)
+	if !c.isApplied(3) || c.isApplied(2) {
+		t.Errorf("Want sequence 3 applied and 2 missing, got %d ahead %v", c.seq, c.ahead)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import "fmt"
+
+const (
+	StorageMemory = "memory"
+	StorageDisk   = "disk"
+)
+
+// Storage keeps committed items and prepared messages of the counter.
+// The counter calls it with its lock held, so implementations
+// do not need locking of their own.
+type Storage interface {
+	// adds or deletes items of the committed message,
+	// returns the number of added or deleted ones
+	Apply(m *Message) (int, error)
+	// adds items repaired or moved from a peer, returns the number of new ones
+	Add(items Items) (int, error)
+	// returns the number of deleted items
+	Delete(items Items) (int, error)
+	// replaces all items, e.g. with a snapshot
+	Reset(items Items) error
+	// forgets items of the tenant, returns the number of dropped ones
+	Drop(tenant string) (int, error)
+
+	Count(tenant string) int
+	Has(i Item) bool
+	Tenants() []string
+	// calls f with every item of the tenant in no particular order
+	Range(tenant string, f func(i Item))
+	// returns all items ordered by tenant and id
+	Items() Items
+	// whether items survive restart, so local snapshots leave them out
+	Durable() bool
+
+	// stores prepared message durably, replaces the one with the same id
+	Prepare(m Message) error
+	// forgets prepared message with given id
+	Unprepare(id string) error
+	// returns prepared message with given id
+	Prepared(id string) (Message, bool)
+	// returns prepared messages in the order they were prepared
+	PreparedMessages() Messages
+	PreparedLen() int
+	// returns id of the prepared message which locks the item
+	LockedBy(i Item) (string, bool)
+
+	Close() error
+}
+
+// opens storage engine selected by the configuration
+// with messages prepared by the previous run
+func OpenStorage(engine string, dir string) (Storage, error) {
+	switch engine {
+	case StorageMemory:
+		prepared, err := NewPreparedStore(preparedPath(dir))
+		if err != nil {
+			return nil, err
+		}
+		s := NewMemoryStorage(prepared)
+		if err := s.LoadPrepared(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case StorageDisk:
+		return OpenDiskStorage(dir)
+	default:
+		return nil, fmt.Errorf("unknown storage engine %s", engine)
+	}
+}
+
+// MemoryStorage keeps items in memory only, they are pulled
+// from the coordinator or a peer again after restart.
+// Prepared messages are still saved, so votes survive restart.
+type MemoryStorage struct {
+	*PreparedSet
+	index Index
+}
+
+func NewMemoryStorage(prepared *PreparedStore) *MemoryStorage {
+	return &MemoryStorage{PreparedSet: NewPreparedSet(prepared), index: Index{}}
+}
+
+func (s *MemoryStorage) Apply(m *Message) (int, error) {
+	if m.Op == OpDelete {
+		return s.Delete(m.Content)
+	}
+	return s.Add(m.Content)
+}
+
+func (s *MemoryStorage) Add(items Items) (int, error) {
+	added := 0
+	for _, i := range items {
+		if s.index.Add(i) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+func (s *MemoryStorage) Delete(items Items) (int, error) {
+	deleted := 0
+	for _, i := range items {
+		if s.index.Remove(i) {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStorage) Reset(items Items) error {
+	s.index = NewIndex(items)
+	return nil
+}
+
+func (s *MemoryStorage) Drop(tenant string) (int, error) {
+	return s.index.Drop(tenant), nil
+}
+
+func (s *MemoryStorage) Count(tenant string) int {
+	return s.index.Count(tenant)
+}
+
+func (s *MemoryStorage) Has(i Item) bool {
+	return s.index.Has(i)
+}
+
+func (s *MemoryStorage) Tenants() []string {
+	return s.index.Tenants()
+}
+
+func (s *MemoryStorage) Range(tenant string, f func(i Item)) {
+	s.index.Range(tenant, f)
+}
+
+func (s *MemoryStorage) Items() Items {
+	return s.index.Items()
+}
+
+func (s *MemoryStorage) Durable() bool {
+	return false
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
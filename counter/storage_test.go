@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStorage(t *testing.T) {
+	tt := []struct {
+		name   string
+		engine string
+	}{
+		{name: "memory", engine: StorageMemory},
+		{name: "disk", engine: StorageDisk},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "storage")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, err := OpenStorage(tc.engine, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if added, _ := s.Apply(&Message{ID: "message-1", Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-1", Tenant: "test"}}}); added != 1 {
+				t.Errorf("Want 1 added item, got %d", added)
+			}
+			if added, _ := s.Add(Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "other"}}); added != 1 {
+				t.Errorf("Want 1 added item, got %d", added)
+			}
+			if count := s.Count("test"); count != 1 {
+				t.Errorf("Want count 1, got %d", count)
+			}
+			if dropped, _ := s.Drop("other"); dropped != 1 {
+				t.Errorf("Want 1 dropped item, got %d", dropped)
+			}
+
+			want := Items{{ID: "item-1", Tenant: "test"}}
+			if items := s.Items(); !reflect.DeepEqual(want, items) {
+				t.Errorf("Want %+v, got %+v", want, items)
+			}
+			if tenants := s.Tenants(); !reflect.DeepEqual([]string{"test"}, tenants) {
+				t.Errorf("Want tenants [test], got %v", tenants)
+			}
+
+			s.Prepare(Message{ID: "message-2", Content: Items{{ID: "item-3", Tenant: "test"}}})
+			s.Prepare(Message{ID: "message-3", Content: Items{{ID: "item-4", Tenant: "test"}}})
+			s.Prepare(Message{ID: "message-2", Content: Items{{ID: "item-3", Tenant: "test"}}, State: StatePreCommitted})
+			if m, ok := s.Prepared("message-2"); !ok || m.State != StatePreCommitted {
+				t.Errorf("Want precommitted message-2, got %+v", m)
+			}
+			if id, ok := s.LockedBy(Item{ID: "item-4", Tenant: "test"}); !ok || id != "message-3" {
+				t.Errorf("Want item-4 locked by message-3, got '%s'", id)
+			}
+			s.Unprepare("message-3")
+			if _, ok := s.LockedBy(Item{ID: "item-4", Tenant: "test"}); ok || s.PreparedLen() != 1 {
+				t.Errorf("Want item-4 released, got %+v", s.PreparedMessages())
+			}
+		})
+	}
+}
+
+func TestDiskStorage_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Reset(Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "other"}})
+	s.Apply(&Message{ID: "message-1", Content: Items{{ID: "item-3", Tenant: "test"}}})
+	s.Drop("other")
+	// enough records to rewrite the log
+	for i := 0; i < diskCompactAfter; i++ {
+		s.Add(Items{{ID: "item-" + itoa(uint32(i+10)), Tenant: "many"}})
+	}
+	s.Prepare(Message{ID: "message-2"})
+	s.Close()
+
+	// torn last line of a crashed write
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"add","items":[{"id":`)
+	f.Close()
+
+	s, err = OpenDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.records >= diskCompactAfter {
+		t.Errorf("Want compacted log, got %d records", s.records)
+	}
+	if count := s.Count("test"); count != 2 {
+		t.Errorf("Want 2 items of test, got %d", count)
+	}
+	if count := s.Count("other"); count != 0 {
+		t.Errorf("Want dropped tenant, got %d items", count)
+	}
+	if count := s.Count("many"); count != diskCompactAfter {
+		t.Errorf("Want %d items of many, got %d", diskCompactAfter, count)
+	}
+	if messages := s.PreparedMessages(); len(messages) != 1 || messages[0].ID != "message-2" {
+		t.Errorf("Want prepared message-2, got %+v", messages)
+	}
+}
+
+func TestDiskStorage_InterruptedReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Items{{ID: "item-1", Tenant: "test"}})
+	s.Close()
+
+	// log is truncated and the new set written,
+	// but the old set is only moved away
+	if err := ioutil.WriteFile(s.path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reset, err := OpenDiskStorage(filepath.Join(dir, "reset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset.Reset(Items{{ID: "item-2", Tenant: "other"}})
+	reset.Close()
+	if err := os.Rename(s.dir, s.dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(reset.dir, s.dir+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if want := (Items{{ID: "item-2", Tenant: "other"}}); !reflect.DeepEqual(want, s.Items()) {
+		t.Errorf("Want %+v, got %+v", want, s.Items())
+	}
+}
+
+// memory storage with given messages prepared
+func preparedStorage(messages ...Message) *MemoryStorage {
+	s := NewMemoryStorage(nil)
+	for _, m := range messages {
+		s.Prepare(m)
+	}
+	return s
+}
+
+// storage which fails to write, e.g. on a full disk
+type failingStorage struct {
+	Storage
+}
+
+func (s failingStorage) Apply(m *Message) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestCounter_CommitStorageError(t *testing.T) {
+	c := NewCounter("counter", failingStorage{NewMemoryStorage(nil)}, nil)
+	m := Message{ID: "message-1", Seq: 1, Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}}}
+	if err := c.acceptMessage(&m); err != nil {
+		t.Fatalf("Accept error: %s", err.Error())
+	}
+
+	if err := c.commit(&m); err == nil {
+		t.Error("Want storage error, got nil")
+	}
+	if c.seq != 0 || c.applied != 0 {
+		t.Errorf("Want nothing applied, got sequence %d and version %d", c.seq, c.applied)
+	}
+	if len(c.getMessages()) != 1 {
+		t.Errorf("Want message still prepared, got %+v", c.getMessages())
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DecisionCommitted = "committed"
+	DecisionAborted   = "aborted"
+	DecisionDiscarded = "discarded"
+)
+
+// what happened to a message which stayed prepared for too long
+type Expiry struct {
+	Message  Message   `json:"message"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+}
+
+// Sweeper removes messages prepared longer than the timeout.
+// Coordinator is asked about them for the last time and the message
+// is discarded only when it was aborted or is unknown to the coordinator,
+// so its locks and memory are released. Pending message may still be
+// committed, so it is kept and asked about again on the next sweep.
+// Three-phase commit messages are not discarded, the other participants
+// are asked about them instead. The message is committed when any of them
+// precommitted it and aborted only when all of them answered and none did.
+type Sweeper struct {
+	counter          *Counter
+	timeout          time.Duration
+	precommitTimeout time.Duration
+	limit            int
+
+	mu        sync.Mutex
+	decisions []Expiry
+}
+
+func NewSweeper(c *Counter, timeout time.Duration, precommitTimeout time.Duration, limit int) *Sweeper {
+	return &Sweeper{
+		counter:          c,
+		timeout:          timeout,
+		precommitTimeout: precommitTimeout,
+		limit:            limit,
+	}
+}
+
+func (s *Sweeper) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.sweep()
+	}
+}
+
+func (s *Sweeper) sweep() {
+	messages := s.counter.getMessages()
+	for i := range messages {
+		m := &messages[i]
+		if !s.expired(m) {
+			continue
+		}
+
+		e := Expiry{Message: *m, Time: time.Now()}
+		outcome, err := s.counter.askOutcome(m.ID)
+		switch {
+		case (err != nil || outcome == OutcomePending) && m.Protocol == Protocol3PC:
+			reason := "outcome still " + outcome
+			if err != nil {
+				reason = "coordinator unavailable: " + err.Error()
+			}
+			decision, err := s.terminate(m)
+			if err != nil {
+				l.Printf("[ERROR] %s keeps expired %s: %s", s.counter.Me, m.ID, err.Error())
+				continue
+			}
+			if decision == DecisionCommitted {
+				if err := s.counter.commit(m); err != nil {
+					l.Printf("[ERROR] %s keeps expired %s: %s", s.counter.Me, m.ID, err.Error())
+					continue
+				}
+			} else {
+				s.counter.abort(m)
+			}
+			e.Decision = decision
+			e.Reason = reason + ", decided with the other participants"
+		case err != nil:
+			l.Printf("[ERROR] %s keeps expired %s, coordinator unavailable: %s", s.counter.Me, m.ID, err.Error())
+			continue
+		case outcome == OutcomeCommitted:
+			if err := s.counter.commit(m); err != nil {
+				l.Printf("[ERROR] %s keeps expired %s: %s", s.counter.Me, m.ID, err.Error())
+				continue
+			}
+			e.Decision = DecisionCommitted
+			e.Reason = "committed by coordinator"
+		case outcome == OutcomeAborted:
+			s.counter.abort(m)
+			e.Decision = DecisionAborted
+			e.Reason = "aborted by coordinator"
+		default:
+			l.Printf("[INFO] %s keeps expired %s, outcome still %s", s.counter.Me, m.ID, outcome)
+			continue
+		}
+
+		l.Printf("[INFO] %s expired %s: %s, %s", s.counter.Me, m.ID, e.Decision, e.Reason)
+		s.record(e)
+	}
+}
+
+// decides three-phase commit message with the other participants,
+// returns error when any of them cannot tell its state and none precommitted
+func (s *Sweeper) terminate(m *Message) (string, error) {
+	if m.State == StatePreCommitted {
+		return DecisionCommitted, nil
+	}
+
+	var unavailable error
+	for _, peer := range m.Participants {
+		if peer == s.counter.Me {
+			continue
+		}
+
+		state, err := s.askState(peer, m.ID)
+		if err != nil {
+			unavailable = fmt.Errorf("participant %s unavailable: %s", peer, err.Error())
+			continue
+		}
+		if state == StatePreCommitted || state == DecisionCommitted {
+			return DecisionCommitted, nil
+		}
+	}
+	if unavailable != nil {
+		return "", unavailable
+	}
+	return DecisionAborted, nil
+}
+
+// state of a message on given participant, unknown one is empty
+func (s *Sweeper) askState(peer string, id string) (string, error) {
+	resp, err := s.counter.Do(http.MethodGet, fmt.Sprintf("http://%s/expired/%s", peer, id), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	state := MessageState{}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return "", err
+	}
+	return state.State, nil
+}
+
+// state of a message the counter prepared or decided
+type MessageState struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+}
+
+// returns state of given message, prepared or precommitted while it is
+// kept and the decision after it expired, empty when it is unknown
+func (s *Sweeper) State(id string) string {
+	for _, m := range s.counter.getMessages() {
+		if m.ID != id {
+			continue
+		}
+		if m.State == "" {
+			return StatePrepared
+		}
+		return m.State
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.decisions) - 1; i >= 0; i-- {
+		if s.decisions[i].Message.ID == id {
+			return s.decisions[i].Decision
+		}
+	}
+	return ""
+}
+
+func (s *Sweeper) expired(m *Message) bool {
+	if m.State == StatePreCommitted {
+		return time.Since(m.PreCommittedAt) >= s.precommitTimeout
+	}
+	return time.Since(m.PreparedAt) >= s.timeout
+}
+
+func (s *Sweeper) record(e Expiry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.decisions = append(s.decisions, e)
+	if len(s.decisions) > s.limit {
+		s.decisions = s.decisions[len(s.decisions)-s.limit:]
+	}
+}
+
+// returns recent decisions about expired messages, the latest first
+func (s *Sweeper) Decisions() []Expiry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	decisions := make([]Expiry, 0, len(s.decisions))
+	for i := len(s.decisions) - 1; i >= 0; i-- {
+		decisions = append(decisions, s.decisions[i])
+	}
+	return decisions
+}
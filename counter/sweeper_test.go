@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweeper_sweep(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		return nil
+	})
+
+	c := &Counter{
+		Me:   "counter",
+		http: client,
+		store: preparedStorage(Messages{
+			{ID: "expired", Content: Items{{ID: "item-1", Tenant: "test"}}, PreparedAt: time.Now().Add(-time.Hour)},
+			{ID: "fresh", Content: Items{{ID: "item-2", Tenant: "test"}}, PreparedAt: time.Now()},
+			{ID: "3pc-prepared", Content: Items{{ID: "item-3", Tenant: "test"}}, Protocol: Protocol3PC, State: StatePrepared, PreparedAt: time.Now().Add(-time.Hour)},
+			{ID: "3pc-precommitted", Content: Items{{ID: "item-4", Tenant: "test"}}, Protocol: Protocol3PC, State: StatePreCommitted, PreparedAt: time.Now().Add(-time.Hour), PreCommittedAt: time.Now().Add(-time.Hour)},
+			{ID: "3pc-fresh", Content: Items{{ID: "item-5", Tenant: "test"}}, Protocol: Protocol3PC, State: StatePreCommitted, PreparedAt: time.Now().Add(-time.Hour), PreCommittedAt: time.Now()},
+		}...),
+	}
+
+	s := NewSweeper(c, time.Minute, time.Minute, 10)
+	s.sweep()
+
+	ids := []string{}
+	for _, m := range c.getMessages() {
+		ids = append(ids, m.ID)
+	}
+	// outcome of the 2PC message is unknown while the coordinator is unavailable
+	if want := []string{"expired", "fresh", "3pc-fresh"}; !reflect.DeepEqual(want, ids) {
+		t.Errorf("Want messages %+v, got %+v", want, ids)
+	}
+
+	if want := (Items{{ID: "item-4", Tenant: "test"}}); !reflect.DeepEqual(want, c.getItems()) {
+		t.Errorf("Want items %+v, got %+v", want, c.getItems())
+	}
+
+	decisions := []string{}
+	for _, e := range s.Decisions() {
+		decisions = append(decisions, e.Message.ID+" "+e.Decision)
+	}
+	want := []string{"3pc-precommitted committed", "3pc-prepared aborted"}
+	if !reflect.DeepEqual(want, decisions) {
+		t.Errorf("Want %+v, got %+v", want, decisions)
+	}
+}
+
+func TestSweeper_terminate(t *testing.T) {
+	states := map[string]string{
+		"peer-1/precommitted": `{"id":"precommitted","state":"precommitted"}`,
+		"peer-1/committed":    `{"id":"committed","state":"committed"}`,
+		"peer-1/prepared":     `{"id":"prepared","state":"prepared"}`,
+	}
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		if req.URL.Host == "coordinator" || req.URL.Host == "down" {
+			return &http.Response{StatusCode: 500, Body: ioutil.NopCloser(bytes.NewBufferString(``)), Header: make(http.Header)}
+		}
+		body, ok := states[req.URL.Host+strings.TrimPrefix(req.URL.Path, "/expired")]
+		if !ok {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`Unknown message`)), Header: make(http.Header)}
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body)), Header: make(http.Header)}
+	})
+
+	expired := func(id string, item string, participants ...string) Message {
+		return Message{ID: id, Content: Items{{ID: item, Tenant: "test"}}, Protocol: Protocol3PC, State: StatePrepared, PreparedAt: time.Now().Add(-time.Hour), Participants: participants}
+	}
+	c := &Counter{
+		Me:   "counter",
+		http: client,
+		store: preparedStorage(Messages{
+			expired("precommitted", "item-1", "counter", "peer-1", "peer-2"),
+			expired("committed", "item-2", "counter", "peer-1", "down"),
+			expired("prepared", "item-3", "counter", "peer-1", "peer-2"),
+			expired("unavailable", "item-4", "counter", "peer-1", "down"),
+		}...),
+	}
+
+	s := NewSweeper(c, time.Minute, time.Minute, 10)
+	s.sweep()
+
+	// participant which cannot tell its state may have precommitted
+	if ids := c.getMessages(); len(ids) != 1 || ids[0].ID != "unavailable" {
+		t.Errorf("Want only unavailable message kept, got %+v", ids)
+	}
+
+	decisions := []string{}
+	for _, e := range s.Decisions() {
+		decisions = append(decisions, e.Message.ID+" "+e.Decision)
+	}
+	want := []string{"prepared aborted", "committed committed", "precommitted committed"}
+	if !reflect.DeepEqual(want, decisions) {
+		t.Errorf("Want %+v, got %+v", want, decisions)
+	}
+
+	if state := s.State("committed"); state != DecisionCommitted {
+		t.Errorf("Want state of decided message committed, got '%s'", state)
+	}
+	if state := s.State("unavailable"); state != StatePrepared {
+		t.Errorf("Want state of kept message prepared, got '%s'", state)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import "time"
+
+// item deleted by a committed message with given version and sequence
+type Tombstone struct {
+	ID      string `json:"id"`
+	Tenant  string `json:"tenant"`
+	Version uint64 `json:"version"`
+	Seq     uint64 `json:"seq,omitempty"`
+}
+
+// removes items of the delete and keeps tombstones,
+// so copies of the items from a peer or a snapshot
+// taken before the delete are not added back
+// must be called with the lock held
+func (c *Counter) deleteLocked(m *Message, items Items) (int, error) {
+	if c.tombstones == nil {
+		c.tombstones = map[Item]Tombstone{}
+	}
+	for _, i := range items {
+		if m.Version >= c.tombstones[i].Version {
+			c.tombstones[i] = Tombstone{ID: i.ID, Tenant: i.Tenant, Version: m.Version, Seq: m.Seq}
+		}
+	}
+	deleted, err := c.store.Apply(&Message{ID: m.ID, Op: OpDelete, Content: items})
+	if err != nil {
+		l.Printf("[ERROR] Unable to delete items of %s: %s", m.ID, err.Error())
+	}
+	return deleted, err
+}
+
+// returns items which were not deleted by a later message,
+// items added again after the delete drop its tombstone
+// must be called with the lock held
+func (c *Counter) liveLocked(items Items, version uint64) Items {
+	live := Items{}
+	for _, i := range items {
+		deleted, ok := c.tombstones[i]
+		if !ok {
+			live = append(live, i)
+			continue
+		}
+		if version > deleted.Version {
+			delete(c.tombstones, i)
+			live = append(live, i)
+		}
+	}
+	return live
+}
+
+// returns items of a peer which applied every commit up to the sequence,
+// the peer applied the delete of an item it still has, so it added the item again
+// must be called with the lock held
+func (c *Counter) liveSinceLocked(items Items, seq uint64) Items {
+	live := Items{}
+	for _, i := range items {
+		deleted, ok := c.tombstones[i]
+		if !ok {
+			live = append(live, i)
+			continue
+		}
+		if deleted.Seq != 0 && deleted.Seq <= seq {
+			delete(c.tombstones, i)
+			live = append(live, i)
+		}
+	}
+	return live
+}
+
+// must be called with the lock held
+func (c *Counter) tombstoneList() []Tombstone {
+	tombstones := []Tombstone{}
+	for _, t := range c.tombstones {
+		tombstones = append(tombstones, t)
+	}
+	return tombstones
+}
+
+// replaces tombstones with the ones of a snapshot and removes their items
+// must be called with the lock held
+func (c *Counter) setTombstones(tombstones []Tombstone) {
+	c.tombstones = map[Item]Tombstone{}
+	items := Items{}
+	for _, t := range tombstones {
+		i := Item{ID: t.ID, Tenant: t.Tenant}
+		c.tombstones[i] = t
+		items = append(items, i)
+	}
+	if _, err := c.store.Delete(items); err != nil {
+		l.Printf("[ERROR] Unable to delete items of tombstones: %s", err.Error())
+	}
+}
+
+// removes items of the tombstones, e.g. of a snapshot
+// must be called with the lock held
+func (c *Counter) addTombstones(tombstones []Tombstone) {
+	if _, err := c.mergeTombstonesLocked(tombstones); err != nil {
+		l.Printf("[ERROR] Unable to delete items of tombstones: %s", err.Error())
+	}
+}
+
+// keeps tombstones of a peer and removes their items, returns the number of removed ones,
+// delete the counter already applied is skipped, as its item was added again since then
+// must be called with the lock held
+func (c *Counter) mergeTombstonesLocked(tombstones []Tombstone) (int, error) {
+	if c.tombstones == nil {
+		c.tombstones = map[Item]Tombstone{}
+	}
+	items := Items{}
+	for _, t := range tombstones {
+		i := Item{ID: t.ID, Tenant: t.Tenant}
+		local, found := c.tombstones[i]
+		if found && local.Version >= t.Version {
+			continue
+		}
+		if !found && t.Seq != 0 && c.isApplied(t.Seq) {
+			continue
+		}
+		c.tombstones[i] = t
+		items = append(items, i)
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+	return c.store.Delete(items)
+}
+
+func (c *Counter) getTombstones() []Tombstone {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tombstoneList()
+}
+
+// drops tombstones of deletes every counter applied, returns the number of dropped ones,
+// none of the counters has their items unless they were added again
+func (c *Counter) collectTombstones(horizon uint64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dropped := 0
+	for i, t := range c.tombstones {
+		if t.Seq != 0 && t.Seq <= horizon {
+			delete(c.tombstones, i)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// drops tombstones below the lowest sequence applied by registered counters
+// every interval, dead counters keep the horizon back until they are removed
+func (c *Counter) RunTombstoneGC(interval time.Duration) {
+	for range time.Tick(interval) {
+		horizon, err := c.horizon()
+		if err != nil {
+			l.Printf("[ERROR] Unable to get horizon of tombstones: %s", err.Error())
+			continue
+		}
+		if dropped := c.collectTombstones(horizon); dropped > 0 {
+			l.Printf("[INFO] %s dropped %d tombstones up to sequence %d", c.Me, dropped, horizon)
+		}
+	}
+}
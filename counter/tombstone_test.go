@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCounter_Delete(t *testing.T) {
+	c := NewCounter("counter", nil, nil)
+	c.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}}})
+
+	tt := []struct {
+		name   string
+		change func()
+		want   Items
+	}{
+		{
+			name: "delete",
+			change: func() {
+				c.apply(&Message{ID: "message-2", Version: 2, Op: OpDelete, Content: Items{{ID: "item-1", Tenant: "test"}}})
+			},
+			want: Items{{ID: "item-2", Tenant: "test"}},
+		},
+		{
+			name: "repair from a peer which missed the delete",
+			change: func() {
+				c.repair("test", Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}}, 1, 0)
+			},
+			want: Items{{ID: "item-2", Tenant: "test"}},
+		},
+		{
+			name: "snapshot of the coordinator taken before the delete",
+			change: func() {
+				c.catchUp(&CatchUp{Seq: 1, Snapshot: true, Items: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}}})
+			},
+			want: Items{{ID: "item-2", Tenant: "test"}},
+		},
+		{
+			name: "addition replayed after the delete",
+			change: func() {
+				c.apply(&Message{ID: "message-1", Version: 1, Content: Items{{ID: "item-1", Tenant: "test"}}})
+			},
+			want: Items{{ID: "item-2", Tenant: "test"}},
+		},
+		{
+			name: "added again after the delete",
+			change: func() {
+				c.apply(&Message{ID: "message-3", Version: 3, Content: Items{{ID: "item-1", Tenant: "test"}}})
+			},
+			want: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.change()
+
+			if items := c.getItems(); !reflect.DeepEqual(tc.want, items) {
+				t.Errorf("Want %+v, got %+v", tc.want, items)
+			}
+			if count := c.countItemsForTenant("test"); count.Value != len(tc.want) {
+				t.Errorf("Want count %d, got %d", len(tc.want), count.Value)
+			}
+		})
+	}
+}
+
+func TestApproximateDelete_Vote(t *testing.T) {
+	c := NewCounter("counter", nil, nil)
+	c.sketches = NewSketches([]string{"big"}, 12)
+
+	tt := []struct {
+		name   string
+		m      *Message
+		reason string
+	}{
+		{name: "delete of exact tenant", m: &Message{Op: OpDelete, Content: Items{{ID: "item-1", Tenant: "test"}}}},
+		{name: "addition to approximate tenant", m: &Message{Content: Items{{ID: "item-1", Tenant: "big"}}}},
+		{name: "delete of approximate tenant", m: &Message{Op: OpDelete, Content: Items{{ID: "item-1", Tenant: "big"}}}, reason: ReasonApproximate},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := ApproximateDelete{}.Vote(c, tc.m)
+			if (r == nil && tc.reason != "") || (r != nil && r.Reason != tc.reason) {
+				t.Errorf("Want reason '%s', got %+v", tc.reason, r)
+			}
+		})
+	}
+}
+
+func TestAntiEntropy_roundDeletes(t *testing.T) {
+	peer := NewCounter("peer", nil, nil)
+	peer.apply(&Message{ID: "message-1", Version: 1, Seq: 1, Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}, {ID: "item-3", Tenant: "test"}}})
+	peer.apply(&Message{ID: "message-2", Version: 2, Seq: 2, Op: OpDelete, Content: Items{{ID: "item-1", Tenant: "test"}}})
+	peer.apply(&Message{ID: "message-3", Version: 3, Seq: 3, Op: OpDelete, Content: Items{{ID: "item-3", Tenant: "test"}}})
+	peer.apply(&Message{ID: "message-4", Version: 4, Seq: 4, Content: Items{{ID: "item-3", Tenant: "test"}}})
+	peer.seq = 4
+
+	// counter missed the delete of item-1 and item-3 added again
+	c := NewCounter("counter", nil, nil)
+	c.apply(&Message{ID: "message-1", Version: 1, Seq: 1, Content: Items{{ID: "item-1", Tenant: "test"}, {ID: "item-2", Tenant: "test"}, {ID: "item-3", Tenant: "test"}}})
+	c.apply(&Message{ID: "message-3", Version: 3, Seq: 3, Op: OpDelete, Content: Items{{ID: "item-3", Tenant: "test"}}})
+	c.seq = 1
+	c.http = NewTestClient(func(req *http.Request) *http.Response {
+		rr := httptest.NewRecorder()
+		NewMerkle(peer).ServeHTTP(rr, req)
+		return rr.Result()
+	})
+
+	a := NewAntiEntropy(c, false)
+	for i := 0; i < 2; i++ {
+		if err := a.round("peer"); err != nil {
+			t.Fatalf("Round error: %s", err.Error())
+		}
+	}
+
+	if want := (Items{{ID: "item-2", Tenant: "test"}, {ID: "item-3", Tenant: "test"}}); !reflect.DeepEqual(want, c.getItems()) {
+		t.Errorf("Want %+v, got %+v", want, c.getItems())
+	}
+	if want := []Tombstone{{ID: "item-1", Tenant: "test", Version: 2, Seq: 2}}; !reflect.DeepEqual(want, c.getTombstones()) {
+		t.Errorf("Want %+v, got %+v", want, c.getTombstones())
+	}
+	if stats := a.Stats(); stats.TenantsDiverged != 1 || stats.ItemsDeleted != 1 || stats.ItemsRepaired != 1 {
+		t.Errorf("Want one divergence with 1 item deleted and 1 repaired, got %+v", stats)
+	}
+}
+
+func TestCounter_collectTombstones(t *testing.T) {
+	c := NewCounter("counter", nil, nil)
+	c.apply(&Message{ID: "message-1", Version: 1, Seq: 2, Op: OpDelete, Content: Items{{ID: "item-1", Tenant: "test"}}})
+	c.apply(&Message{ID: "message-2", Version: 2, Seq: 5, Op: OpDelete, Content: Items{{ID: "item-2", Tenant: "test"}}})
+
+	tt := []struct {
+		name     string
+		counters string
+		horizon  uint64
+		want     []Tombstone
+	}{
+		{
+			name:     "unregistered counter",
+			counters: `[{"addr":"peer","seq":4}]`,
+			want:     []Tombstone{{ID: "item-1", Tenant: "test", Version: 1, Seq: 2}, {ID: "item-2", Tenant: "test", Version: 2, Seq: 5}},
+		},
+		{
+			name:     "counter which did not report its sequence",
+			counters: `[{"addr":"counter","seq":4},{"addr":"peer"}]`,
+			want:     []Tombstone{{ID: "item-1", Tenant: "test", Version: 1, Seq: 2}, {ID: "item-2", Tenant: "test", Version: 2, Seq: 5}},
+		},
+		{
+			name:     "delete applied by every counter",
+			counters: `[{"addr":"counter","seq":4},{"addr":"peer","seq":3}]`,
+			horizon:  3,
+			want:     []Tombstone{{ID: "item-2", Tenant: "test", Version: 2, Seq: 5}},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c.http = NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(tc.counters)),
+					Header:     make(http.Header),
+				}
+			})
+
+			horizon, err := c.horizon()
+			if err != nil {
+				t.Fatalf("Horizon error: %s", err.Error())
+			}
+			if horizon != tc.horizon {
+				t.Errorf("Want horizon %d, got %d", tc.horizon, horizon)
+			}
+
+			c.collectTombstones(horizon)
+			tombstones := c.getTombstones()
+			sort.Slice(tombstones, func(i, j int) bool {
+				return tombstones[i].ID < tombstones[j].ID
+			})
+			if !reflect.DeepEqual(tc.want, tombstones) {
+				t.Errorf("Want %+v, got %+v", tc.want, tombstones)
+			}
+		})
+	}
+}
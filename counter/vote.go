@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ReasonDuplicateMessage = "duplicate_message"
+	ReasonItemsLocked      = "items_locked"
+	ReasonMemoryLimit      = "memory_limit"
+	ReasonTenantLimit      = "tenant_limit"
+	ReasonApproximate      = "approximate_tenant"
+)
+
+// reason of voting no, sent back to the coordinator
+type Rejection struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%s: %s", r.Reason, r.Message)
+}
+
+// decides whether the counter can promise to commit given message,
+// it is called with the counter lock held
+type VotePolicy interface {
+	Vote(c *Counter, m *Message) *Rejection
+}
+
+// votes no if any of the policies does
+type Policies []VotePolicy
+
+func (ps Policies) Vote(c *Counter, m *Message) *Rejection {
+	for _, p := range ps {
+		if r := p.Vote(c, m); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// refuses message with the id of a prepared one but other items,
+// retry of the same message is accepted before voting
+type DuplicateMessage struct{}
+
+func (DuplicateMessage) Vote(c *Counter, m *Message) *Rejection {
+	if _, ok := c.store.Prepared(m.ID); ok {
+		return &Rejection{Reason: ReasonDuplicateMessage, Message: fmt.Sprintf("message %s is already prepared", m.ID)}
+	}
+	return nil
+}
+
+// refuses message with items locked by another prepared message
+type LockedItems struct{}
+
+func (LockedItems) Vote(c *Counter, m *Message) *Rejection {
+	for _, i := range m.Content {
+		if id, ok := c.store.LockedBy(i); ok {
+			return &Rejection{Reason: ReasonItemsLocked, Message: fmt.Sprintf("item %s of %s is locked by %s", i.ID, i.Tenant, id)}
+		}
+	}
+	return nil
+}
+
+// Heap size sampled in the background, reading memory stats
+// stops the world, so it is not done on every vote.
+// Nil *HeapSampler reports an empty heap.
+type HeapSampler struct {
+	heapAlloc uint64
+}
+
+func NewHeapSampler() *HeapSampler {
+	s := &HeapSampler{}
+	s.sample()
+	return s
+}
+
+func (s *HeapSampler) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.sample()
+	}
+}
+
+func (s *HeapSampler) sample() {
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	atomic.StoreUint64(&s.heapAlloc, stats.HeapAlloc)
+}
+
+// returns heap size of the latest sample
+func (s *HeapSampler) HeapAlloc() uint64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.heapAlloc)
+}
+
+// refuses message when there are too many prepared messages
+// or sampled heap is over the limit, zero disables given limit
+type MemoryLimit struct {
+	MaxPrepared  int
+	MaxHeapBytes uint64
+	Heap         *HeapSampler
+}
+
+func (p MemoryLimit) Vote(c *Counter, m *Message) *Rejection {
+	if n := c.store.PreparedLen(); p.MaxPrepared > 0 && n >= p.MaxPrepared {
+		return &Rejection{Reason: ReasonMemoryLimit, Message: fmt.Sprintf("%d messages are already prepared", n)}
+	}
+
+	if heap := p.Heap.HeapAlloc(); p.MaxHeapBytes > 0 && heap >= p.MaxHeapBytes {
+		return &Rejection{Reason: ReasonMemoryLimit, Message: fmt.Sprintf("heap size %d exceeds %d bytes", heap, p.MaxHeapBytes)}
+	}
+	return nil
+}
+
+// refuses message which would make a tenant exceed
+// the number of distinct items, zero disables the limit
+type TenantLimit struct {
+	MaxItems int
+}
+
+func (p TenantLimit) Vote(c *Counter, m *Message) *Rejection {
+	if p.MaxItems <= 0 || m.Op == OpDelete {
+		return nil
+	}
+
+	// items not committed yet, prepared messages
+	// may be committed before this one
+	pending := Index{}
+	add := func(items Items) {
+		for _, i := range items {
+			if !c.store.Has(i) {
+				pending.Add(i)
+			}
+		}
+	}
+	for _, mess := range c.store.PreparedMessages() {
+		add(mess.Content)
+	}
+	add(m.Content)
+
+	for _, i := range m.Content {
+		// estimate is not exact enough to refuse a write
+		if c.sketches.Approximate(i.Tenant) {
+			continue
+		}
+		if n := c.store.Count(i.Tenant) + pending.Count(i.Tenant); n > p.MaxItems {
+			return &Rejection{Reason: ReasonTenantLimit, Message: fmt.Sprintf("tenant %s would have %d items, limit is %d", i.Tenant, n, p.MaxItems)}
+		}
+	}
+	return nil
+}
+
+// refuses delete of items of a tenant in approximate mode,
+// its sketch cannot forget them
+type ApproximateDelete struct{}
+
+func (ApproximateDelete) Vote(c *Counter, m *Message) *Rejection {
+	if m.Op != OpDelete {
+		return nil
+	}
+
+	for _, i := range m.Content {
+		if c.sketches.Approximate(i.Tenant) {
+			return &Rejection{Reason: ReasonApproximate, Message: fmt.Sprintf("items of %s are counted approximately and cannot be deleted", i.Tenant)}
+		}
+	}
+	return nil
+}